@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// UDP acknowledgements: with --ack, each datagram starts with a sequence
+// number that the receiver answers with a tiny ACK datagram, and the sender
+// retransmits datagrams that aren't acknowledged in time
+const (
+	SEQ_MAGIC           = "NPSEQ\x00\x00\x00"       // Marks a datagram that expects an ACK
+	SEQ_HEADER_SIZE     = len(SEQ_MAGIC) + 4        // Magic and sequence number
+	ACK_MAGIC           = "NPACK\x00\x00\x00"       // Marks an ACK sent back by the receiver
+	ACK_SIZE            = len(ACK_MAGIC) + 4        // Magic and acknowledged sequence number
+	ACK_PROBE           = AUTH_COMMAND + " \x00ACK" // Asks whether the receiver sends ACKs
+	ACK_PROBE_RESPONSE  = AUTH_RESPONSE + " \x00ACK"
+	DEFAULT_ACK_TIMEOUT = 500 * time.Millisecond // Time to wait for an ACK before retransmitting
+	DEFAULT_ACK_RETRIES = 3                      // Retransmissions before giving up on a datagram
+	ACK_WINDOW          = 1024                   // Sequence numbers remembered per source to drop retransmits
+	ACK_SOURCE_TIMEOUT  = time.Minute            // Sources silent for this long are forgotten
+)
+
+// ackSupported reports whether the receiver at host:port answers --ack
+// datagrams. Older receivers treat the probe like an instance probe from
+// another deployment and don't reply.
+func ackSupported(host string, port int) bool {
+	conn, err := net.DialTimeout("udp", hostPort(host, port), AUTH_TIMEOUT)
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(ACK_PROBE)); err != nil {
+		return false
+	}
+
+	buffer := make([]byte, 64)
+	conn.SetReadDeadline(time.Now().Add(AUTH_TIMEOUT))
+	n, err := conn.Read(buffer)
+	if err != nil {
+		return false
+	}
+	return string(buffer[:n]) == ACK_PROBE_RESPONSE
+}
+
+// addSequence returns data prefixed with the --ack header for seq
+func addSequence(data []byte, seq uint32) []byte {
+	datagram := make([]byte, SEQ_HEADER_SIZE, SEQ_HEADER_SIZE+len(data))
+	copy(datagram, SEQ_MAGIC)
+	binary.BigEndian.PutUint32(datagram[len(SEQ_MAGIC):], seq)
+	return append(datagram, data...)
+}
+
+// parseSequence returns the sequence number and payload of a datagram
+// sent with --ack, or false for any other datagram
+func parseSequence(datagram []byte) (uint32, []byte, bool) {
+	if len(datagram) < SEQ_HEADER_SIZE || !bytes.HasPrefix(datagram, []byte(SEQ_MAGIC)) {
+		return 0, nil, false
+	}
+	return binary.BigEndian.Uint32(datagram[len(SEQ_MAGIC):]), datagram[SEQ_HEADER_SIZE:], true
+}
+
+// newAck returns the ACK datagram for seq
+func newAck(seq uint32) []byte {
+	ack := make([]byte, ACK_SIZE)
+	copy(ack, ACK_MAGIC)
+	binary.BigEndian.PutUint32(ack[len(ACK_MAGIC):], seq)
+	return ack
+}
+
+// parseAck returns the sequence number acknowledged by an ACK datagram,
+// or false for any other datagram
+func parseAck(datagram []byte) (uint32, bool) {
+	if len(datagram) != ACK_SIZE || !bytes.HasPrefix(datagram, []byte(ACK_MAGIC)) {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(datagram[len(ACK_MAGIC):]), true
+}
+
+// pendingAck is a sent datagram still waiting for its ACK
+type pendingAck struct {
+	datagram []byte       // Datagram as sent, retransmitted unchanged
+	addr     *net.UDPAddr // Where it was sent
+	sentAt   time.Time    // Last time it was sent
+	attempts int          // Retransmissions so far
+}
+
+// AckTracker keeps the datagrams a --ack sender is waiting to have
+// acknowledged and retransmits them when their ACK doesn't arrive
+type AckTracker struct {
+	pending map[uint32]*pendingAck // Unacknowledged datagrams by sequence number
+	nextSeq uint32                 // Sequence number of the next datagram
+	timeout time.Duration          // Time to wait for an ACK
+	retries int                    // Retransmissions before giving up
+	lost    func()                 // Called for each datagram given up on
+	mutex   sync.Mutex             // Guards pending and nextSeq
+}
+
+// NewAckTracker creates the tracker for a --ack sender that calls lost for
+// each datagram never acknowledged. Sequence numbers start from the clock,
+// so a restarted sender isn't mistaken for retransmits of the previous one.
+func NewAckTracker(timeout time.Duration, retries int, lost func()) *AckTracker {
+	return &AckTracker{
+		pending: make(map[uint32]*pendingAck),
+		nextSeq: uint32(time.Now().UnixNano()),
+		timeout: timeout,
+		retries: retries,
+		lost:    lost,
+	}
+}
+
+// Next assigns a sequence number to data and returns the datagram to send
+func (at *AckTracker) Next(data []byte) (uint32, []byte) {
+	at.mutex.Lock()
+	defer at.mutex.Unlock()
+
+	at.nextSeq++
+	return at.nextSeq, addSequence(data, at.nextSeq)
+}
+
+// Sent records that datagram, as written to the socket, waits for the
+// ACK of seq
+func (at *AckTracker) Sent(seq uint32, datagram []byte, addr *net.UDPAddr) {
+	at.mutex.Lock()
+	defer at.mutex.Unlock()
+
+	at.pending[seq] = &pendingAck{datagram: datagram, addr: addr, sentAt: time.Now()}
+}
+
+// Ack stops waiting for seq, once acknowledged or when it couldn't be sent
+func (at *AckTracker) Ack(seq uint32) {
+	at.mutex.Lock()
+	defer at.mutex.Unlock()
+
+	delete(at.pending, seq)
+}
+
+// Due returns the datagrams whose ACK is overdue and should be sent again,
+// giving up on those already retransmitted --ack-retries times
+func (at *AckTracker) Due() []*pendingAck {
+	at.mutex.Lock()
+	defer at.mutex.Unlock()
+
+	var due []*pendingAck
+	now := time.Now()
+	for seq, pending := range at.pending {
+		if now.Sub(pending.sentAt) < at.timeout {
+			continue
+		}
+		if pending.attempts >= at.retries {
+			fmt.Fprintf(os.Stderr, "Datagram %d to %s not acknowledged after %d retransmissions, giving up\n", seq, pending.addr, pending.attempts)
+			delete(at.pending, seq)
+			if at.lost != nil {
+				at.lost()
+			}
+			continue
+		}
+		pending.attempts++
+		pending.sentAt = now
+		due = append(due, pending)
+	}
+	return due
+}
+
+// ackSource is the sequence numbers recently received from one sender
+type ackSource struct {
+	seen     map[uint32]bool // Set of the sequence numbers in order
+	order    []uint32        // Up to ACK_WINDOW sequence numbers, oldest first
+	lastSeen time.Time       // When the source last sent a datagram
+}
+
+// AckWindow remembers the sequence numbers received from each --ack
+// sender, so retransmits of datagrams whose ACK was lost are dropped
+type AckWindow struct {
+	sources map[string]*ackSource // Recent sequence numbers by source
+	mutex   sync.Mutex            // Guards sources against Expire
+}
+
+// NewAckWindow creates the receiver's window of acknowledged datagrams
+func NewAckWindow() *AckWindow {
+	return &AckWindow{sources: make(map[string]*ackSource)}
+}
+
+// Duplicate reports whether seq from source was already received, and
+// remembers it
+func (aw *AckWindow) Duplicate(source string, seq uint32) bool {
+	aw.mutex.Lock()
+	defer aw.mutex.Unlock()
+
+	src, exists := aw.sources[source]
+	if !exists {
+		src = &ackSource{seen: make(map[uint32]bool)}
+		aw.sources[source] = src
+	}
+	src.lastSeen = time.Now()
+
+	if src.seen[seq] {
+		return true
+	}
+	src.seen[seq] = true
+	src.order = append(src.order, seq)
+	if len(src.order) > ACK_WINDOW {
+		delete(src.seen, src.order[0])
+		src.order = src.order[1:]
+	}
+	return false
+}
+
+// Expire forgets the sources that sent nothing for ACK_SOURCE_TIMEOUT
+func (aw *AckWindow) Expire() {
+	aw.mutex.Lock()
+	defer aw.mutex.Unlock()
+
+	now := time.Now()
+	for source, src := range aw.sources {
+		if now.Sub(src.lastSeen) > ACK_SOURCE_TIMEOUT {
+			delete(aw.sources, source)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// TCP authentication: with --auth-secret the receiver sends a random
+// challenge and the sender answers with its HMAC-SHA256 under the shared
+// secret. With --auth-cmd each side runs a program on the connection
+// instead. Either way it happens after the handshake, before any data.
+const (
+	TCP_AUTH_CHALLENGE = "AUTH "          // Followed by the hex nonce and a newline
+	TCP_AUTH_ACCEPTED  = "AUTH OK"        // Sent by the receiver when the answer matches
+	TCP_AUTH_REJECTED  = "AUTH FAILED"    // Sent by the receiver before closing the connection
+	TCP_AUTH_NONCE     = 32               // Bytes of randomness in each challenge
+	TCP_AUTH_MAX_LINE  = 128              // Longest challenge or answer accepted
+	TCP_AUTH_TIMEOUT   = 10 * time.Second // Time the whole exchange may take
+)
+
+// authenticateClient runs the receiver side of the authentication
+// configured for a new connection. It returns nil if the client passed or
+// no authentication is configured.
+func authenticateClient(config *Config, conn net.Conn) error {
+	if config.authCmd != "" {
+		return runAuthCommand(config.authCmd, conn)
+	}
+	if config.authSecret == "" {
+		return nil
+	}
+
+	conn.SetDeadline(time.Now().Add(TCP_AUTH_TIMEOUT))
+	defer conn.SetDeadline(time.Time{})
+
+	nonce := make([]byte, TCP_AUTH_NONCE)
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("failed to generate challenge: %v", err)
+	}
+	challenge := hex.EncodeToString(nonce)
+	if _, err := writeFull(conn, []byte(TCP_AUTH_CHALLENGE+challenge+"\n")); err != nil {
+		return fmt.Errorf("failed to send challenge: %v", err)
+	}
+
+	answer, err := readAuthLine(conn)
+	if err != nil {
+		return fmt.Errorf("no answer to the challenge: %v", err)
+	}
+	if !hmac.Equal([]byte(answer), []byte(authAnswer(config.authSecret, challenge))) {
+		writeFull(conn, []byte(TCP_AUTH_REJECTED+"\n"))
+		return errors.New("wrong answer to the challenge")
+	}
+	_, err = writeFull(conn, []byte(TCP_AUTH_ACCEPTED+"\n"))
+	return err
+}
+
+// authenticateToReceiver runs the sender side of the authentication
+// configured for a new connection
+func authenticateToReceiver(config *Config, conn net.Conn) error {
+	if config.authCmd != "" {
+		return runAuthCommand(config.authCmd, conn)
+	}
+	if config.authSecret == "" {
+		return nil
+	}
+
+	conn.SetDeadline(time.Now().Add(TCP_AUTH_TIMEOUT))
+	defer conn.SetDeadline(time.Time{})
+
+	line, err := readAuthLine(conn)
+	if err != nil {
+		return fmt.Errorf("%s sent no authentication challenge: %v", conn.RemoteAddr(), err)
+	}
+	challenge, ok := strings.CutPrefix(line, TCP_AUTH_CHALLENGE)
+	if !ok {
+		return fmt.Errorf("%s sent %q instead of an authentication challenge; is it running with --auth-secret?", conn.RemoteAddr(), line)
+	}
+	if _, err := writeFull(conn, []byte(authAnswer(config.authSecret, challenge)+"\n")); err != nil {
+		return err
+	}
+
+	result, err := readAuthLine(conn)
+	if err != nil {
+		return fmt.Errorf("%s closed the connection during authentication: %v", conn.RemoteAddr(), err)
+	}
+	if result != TCP_AUTH_ACCEPTED {
+		return fmt.Errorf("%s rejected the authentication; check --auth-secret", conn.RemoteAddr())
+	}
+	return nil
+}
+
+// authAnswer is the expected answer to challenge: its hex HMAC-SHA256
+// under secret
+func authAnswer(secret, challenge string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(challenge))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// readAuthLine reads one line of the exchange. Like readHandshake, it reads
+// a byte at a time so data sent after it is left for the pipe.
+func readAuthLine(conn net.Conn) (string, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		n, err := conn.Read(b)
+		if n == 1 && b[0] == '\n' {
+			return string(line), nil
+		}
+		line = append(line, b[:n]...)
+		if err != nil {
+			return "", err
+		}
+		if len(line) > TCP_AUTH_MAX_LINE {
+			return "", errors.New("line too long")
+		}
+	}
+}
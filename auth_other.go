@@ -0,0 +1,14 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// runAuthCommand is not supported on this platform, since the connection
+// can't be handed to a program as its stdin and stdout
+func runAuthCommand(command string, conn net.Conn) error {
+	return errors.New("--auth-cmd is not supported on this platform")
+}
@@ -0,0 +1,75 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// runAuthCommand runs the --auth-cmd program through the shell with the
+// connection as its stdin and stdout, so it can talk to the peer directly.
+// NP_REMOTE_ADDR holds the peer's address. The peer passes if the program
+// exits with status 0 within TCP_AUTH_TIMEOUT.
+func runAuthCommand(command string, conn net.Conn) error {
+	filer, ok := conn.(interface{ File() (*os.File, error) })
+	if !ok {
+		return errors.New("--auth-cmd needs a plain TCP connection")
+	}
+	file, err := filer.File()
+	if err != nil {
+		return fmt.Errorf("failed to pass the connection to --auth-cmd: %v", err)
+	}
+	defer file.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), TCP_AUTH_TIMEOUT)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Stdin = file
+	cmd.Stdout = file
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), "NP_REMOTE_ADDR="+conn.RemoteAddr().String())
+
+	err = cmd.Run()
+
+	// Shells clear O_NONBLOCK on their stdin, which the copy shares with
+	// conn, and Go can only poll the connection with it set
+	if restoreErr := setNonblock(conn); restoreErr != nil && err == nil {
+		err = restoreErr
+	}
+	if ctx.Err() != nil {
+		return fmt.Errorf("--auth-cmd did not finish within %v", TCP_AUTH_TIMEOUT)
+	}
+	if err != nil {
+		return fmt.Errorf("--auth-cmd failed: %v", err)
+	}
+	return nil
+}
+
+// setNonblock puts conn back in non-blocking mode
+func setNonblock(conn net.Conn) error {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return nil
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var nbErr error
+	err = raw.Control(func(fd uintptr) {
+		nbErr = unix.SetNonblock(int(fd), true)
+	})
+	if err != nil {
+		return err
+	}
+	return nbErr
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd
+
+package main
+
+import "net"
+
+// setListenBacklog does nothing on this platform, where the listen backlog
+// can't be changed after Go opened the listener, so --backlog is ignored
+func setListenBacklog(listener net.Listener, backlog int) error {
+	return nil
+}
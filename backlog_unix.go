@@ -0,0 +1,36 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+
+package main
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// setListenBacklog calls listen() again on the listening socket with the
+// --backlog length. The socket Control callback runs before Go calls
+// listen() with its own backlog, so the length can only be changed
+// afterwards; calling listen() on a listening socket updates it in place.
+// The kernel still caps it at net.core.somaxconn (kern.ipc.somaxconn on
+// macOS and the BSDs).
+func setListenBacklog(listener net.Listener, backlog int) error {
+	tcpListener, ok := listener.(*net.TCPListener)
+	if !ok {
+		return nil
+	}
+
+	rawConn, err := tcpListener.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var listenErr error
+	err = rawConn.Control(func(fd uintptr) {
+		listenErr = unix.Listen(int(fd), backlog)
+	})
+	if err != nil {
+		return err
+	}
+	return listenErr
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DEFAULT_BENCH_SIZE is the amount of data sent by np bench
+const DEFAULT_BENCH_SIZE = "100MB"
+
+// sizeUnits maps the suffixes accepted by parseSize to their multiplier
+var sizeUnits = map[string]int64{
+	"":   1,
+	"B":  1,
+	"K":  1 << 10,
+	"KB": 1 << 10,
+	"M":  1 << 20,
+	"MB": 1 << 20,
+	"G":  1 << 30,
+	"GB": 1 << 30,
+	"T":  1 << 40,
+	"TB": 1 << 40,
+}
+
+// parseSize parses a byte count such as 4096, 512KB or 1GB. Units are
+// binary, like the sizes printed by np.
+func parseSize(value string) (int64, error) {
+	value = strings.ToUpper(strings.TrimSpace(value))
+	number := strings.TrimRight(value, "BKMGT")
+	multiplier, ok := sizeUnits[value[len(number):]]
+	if !ok {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+
+	n, err := strconv.ParseInt(strings.TrimSpace(number), 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	return n * multiplier, nil
+}
+
+// benchSource generates size zero bytes, like a limited /dev/zero, and
+// counts the bytes handed to the sender
+type benchSource struct {
+	remaining int64 // Bytes still to generate
+	read      int64 // Bytes generated so far
+}
+
+// Read implements io.Reader, returning io.EOF once size bytes were read
+func (bs *benchSource) Read(p []byte) (int, error) {
+	if bs.remaining <= 0 {
+		return 0, io.EOF
+	}
+
+	if int64(len(p)) > bs.remaining {
+		p = p[:bs.remaining]
+	}
+	for i := range p {
+		p[i] = 0
+	}
+
+	bs.remaining -= int64(len(p))
+	bs.read += int64(len(p))
+	return len(p), nil
+}
+
+// runBench streams --size bytes of generated data to a TCP receiver as fast
+// as possible, through the same transport and compression as a sender, and
+// prints the achieved throughput. The time is measured until the last write
+// returned, so run the receiver with --sink to keep it from being the
+// bottleneck.
+func runBench(config *Config, web *WebUIServer) error {
+	handler, err := createConnHandler(config, web)
+	if err != nil {
+		return err
+	}
+	defer handler.Close()
+
+	source := &benchSource{remaining: config.benchSize}
+	pipe := handler.(*TCPPipe)
+	pipe.input = source
+
+	fmt.Fprintf(os.Stderr, "Sending %s to %s\n", formatBytes(uint64(config.benchSize)), pipe.conn.RemoteAddr())
+	if config.compression != "none" {
+		fmt.Fprintf(os.Stderr, "Compression enabled: %s (level %d)\n", config.compression, config.compressLevel)
+	}
+
+	start := time.Now()
+	if err := handler.Start(); err != nil {
+		return err
+	}
+	elapsed := time.Since(start)
+
+	throughput := float64(source.read) / elapsed.Seconds()
+	fmt.Printf("Sent %s in %v: %s/s (%.1f Mbit/s)\n", formatBytes(uint64(source.read)),
+		elapsed.Round(time.Millisecond), formatBytes(uint64(throughput)), throughput*8/1e6)
+
+	if source.read < config.benchSize {
+		return fmt.Errorf("transfer interrupted after %s", formatBytes(uint64(source.read)))
+	}
+	return nil
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"fmt"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// bindToDevice sets SO_BINDTODEVICE so the socket only sends and receives
+// through the given network interface
+func bindToDevice(c syscall.RawConn, device string) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = unix.BindToDevice(int(fd), device)
+	})
+	if err != nil {
+		return err
+	}
+	if sockErr != nil {
+		return fmt.Errorf("failed to bind to device %s: %v", device, sockErr)
+	}
+	return nil
+}
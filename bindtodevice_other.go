@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// bindToDevice is only supported on Linux, so --bind-device fails elsewhere
+func bindToDevice(c syscall.RawConn, device string) error {
+	return fmt.Errorf("--bind-device is only supported on Linux")
+}
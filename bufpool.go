@@ -0,0 +1,31 @@
+package main
+
+import "sync"
+
+// bufferPool holds the BUFFER_SIZE buffers shared by the read loops with
+// --buffer-pool, so connections and messages don't each allocate their own
+var bufferPool = sync.Pool{
+	New: func() any {
+		return make([]byte, BUFFER_SIZE)
+	},
+}
+
+// getBuffer returns a buffer of size bytes, taken from the pool with
+// --buffer-pool when it fits in BUFFER_SIZE
+func getBuffer(config *Config, size int) []byte {
+	if !config.bufferPool || size > BUFFER_SIZE {
+		return make([]byte, size)
+	}
+	return bufferPool.Get().([]byte)[:size]
+}
+
+// putBuffer gives a buffer from getBuffer back to the pool. The caller must
+// not use it afterwards, nor keep anything that still references it: the
+// web interface and the outputs copy what they keep, so buffers can be put
+// back once the data was handled.
+func putBuffer(config *Config, buffer []byte) {
+	if !config.bufferPool || cap(buffer) != BUFFER_SIZE {
+		return
+	}
+	bufferPool.Put(buffer[:BUFFER_SIZE])
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Chat interface defaults
+const (
+	CHAT_PROMPT       = "> " // Prompt shown on the input line
+	CHAT_DEFAULT_ROWS = 24   // Terminal height used when it can't be detected
+	CHAT_DEFAULT_COLS = 80   // Terminal width used when it can't be detected
+)
+
+// ChatUI renders a minimal terminal chat interface: received messages scroll
+// in the upper part of the screen while the user types on the bottom line.
+// It implements io.Reader (typed lines) and io.Writer (received data) so it
+// can stand in for stdin/stdout in the pipe loops.
+type ChatUI struct {
+	in         *os.File   // Terminal input
+	out        *os.File   // Terminal output
+	stderr     *os.File   // Original stderr, restored on Close
+	stderrPipe *os.File   // Write end of the pipe capturing stderr
+	rows       int        // Terminal height
+	cols       int        // Terminal width
+	color      bool       // Color lines by direction with --color
+	mutex      sync.Mutex // Serializes screen updates
+	started    bool       // Whether the screen has been set up
+}
+
+// isTerminal reports whether the file is attached to a terminal
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// NewChatUI creates a chat interface on the given terminal, coloring sent,
+// received and notice lines if color is set
+func NewChatUI(in, out *os.File, color bool) *ChatUI {
+	rows, cols, ok := terminalSize(out)
+	if !ok || rows < 3 {
+		rows, cols = CHAT_DEFAULT_ROWS, CHAT_DEFAULT_COLS
+	}
+
+	return &ChatUI{
+		in:    in,
+		out:   out,
+		rows:  rows,
+		cols:  cols,
+		color: color,
+	}
+}
+
+// Start clears the screen and draws the input line. Status messages written
+// to stderr from then on are shown in the scroll area instead of garbling
+// the screen.
+func (ui *ChatUI) Start() {
+	ui.mutex.Lock()
+	defer ui.mutex.Unlock()
+
+	if ui.started {
+		return
+	}
+	ui.started = true
+
+	if r, w, err := os.Pipe(); err == nil {
+		ui.stderr = os.Stderr
+		ui.stderrPipe = w
+		os.Stderr = w
+		go ui.captureNotices(r)
+	}
+
+	// Clear the screen and restrict scrolling to all but the last two lines
+	fmt.Fprintf(ui.out, "\x1b[2J\x1b[1;%dr", ui.rows-2)
+	ui.drawInputLocked()
+}
+
+// Read returns the next line typed by the user and echoes it in the scroll area
+func (ui *ChatUI) Read(p []byte) (int, error) {
+	n, err := ui.in.Read(p)
+	if n > 0 {
+		ui.mutex.Lock()
+		for _, line := range splitLines(p[:n]) {
+			ui.printLocked(colorize(ui.color, COLOR_OUT, CHAT_PROMPT+line))
+		}
+		ui.drawInputLocked()
+		ui.mutex.Unlock()
+	}
+	return n, err
+}
+
+// Write displays received data in the scroll area, one entry per line
+func (ui *ChatUI) Write(p []byte) (int, error) {
+	ui.mutex.Lock()
+	defer ui.mutex.Unlock()
+
+	for _, line := range splitLines(p) {
+		ui.printLocked(colorize(ui.color, COLOR_IN, "< "+line))
+	}
+	return len(p), nil
+}
+
+// Close restores stderr and the terminal's scroll region
+func (ui *ChatUI) Close() error {
+	ui.mutex.Lock()
+	defer ui.mutex.Unlock()
+
+	if !ui.started {
+		return nil
+	}
+	ui.started = false
+
+	if ui.stderr != nil {
+		os.Stderr = ui.stderr
+		ui.stderrPipe.Close()
+	}
+
+	// Reset the scroll region and leave the cursor below the interface
+	fmt.Fprintf(ui.out, "\x1b[r\x1b[%d;1H\n", ui.rows)
+	return nil
+}
+
+// captureNotices shows lines written to stderr in the scroll area
+func (ui *ChatUI) captureNotices(r *os.File) {
+	defer r.Close()
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		ui.mutex.Lock()
+		ui.printLocked(colorize(ui.color, COLOR_NOTICE, "* "+sanitizeLine(scanner.Text())))
+		ui.mutex.Unlock()
+	}
+}
+
+// printLocked prints a line at the bottom of the scroll area, scrolling
+// older lines up, and returns the cursor to the input line
+func (ui *ChatUI) printLocked(line string) {
+	fmt.Fprintf(ui.out, "\x1b7\x1b[%d;1H\n%s\x1b8", ui.rows-2, line)
+}
+
+// drawInputLocked redraws the separator and an empty input line
+func (ui *ChatUI) drawInputLocked() {
+	fmt.Fprintf(ui.out, "\x1b[%d;1H\x1b[2K%s\x1b[%d;1H\x1b[2K%s",
+		ui.rows-1, strings.Repeat("-", ui.cols), ui.rows, CHAT_PROMPT)
+}
+
+// splitLines splits data into display lines, dropping the trailing newline
+func splitLines(data []byte) []string {
+	text := strings.TrimRight(string(data), "\r\n")
+	if text == "" {
+		return nil
+	}
+
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		lines[i] = sanitizeLine(line)
+	}
+	return lines
+}
+
+// sanitizeLine replaces control characters so remote data can't inject
+// terminal escape sequences into the interface
+func sanitizeLine(line string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '\t' {
+			return ' '
+		}
+		if r < 0x20 || r == 0x7f {
+			return '.'
+		}
+		return r
+	}, strings.TrimRight(line, "\r"))
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+)
+
+// CHECKSUM_SIZE is the length of the CRC-32 prepended to each datagram
+// with --checksum
+const CHECKSUM_SIZE = 4
+
+// addChecksum returns data prefixed with its CRC-32 (IEEE), big-endian
+func addChecksum(data []byte) []byte {
+	datagram := make([]byte, CHECKSUM_SIZE, CHECKSUM_SIZE+len(data))
+	binary.BigEndian.PutUint32(datagram, crc32.ChecksumIEEE(data))
+	return append(datagram, data...)
+}
+
+// verifyChecksum checks the CRC-32 prefix of a datagram and returns the
+// payload after it, or false when the datagram is too short or corrupt
+func verifyChecksum(datagram []byte) ([]byte, bool) {
+	if len(datagram) < CHECKSUM_SIZE {
+		return nil, false
+	}
+
+	payload := datagram[CHECKSUM_SIZE:]
+	return payload, binary.BigEndian.Uint32(datagram) == crc32.ChecksumIEEE(payload)
+}
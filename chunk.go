@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// UDP message chunking: messages larger than --mtu are split into
+// datagrams that each start with this header, so the receiver can put them
+// back together in order
+const (
+	CHUNK_MAGIC       = "NPCHUNK\x00"          // Marks a datagram as a chunk of a larger message
+	CHUNK_HEADER_SIZE = len(CHUNK_MAGIC) + 8   // Magic, message ID (4), index (2) and count (2)
+	CHUNK_MAX_COUNT   = 1<<16 - 1              // Most chunks a message can be split into
+	CHUNK_TIMEOUT     = 5 * time.Second        // Time an incomplete message waits for its missing chunks
+	CHUNK_MAX_PENDING = 64                     // Incomplete messages kept per source before the oldest is dropped
+	DEFAULT_MTU       = 1400                   // Largest datagram sent, below the usual path MTU
+	MIN_MTU           = CHUNK_HEADER_SIZE + 64 // Smallest --mtu that leaves room for data
+	MAX_MTU           = BUFFER_SIZE            // Largest datagram receivers read in one piece
+)
+
+// splitMessage splits data into datagrams of at most mtu bytes, reserving
+// overhead bytes of each for what sendDatagram adds. Messages that fit are
+// returned as is, so plain UDP peers keep working with short lines.
+func splitMessage(data []byte, id uint32, mtu, overhead int) ([][]byte, error) {
+	if mtu == 0 || len(data)+overhead <= mtu {
+		return [][]byte{data}, nil
+	}
+
+	size := mtu - overhead - CHUNK_HEADER_SIZE
+	count := (len(data) + size - 1) / size
+	if count > CHUNK_MAX_COUNT {
+		return nil, fmt.Errorf("message of %d bytes needs more than %d chunks, increase --mtu", len(data), CHUNK_MAX_COUNT)
+	}
+
+	chunks := make([][]byte, 0, count)
+	for index := 0; index < count; index++ {
+		end := (index + 1) * size
+		if end > len(data) {
+			end = len(data)
+		}
+
+		chunk := make([]byte, CHUNK_HEADER_SIZE, CHUNK_HEADER_SIZE+end-index*size)
+		copy(chunk, CHUNK_MAGIC)
+		binary.BigEndian.PutUint32(chunk[len(CHUNK_MAGIC):], id)
+		binary.BigEndian.PutUint16(chunk[len(CHUNK_MAGIC)+4:], uint16(index))
+		binary.BigEndian.PutUint16(chunk[len(CHUNK_MAGIC)+6:], uint16(count))
+		chunks = append(chunks, append(chunk, data[index*size:end]...))
+	}
+	return chunks, nil
+}
+
+// pendingMessage is a chunked message still missing some chunks
+type pendingMessage struct {
+	chunks    [][]byte  // Chunk payloads by index, nil until received
+	missing   int       // Chunks not received yet
+	startedAt time.Time // When the first chunk arrived
+}
+
+// ChunkAssembler puts chunked messages back together, keeping a separate
+// buffer for each source. Chunks may arrive in any order; messages still
+// incomplete after CHUNK_TIMEOUT are dropped.
+type ChunkAssembler struct {
+	pending map[string]map[uint32]*pendingMessage // Incomplete messages by source and ID
+	dropped func()                                // Called for each incomplete message dropped
+	mutex   sync.Mutex                            // Guards pending against Expire
+}
+
+// NewChunkAssembler creates an assembler for received chunks that calls
+// dropped for each incomplete message it gives up on
+func NewChunkAssembler(dropped func()) *ChunkAssembler {
+	return &ChunkAssembler{
+		pending: make(map[string]map[uint32]*pendingMessage),
+		dropped: dropped,
+	}
+}
+
+// Add processes a datagram from source. Datagrams that aren't chunks are
+// returned as is. For chunks, it returns the whole message once its last
+// chunk arrives, and ok false until then.
+func (ca *ChunkAssembler) Add(source string, datagram []byte) (message []byte, ok bool) {
+	if len(datagram) < CHUNK_HEADER_SIZE || !bytes.HasPrefix(datagram, []byte(CHUNK_MAGIC)) {
+		return datagram, true
+	}
+
+	header := datagram[len(CHUNK_MAGIC):CHUNK_HEADER_SIZE]
+	id := binary.BigEndian.Uint32(header)
+	index := int(binary.BigEndian.Uint16(header[4:]))
+	count := int(binary.BigEndian.Uint16(header[6:]))
+	if count == 0 || index >= count {
+		return nil, false
+	}
+
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+
+	messages, exists := ca.pending[source]
+	if !exists {
+		messages = make(map[uint32]*pendingMessage)
+		ca.pending[source] = messages
+	}
+
+	pending, exists := messages[id]
+	if !exists {
+		if len(messages) >= CHUNK_MAX_PENDING {
+			ca.dropOldest(source)
+		}
+		pending = &pendingMessage{
+			chunks:    make([][]byte, count),
+			missing:   count,
+			startedAt: time.Now(),
+		}
+		messages[id] = pending
+	}
+	if len(pending.chunks) != count || pending.chunks[index] != nil {
+		return nil, false
+	}
+
+	// Copy the payload, since the receive buffer is reused
+	pending.chunks[index] = append([]byte(nil), datagram[CHUNK_HEADER_SIZE:]...)
+	pending.missing--
+	if pending.missing > 0 {
+		return nil, false
+	}
+
+	ca.forget(source, id)
+	return bytes.Join(pending.chunks, nil), true
+}
+
+// Expire drops the messages that waited longer than CHUNK_TIMEOUT for
+// their missing chunks
+func (ca *ChunkAssembler) Expire() {
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+
+	now := time.Now()
+	for source, messages := range ca.pending {
+		for id, pending := range messages {
+			if now.Sub(pending.startedAt) > CHUNK_TIMEOUT {
+				ca.drop(source, id)
+			}
+		}
+	}
+}
+
+// dropOldest drops the message from source that has been incomplete the
+// longest, to make room for a new one
+func (ca *ChunkAssembler) dropOldest(source string) {
+	var oldest *pendingMessage
+	var oldestID uint32
+	for id, pending := range ca.pending[source] {
+		if oldest == nil || pending.startedAt.Before(oldest.startedAt) {
+			oldest, oldestID = pending, id
+		}
+	}
+	if oldest != nil {
+		ca.drop(source, oldestID)
+	}
+}
+
+// drop gives up on an incomplete message, reporting how much of it was lost
+func (ca *ChunkAssembler) drop(source string, id uint32) {
+	pending := ca.pending[source][id]
+	fmt.Fprintf(os.Stderr, "Dropped incomplete message %d from %s, %d of %d chunks missing\n", id, source, pending.missing, len(pending.chunks))
+	ca.forget(source, id)
+	if ca.dropped != nil {
+		ca.dropped()
+	}
+}
+
+// forget removes a message, and the buffer of its source once empty
+func (ca *ChunkAssembler) forget(source string, id uint32) {
+	delete(ca.pending[source], id)
+	if len(ca.pending[source]) == 0 {
+		delete(ca.pending, source)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import "os"
+
+// Values of --color
+const (
+	COLOR_AUTO   = "auto"   // Color when the output is a terminal
+	COLOR_ALWAYS = "always" // Color even when the output is redirected
+	COLOR_NEVER  = "never"  // Never color
+)
+
+// colorModes lists the valid --color values
+var colorModes = []string{COLOR_AUTO, COLOR_ALWAYS, COLOR_NEVER}
+
+// ANSI colors of the decorations around data: the chat prefixes and
+// notices and the --peek lines. The data itself is never colored.
+const (
+	COLOR_IN     = "\x1b[32m" // Received data, green
+	COLOR_OUT    = "\x1b[36m" // Sent data, cyan
+	COLOR_NOTICE = "\x1b[33m" // Status notices, yellow
+	COLOR_RESET  = "\x1b[0m"
+)
+
+// validColorMode reports whether mode is a known --color value
+func validColorMode(mode string) bool {
+	for _, known := range colorModes {
+		if mode == known {
+			return true
+		}
+	}
+	return false
+}
+
+// useColor reports whether decorations written to f are colored with
+// --color mode. In auto mode, terminals are colored unless NO_COLOR is set
+// or TERM is dumb. Anything that writes ANSI colors must check it first, so
+// --no-color and NO_COLOR are honored everywhere.
+func useColor(mode string, f *os.File) bool {
+	switch mode {
+	case COLOR_ALWAYS:
+		return true
+	case COLOR_NEVER:
+		return false
+	}
+	return isTerminal(f) && os.Getenv("NO_COLOR") == "" && os.Getenv("TERM") != "dumb"
+}
+
+// colorize returns s in color when enabled, and s as is otherwise
+func colorize(enabled bool, color, s string) string {
+	if !enabled {
+		return s
+	}
+	return color + s + COLOR_RESET
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"container/list"
+	"hash/fnv"
+	"time"
+)
+
+// Deduplication defaults
+const (
+	DEFAULT_DEDUP_WINDOW = time.Second // How long a datagram is remembered
+	DEFAULT_DEDUP_SIZE   = 1024        // Maximum number of datagrams remembered
+)
+
+// dedupEntry is a remembered datagram hash and when it was last seen
+type dedupEntry struct {
+	hash   uint64
+	seenAt time.Time
+}
+
+// DedupWindow remembers the hashes of recently received datagrams in a
+// bounded LRU, so exact duplicates from the same sender can be dropped.
+// It is used by the single receive goroutine and isn't safe for
+// concurrent use.
+type DedupWindow struct {
+	window  time.Duration            // Duplicates older than this are accepted again
+	size    int                      // Maximum number of hashes kept
+	entries map[uint64]*list.Element // Hashes by value, pointing into order
+	order   *list.List               // Hashes, most recently seen first
+}
+
+// NewDedupWindow creates a deduplication window for --dedup
+func NewDedupWindow(window time.Duration, size int) *DedupWindow {
+	if window <= 0 {
+		window = DEFAULT_DEDUP_WINDOW
+	}
+	if size <= 0 {
+		size = DEFAULT_DEDUP_SIZE
+	}
+
+	return &DedupWindow{
+		window:  window,
+		size:    size,
+		entries: make(map[uint64]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// Duplicate reports whether the same data from the same source was seen
+// within the window, and remembers it
+func (dw *DedupWindow) Duplicate(source string, data []byte) bool {
+	hasher := fnv.New64a()
+	hasher.Write([]byte(source))
+	hasher.Write([]byte{0})
+	hasher.Write(data)
+	hash := hasher.Sum64()
+
+	now := time.Now()
+	if element, exists := dw.entries[hash]; exists {
+		entry := element.Value.(*dedupEntry)
+		duplicate := now.Sub(entry.seenAt) < dw.window
+		entry.seenAt = now
+		dw.order.MoveToFront(element)
+		return duplicate
+	}
+
+	dw.entries[hash] = dw.order.PushFront(&dedupEntry{hash: hash, seenAt: now})
+
+	// Forget the least recently seen hash when full
+	if dw.order.Len() > dw.size {
+		oldest := dw.order.Back()
+		dw.order.Remove(oldest)
+		delete(dw.entries, oldest.Value.(*dedupEntry).hash)
+	}
+	return false
+}
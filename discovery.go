@@ -4,7 +4,9 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"regexp"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -13,11 +15,24 @@ import (
 
 // mDNS service discovery constants
 const (
-	SERVICE_TYPE      = "_np._tcp"      // mDNS service type
-	SERVICE_DOMAIN    = "local."        // mDNS service domain
-	DISCOVERY_TIMEOUT = 5 * time.Second // Default timeout for service discovery
+	SERVICE_TYPE      = "_np._tcp"             // Default mDNS service type
+	SERVICE_DOMAIN    = "local."               // mDNS service domain
+	DISCOVERY_TIMEOUT = 5 * time.Second        // Default timeout for service discovery
+	DISCOVERY_GRACE   = 500 * time.Millisecond // Time clients that discovered a stopping receiver get to connect
 )
 
+// serviceTypePattern matches DNS-SD service types (RFC 6763): a service
+// name of up to 15 letters, digits and hyphens, then _tcp or _udp
+var serviceTypePattern = regexp.MustCompile(`^_[A-Za-z0-9]([A-Za-z0-9-]{0,13}[A-Za-z0-9])?\._(tcp|udp)$`)
+
+// validServiceType reports whether serviceType is a valid DNS-SD service
+// type such as _np._tcp
+func validServiceType(serviceType string) bool {
+	name := strings.SplitN(serviceType, ".", 2)[0]
+	return serviceTypePattern.MatchString(serviceType) && !strings.Contains(name, "--") &&
+		strings.ContainsAny(name, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
+}
+
 // ServiceInfo contains detailed information about a discovered service
 type ServiceInfo struct {
 	Name      string   // Service name
@@ -28,30 +43,43 @@ type ServiceInfo struct {
 	Text      []string // TXT record contents
 	TTL       uint32   // Time to live
 	IsTCP     bool     // Whether the service uses TCP
+	Token     string   // Value of the token TXT key, if announced
+	Version   string   // Value of the version TXT key, if announced
+	Cached    bool     `json:"-"` // Loaded from the discovery cache, not seen on the network yet
 }
 
 // DiscoveryService manages service discovery and service announcement
 // using multicast DNS (mDNS/Bonjour/Avahi)
 type DiscoveryService struct {
-	config     *Config                // Application configuration
-	server     *zeroconf.Server       // mDNS server for service announcement
-	mutex      sync.Mutex             // Mutex for thread-safe access
-	services   map[string]ServiceInfo // Discovered services by name
-	isRunning  bool                   // Whether discovery is active
-	stopBrowse context.CancelFunc     // Function to stop service discovery
+	config      *Config                // Application configuration
+	serviceType string                 // mDNS service type announced and browsed
+	server      *zeroconf.Server       // mDNS server for service announcement
+	mutex       sync.Mutex             // Mutex for thread-safe access
+	services    map[string]ServiceInfo // Discovered services by name
+	isRunning   bool                   // Whether discovery is active
+	stopBrowse  context.CancelFunc     // Function to stop service discovery
+	selected    *ServiceInfo           // Service the sender connects to, if discovered
+
+	announceName  string        // Instance name announced by StartAnnounce
+	announcePort  int           // Port announced by StartAnnounce
+	announceText  []string      // TXT records announced by StartAnnounce
+	announceAddrs string        // Host addresses when the service was registered
+	stopAnnounce  chan struct{} // Closed by StopAnnounce to end keepAnnounced
 }
 
 // NewDiscoveryService creates a new service discovery instance
 func NewDiscoveryService(config *Config) *DiscoveryService {
 	return &DiscoveryService{
-		config:    config,
-		services:  make(map[string]ServiceInfo),
-		isRunning: false,
+		config:      config,
+		serviceType: config.mdnsService,
+		services:    make(map[string]ServiceInfo),
+		isRunning:   false,
 	}
 }
 
 // StartAnnounce broadcasts this service on the local network via mDNS
-// allowing other NP instances to discover it automatically
+// allowing other NP instances to discover it automatically. Registration
+// runs in the background, see keepAnnounced.
 func (ds *DiscoveryService) StartAnnounce(serviceName string, port int, isTCP bool) error {
 	ds.mutex.Lock()
 	defer ds.mutex.Unlock()
@@ -66,48 +94,63 @@ func (ds *DiscoveryService) StartAnnounce(serviceName string, port int, isTCP bo
 		proto = "tcp"
 	}
 
-	// Register the service with mDNS
-	server, err := zeroconf.Register(
-		serviceName,                // Service name
-		SERVICE_TYPE,               // Service type
-		SERVICE_DOMAIN,             // Domain
-		port,                       // Port
-		[]string{"proto=" + proto}, // TXT records
-		nil,                        // Interfaces (all)
-	)
-
-	if err != nil {
-		return fmt.Errorf("failed to register mDNS service: %v", err)
+	// Announce the version, and the token so senders can tell deployments
+	// apart
+	text := []string{"proto=" + proto, "version=" + Version}
+	if ds.config.serviceToken != "" {
+		text = append(text, "token="+ds.config.serviceToken)
 	}
 
-	ds.server = server
+	ds.announceName = serviceName
+	ds.announcePort = port
+	ds.announceText = text
+	ds.stopAnnounce = make(chan struct{})
 	ds.isRunning = true
 
+	go ds.keepAnnounced(ds.stopAnnounce)
 	return nil
 }
 
-// StopAnnounce stops the service announcement
-func (ds *DiscoveryService) StopAnnounce() {
+// StopAnnounce stops the service announcement. It returns whether the
+// service was being announced.
+func (ds *DiscoveryService) StopAnnounce() bool {
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+
+	announced := ds.stopAnnounce != nil
+	if announced {
+		close(ds.stopAnnounce)
+		ds.stopAnnounce = nil
+	}
+
 	if ds.server != nil {
 		ds.server.Shutdown()
 		ds.server = nil
 		fmt.Fprintf(os.Stderr, "mDNS service announcement stopped\n")
 	}
+	return announced
 }
 
 // StartBrowse begins looking for NP services on the local network
 func (ds *DiscoveryService) StartBrowse() error {
+	return ds.StartBrowseContext(context.Background())
+}
+
+// StartBrowseContext begins looking for NP services on the local network
+// until StopBrowse is called or ctx is cancelled
+func (ds *DiscoveryService) StartBrowseContext(ctx context.Context) error {
 	if ds.isRunning {
 		return fmt.Errorf("discovery is already running")
 	}
 
 	// Create a cancelable context
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(ctx)
 	ds.stopBrowse = cancel
 
 	// Configure the resolver
 	resolver, err := zeroconf.NewResolver(nil)
 	if err != nil {
+		cancel()
 		return fmt.Errorf("failed to create mDNS resolver: %v", err)
 	}
 
@@ -122,8 +165,9 @@ func (ds *DiscoveryService) StartBrowse() error {
 	}()
 
 	// Start searching for services
-	err = resolver.Browse(ctx, SERVICE_TYPE, SERVICE_DOMAIN, entries)
+	err = resolver.Browse(ctx, ds.serviceType, SERVICE_DOMAIN, entries)
 	if err != nil {
+		cancel()
 		return fmt.Errorf("failed to start mDNS search: %v", err)
 	}
 
@@ -158,12 +202,18 @@ func (ds *DiscoveryService) addService(entry *zeroconf.ServiceEntry) {
 		IsTCP:     false, // Default to UDP
 	}
 
-	// Check for protocol information
+	// Check for protocol, token and version information
 	for _, text := range entry.Text {
 		if text == "proto=tcp" {
 			service.Protocol = "tcp"
 			service.IsTCP = true
 		}
+		if token, ok := strings.CutPrefix(text, "token="); ok {
+			service.Token = token
+		}
+		if version, ok := strings.CutPrefix(text, "version="); ok {
+			service.Version = version
+		}
 	}
 
 	// Get IP addresses
@@ -174,9 +224,9 @@ func (ds *DiscoveryService) addService(entry *zeroconf.ServiceEntry) {
 		service.Addresses = append(service.Addresses, addr.String())
 	}
 
-	// Add the service to the list
-	serviceId := fmt.Sprintf("%s:%d", service.Name, service.Port)
-	ds.services[serviceId] = service
+	// Add the service to the list and the cache file, if enabled
+	ds.services[serviceKey(service)] = service
+	ds.saveCacheLocked()
 
 	fmt.Fprintf(os.Stderr, "Discovered NP service: %s at %s:%d (%s)\n",
 		service.Name, service.Host, service.Port, service.Protocol)
@@ -196,20 +246,35 @@ func (ds *DiscoveryService) GetServices() []ServiceInfo {
 
 // FindService searches for a service with a timeout
 func (ds *DiscoveryService) FindService(timeout time.Duration) ([]ServiceInfo, error) {
+	return ds.FindServiceContext(context.Background(), timeout)
+}
+
+// FindServiceContext searches for services for timeout, or until ctx is
+// cancelled. On cancellation it returns right away with the services found
+// so far and ctx's error.
+func (ds *DiscoveryService) FindServiceContext(ctx context.Context, timeout time.Duration) ([]ServiceInfo, error) {
 	// Start discovery
-	err := ds.StartBrowse()
+	err := ds.StartBrowseContext(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	// Wait for timeout
-	time.Sleep(timeout)
+	// Wait for timeout or cancellation
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
 
 	// Stop discovery
 	ds.StopBrowse()
 
 	// Return found services
 	services := ds.GetServices()
+	if ctx.Err() != nil {
+		return services, ctx.Err()
+	}
 	if len(services) == 0 {
 		return nil, fmt.Errorf("no NP services found on the network")
 	}
@@ -219,9 +284,16 @@ func (ds *DiscoveryService) FindService(timeout time.Duration) ([]ServiceInfo, e
 
 // ChooseServiceInteractive allows the user to choose a service interactively
 func (ds *DiscoveryService) ChooseServiceInteractive() (*ServiceInfo, error) {
+	return ds.ChooseServiceInteractiveContext(context.Background())
+}
+
+// ChooseServiceInteractiveContext allows the user to choose a service
+// interactively, giving up with ctx's error when ctx is cancelled during
+// the search or while waiting for the choice
+func (ds *DiscoveryService) ChooseServiceInteractiveContext(ctx context.Context) (*ServiceInfo, error) {
 	fmt.Println("Searching for NP services on the local network...")
 
-	services, err := ds.FindService(DISCOVERY_TIMEOUT)
+	services, err := ds.FindServiceContext(ctx, DISCOVERY_TIMEOUT)
 	if err != nil {
 		return nil, err
 	}
@@ -236,19 +308,29 @@ func (ds *DiscoveryService) ChooseServiceInteractive() (*ServiceInfo, error) {
 		fmt.Printf("%d) %s at %s:%d (%s)\n", i+1, service.Name, addr, service.Port, service.Protocol)
 	}
 
-	// Ask the user which service to connect to
-	var choice int
-	for {
-		fmt.Print("\nChoose a service (1-" + strconv.Itoa(len(services)) + "): ")
-		_, err := fmt.Scanf("%d", &choice)
-		if err == nil && choice >= 1 && choice <= len(services) {
-			break
+	// Ask the user which service to connect to. Reading stdin can't be
+	// interrupted, so it happens in a goroutine left behind on cancellation.
+	chosen := make(chan int, 1)
+	go func() {
+		var choice int
+		for {
+			fmt.Print("\nChoose a service (1-" + strconv.Itoa(len(services)) + "): ")
+			_, err := fmt.Scanf("%d", &choice)
+			if err == nil && choice >= 1 && choice <= len(services) {
+				chosen <- choice
+				return
+			}
+			fmt.Println("Invalid choice. Try again.")
 		}
-		fmt.Println("Invalid choice. Try again.")
-	}
+	}()
 
 	// Return the chosen service
-	return &services[choice-1], nil
+	select {
+	case choice := <-chosen:
+		return &services[choice-1], nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
 }
 
 // Close releases discovery service resources
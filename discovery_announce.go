@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/grandcat/zeroconf"
+)
+
+// mDNS announcement defaults
+const (
+	DEFAULT_MDNS_RETRIES = 10               // Times registration is retried before giving up
+	MDNS_WATCH_INTERVAL  = 10 * time.Second // How often the host addresses are checked after registering
+)
+
+// keepAnnounced registers the service, retrying with backoff while the
+// network isn't ready, then registers it again whenever the host addresses
+// change, since the zeroconf server only answers with the addresses it saw
+// when it was registered. It returns when stop is closed or the retries run
+// out.
+func (ds *DiscoveryService) keepAnnounced(stop chan struct{}) {
+	for {
+		err := retryConnect(ds.config, ds.config.mdnsRetries, "Announcing mDNS service", func() error {
+			return ds.register(stop)
+		})
+		if isClosed(stop) {
+			return
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: Failed to announce mDNS service: %v\n", err)
+			return
+		}
+		fmt.Fprintf(os.Stderr, "Announced service via mDNS\n")
+
+		if !ds.waitForAddressChange(stop) {
+			return
+		}
+		fmt.Fprintf(os.Stderr, "Network addresses changed, announcing the mDNS service again\n")
+	}
+}
+
+// register replaces the zeroconf server with a new registration of the
+// service. It does nothing once stop is closed.
+func (ds *DiscoveryService) register(stop chan struct{}) error {
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+
+	if isClosed(stop) {
+		return nil
+	}
+
+	if ds.server != nil {
+		ds.server.Shutdown()
+		ds.server = nil
+	}
+
+	addrs := hostAddrs()
+	server, err := zeroconf.Register(
+		ds.announceName, // Service name
+		ds.serviceType,  // Service type
+		SERVICE_DOMAIN,  // Domain
+		ds.announcePort, // Port
+		ds.announceText, // TXT records
+		nil,             // Interfaces (all)
+	)
+	if err != nil {
+		return fmt.Errorf("failed to register mDNS service: %v", err)
+	}
+
+	ds.server = server
+	ds.announceAddrs = addrs
+	return nil
+}
+
+// waitForAddressChange polls the host addresses until they differ from the
+// registered ones, returning true, or stop is closed, returning false
+func (ds *DiscoveryService) waitForAddressChange(stop chan struct{}) bool {
+	ticker := time.NewTicker(MDNS_WATCH_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return false
+		case <-ticker.C:
+			ds.mutex.Lock()
+			changed := hostAddrs() != ds.announceAddrs
+			ds.mutex.Unlock()
+
+			if changed {
+				return true
+			}
+		}
+	}
+}
+
+// hostAddrs lists the addresses of the interfaces mDNS announces on, up
+// and multicast-capable ones, as a sorted string for comparison
+func hostAddrs() string {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return ""
+	}
+
+	var addrs []string
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagMulticast == 0 {
+			continue
+		}
+		ifaceAddrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range ifaceAddrs {
+			addrs = append(addrs, iface.Name+"="+addr.String())
+		}
+	}
+
+	sort.Strings(addrs)
+	return strings.Join(addrs, ",")
+}
+
+// isClosed reports whether ch was closed, without blocking
+func isClosed(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// LoadCache seeds the discovered services with the ones saved in the
+// --discovery-cache file. A missing file is not an error.
+func (ds *DiscoveryService) LoadCache(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read discovery cache: %v", err)
+	}
+
+	var services []ServiceInfo
+	if err := json.Unmarshal(data, &services); err != nil {
+		return fmt.Errorf("failed to parse discovery cache %s: %v", path, err)
+	}
+
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+
+	for _, service := range services {
+		service.Cached = true
+		ds.services[serviceKey(service)] = service
+	}
+	return nil
+}
+
+// saveCacheLocked writes the discovered services to the --discovery-cache
+// file, if one is configured. The caller must hold ds.mutex.
+func (ds *DiscoveryService) saveCacheLocked() {
+	path := ds.config.discoveryCache
+	if path == "" {
+		return
+	}
+
+	services := make([]ServiceInfo, 0, len(ds.services))
+	for _, service := range ds.services {
+		services = append(services, service)
+	}
+
+	data, err := json.MarshalIndent(services, "", "  ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to encode discovery cache: %v\n", err)
+		return
+	}
+
+	// Replace the file atomically so a concurrent run never reads half of it
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to write discovery cache: %v\n", err)
+		return
+	}
+	_, err = tmp.Write(append(data, '\n'))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		fmt.Fprintf(os.Stderr, "Warning: failed to write discovery cache: %v\n", err)
+	}
+}
+
+// PruneCached forgets a cached service that could not be reached and
+// updates the cache file. It is kept if mDNS has seen it again meanwhile.
+func (ds *DiscoveryService) PruneCached(service ServiceInfo) {
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+
+	key := serviceKey(service)
+	if current, exists := ds.services[key]; !exists || !current.Cached {
+		return
+	}
+	delete(ds.services, key)
+	ds.saveCacheLocked()
+}
+
+// serviceKey identifies a service in the discovered services map
+func serviceKey(service ServiceInfo) string {
+	return fmt.Sprintf("%s:%d", service.Name, service.Port)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// fileList collects the values of a repeatable flag, such as --file
+type fileList []string
+
+// String returns the files joined by commas
+func (fl *fileList) String() string {
+	return strings.Join(*fl, ",")
+}
+
+// Set appends a file to the list
+func (fl *fileList) Set(value string) error {
+	*fl = append(*fl, value)
+	return nil
+}
+
+// MultiFileReader reads several files back-to-back, in order, reporting the
+// progress of each file on stderr. Files are opened only when reached.
+type MultiFileReader struct {
+	files       []string // Files to read, in order
+	delimiter   []byte   // Written between two files
+	skipMissing bool     // Skip files that can't be opened instead of failing
+
+	index   int      // Index of the next file to open
+	current *os.File // File being read, nil between files
+	pending []byte   // Remainder of the delimiter still to be returned
+	started bool     // Whether a file was already read, to place delimiters
+	sent    int      // Files opened so far
+	read    int64    // Bytes read from the current file
+	total   int64    // Bytes read from all files
+}
+
+// NewMultiFileReader creates a reader for the given files
+func NewMultiFileReader(files []string, delimiter string, skipMissing bool) *MultiFileReader {
+	return &MultiFileReader{
+		files:       files,
+		delimiter:   []byte(delimiter),
+		skipMissing: skipMissing,
+	}
+}
+
+// Read implements io.Reader, returning io.EOF after the last file
+func (mr *MultiFileReader) Read(p []byte) (int, error) {
+	for {
+		if len(mr.pending) > 0 {
+			n := copy(p, mr.pending)
+			mr.pending = mr.pending[n:]
+			return n, nil
+		}
+
+		if mr.current == nil {
+			if err := mr.openNext(); err != nil {
+				return 0, err
+			}
+			continue
+		}
+
+		n, err := mr.current.Read(p)
+		mr.read += int64(n)
+		mr.total += int64(n)
+		if err == io.EOF {
+			mr.finishCurrent()
+			err = nil
+		}
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+}
+
+// openNext opens the next file, queueing the delimiter before it when a
+// previous file was sent
+func (mr *MultiFileReader) openNext() error {
+	for mr.index < len(mr.files) {
+		name := mr.files[mr.index]
+		mr.index++
+
+		file, err := os.Open(name)
+		if err != nil {
+			if mr.skipMissing {
+				fmt.Fprintf(os.Stderr, "Skipping file %s: %v\n", name, err)
+				continue
+			}
+			return fmt.Errorf("failed to open input file: %v", err)
+		}
+
+		fmt.Fprintf(os.Stderr, "Sending file %d/%d: %s\n", mr.index, len(mr.files), name)
+
+		if mr.started {
+			mr.pending = mr.delimiter
+		}
+		mr.started = true
+		mr.current = file
+		mr.sent++
+		mr.read = 0
+		return nil
+	}
+
+	fmt.Fprintf(os.Stderr, "Sent %d files: %d bytes in total\n", mr.sent, mr.total)
+	return io.EOF
+}
+
+// finishCurrent closes the file being read and reports its size
+func (mr *MultiFileReader) finishCurrent() {
+	fmt.Fprintf(os.Stderr, "Sent %s: %d bytes (total %d bytes)\n", mr.current.Name(), mr.read, mr.total)
+	mr.current.Close()
+	mr.current = nil
+}
+
+// Close closes the file being read, if any
+func (mr *MultiFileReader) Close() error {
+	if mr.current == nil {
+		return nil
+	}
+	err := mr.current.Close()
+	mr.current = nil
+	return err
+}
+
+// unescapeDelimiter interprets escape sequences such as \n and \t in the
+// --file-delimiter value, keeping it as given when it isn't valid
+func unescapeDelimiter(value string) string {
+	unquoted, err := strconv.Unquote(`"` + strings.ReplaceAll(value, `"`, `\"`) + `"`)
+	if err != nil {
+		return value
+	}
+	return unquoted
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"time"
+)
+
+// Output formats selected with --output-format
+const (
+	OUTPUT_RAW  = "raw"  // Data as received
+	OUTPUT_HEX  = "hex"  // Hex dump of each message
+	OUTPUT_JSON = "json" // One JSON object per message
+	OUTPUT_PEEK = "peek" // One summary line per message, as with --peek
+)
+
+// outputFormats lists the valid --output-format values
+var outputFormats = []string{OUTPUT_RAW, OUTPUT_HEX, OUTPUT_JSON, OUTPUT_PEEK}
+
+// outputRecord is a received message in the json output format. The data
+// is base64-encoded by encoding/json.
+type outputRecord struct {
+	Timestamp time.Time `json:"ts"`
+	From      string    `json:"from"`
+	Size      int       `json:"size"`
+	Data      []byte    `json:"data_base64"`
+}
+
+// writeFormatted writes a message received from source to w in the given
+// output format. Only the peek summaries are colored with color, never the
+// data itself.
+func writeFormatted(w io.Writer, format string, color bool, source string, data []byte) error {
+	switch format {
+	case OUTPUT_HEX:
+		_, err := io.WriteString(w, hex.Dump(data))
+		return err
+	case OUTPUT_JSON:
+		line, err := json.Marshal(outputRecord{Timestamp: time.Now(), From: source, Size: len(data), Data: data})
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(append(line, '\n'))
+		return err
+	case OUTPUT_PEEK:
+		return writePeek(w, "in", source, data, color)
+	}
+
+	_, err := w.Write(data)
+	return err
+}
+
+// validOutputFormat reports whether format is a known --output-format value
+func validOutputFormat(format string) bool {
+	for _, known := range outputFormats {
+		if format == known {
+			return true
+		}
+	}
+	return false
+}
@@ -5,6 +5,7 @@ go 1.20
 require (
 	github.com/grandcat/zeroconf v1.0.0
 	github.com/klauspost/compress v1.17.2
+	golang.org/x/sys v0.8.0
 )
 
 // Forcing more recent versions of dependencies
@@ -18,5 +19,4 @@ require (
 	github.com/miekg/dns v1.1.27 // indirect
 	golang.org/x/crypto v0.0.0-20210921155107-089bfa567519 // indirect
 	golang.org/x/net v0.6.0 // indirect
-	golang.org/x/sys v0.8.0 // indirect
 )
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TCP handshake: receivers send this banner on every accepted connection,
+// so senders can tell they reached an NP receiver speaking their protocol
+// before sending anything
+const (
+	HANDSHAKE_PREFIX     = "NP/"           // Followed by the protocol version, a space, the NP version and a newline
+	HANDSHAKE_PROTOCOL   = 1               // Bumped when the TCP protocol changes incompatibly
+	HANDSHAKE_MAX_LENGTH = 128             // Longest banner accepted
+	HANDSHAKE_TIMEOUT    = 5 * time.Second // Time a sender waits for the banner
+)
+
+// sendHandshake sends the receiver's banner on a new connection
+func sendHandshake(conn net.Conn) error {
+	_, err := writeFull(conn, []byte(fmt.Sprintf("%s%d %s\n", HANDSHAKE_PREFIX, HANDSHAKE_PROTOCOL, Version)))
+	return err
+}
+
+// readHandshake reads the receiver's banner from a new connection and
+// checks it comes from an NP receiver with a compatible protocol, returning
+// the receiver's NP version. It reads a byte at a time so data sent after
+// the banner is left for the pipe.
+func readHandshake(conn net.Conn) (string, error) {
+	conn.SetReadDeadline(time.Now().Add(HANDSHAKE_TIMEOUT))
+	defer conn.SetReadDeadline(time.Time{})
+
+	var line []byte
+	b := make([]byte, 1)
+	for len(line) < HANDSHAKE_MAX_LENGTH {
+		n, err := conn.Read(b)
+		if n == 1 && b[0] == '\n' {
+			break
+		}
+		line = append(line, b[:n]...)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() && len(line) == 0 {
+				return "", fmt.Errorf("%s sent no handshake within %v: it is not an NP receiver, or runs a version from before the handshake or --no-handshake (connect with --no-handshake)", conn.RemoteAddr(), HANDSHAKE_TIMEOUT)
+			}
+			if len(line) == 0 {
+				return "", fmt.Errorf("%s closed the connection before the handshake: %v", conn.RemoteAddr(), err)
+			}
+			return "", fmt.Errorf("%s is not an NP receiver, it sent %q (connect with --no-handshake to send to it anyway)", conn.RemoteAddr(), line)
+		}
+	}
+
+	banner := string(line)
+	rest, ok := strings.CutPrefix(banner, HANDSHAKE_PREFIX)
+	protocol, version, _ := strings.Cut(rest, " ")
+	number, err := strconv.Atoi(protocol)
+	if !ok || err != nil {
+		return "", fmt.Errorf("%s is not an NP receiver, it sent %q (connect with --no-handshake to send to it anyway)", conn.RemoteAddr(), banner)
+	}
+	if number != HANDSHAKE_PROTOCOL {
+		return "", fmt.Errorf("%s runs NP %s with protocol %d, which this version (protocol %d) can't talk to; upgrade the older side", conn.RemoteAddr(), version, number, HANDSHAKE_PROTOCOL)
+	}
+	return version, nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+// ifaceEntry is a local network interface as printed by np ifaces --json
+type ifaceEntry struct {
+	Name      string   `json:"name"`
+	Up        bool     `json:"up"`
+	Loopback  bool     `json:"loopback"`
+	Addresses []string `json:"addresses"`
+}
+
+// runIfaces prints the local interface addresses that can be given to
+// --bind, as a table or as JSON with --json
+func runIfaces(config *Config) error {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return fmt.Errorf("failed to list network interfaces: %v", err)
+	}
+
+	entries := make([]ifaceEntry, 0, len(interfaces))
+	for _, iface := range interfaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			config.debugf("Skipping addresses of %s: %v", iface.Name, err)
+		}
+
+		entry := ifaceEntry{
+			Name:      iface.Name,
+			Up:        iface.Flags&net.FlagUp != 0,
+			Loopback:  iface.Flags&net.FlagLoopback != 0,
+			Addresses: []string{},
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok {
+				entry.Addresses = append(entry.Addresses, ipNet.IP.String())
+			}
+		}
+		entries = append(entries, entry)
+	}
+
+	if config.ifacesJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(entries)
+	}
+
+	table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "INTERFACE\tSTATE\tADDRESS")
+	for _, entry := range entries {
+		state := "down"
+		if entry.Up {
+			state = "up"
+		}
+		if len(entry.Addresses) == 0 {
+			fmt.Fprintf(table, "%s\t%s\t-\n", entry.Name, state)
+		}
+		for _, address := range entry.Addresses {
+			fmt.Fprintf(table, "%s\t%s\t%s\n", entry.Name, state, address)
+		}
+	}
+	if err := table.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "Use %s or :: to listen on all interfaces\n", DEFAULT_BIND)
+	return nil
+}
+
+// validateAddress checks that address, given to the named flag, is an IP
+// address or a host name that resolves, so typos are reported before the
+// socket layer fails with a less helpful error
+func validateAddress(flagName, address string) error {
+	if net.ParseIP(strings.Trim(address, "[]")) != nil {
+		return nil
+	}
+	if _, err := net.LookupHost(address); err != nil {
+		return fmt.Errorf("%s %q is not an IP address or a resolvable host name; run 'np ifaces' to list local addresses", flagName, address)
+	}
+	return nil
+}
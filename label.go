@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"time"
+)
+
+// Connection label handshake: a TCP sender started with --label sends this
+// line before any data, so receivers can name the connection
+const (
+	LABEL_COMMAND    = "NPLABEL " // Followed by the label and a newline
+	LABEL_MAX_LENGTH = 64         // Longest label accepted
+)
+
+// labelPattern restricts labels to characters that are safe to display as is
+var labelPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._:@-]*$`)
+
+// validLabel reports whether label can be sent with --label
+func validLabel(label string) bool {
+	return len(label) <= LABEL_MAX_LENGTH && labelPattern.MatchString(label)
+}
+
+// sendLabel sends the label handshake on a new connection
+func sendLabel(conn net.Conn, label string) error {
+	_, err := writeFull(conn, []byte(LABEL_COMMAND+label+"\n"))
+	return err
+}
+
+// parseLabel extracts the label handshake from the first data received on
+// a connection. It returns the label and the data that followed it, or ok
+// false when the data doesn't start with a valid handshake.
+func parseLabel(data []byte) (label string, rest []byte, ok bool) {
+	if !bytes.HasPrefix(data, []byte(LABEL_COMMAND)) {
+		return "", data, false
+	}
+
+	line, rest, found := bytes.Cut(data[len(LABEL_COMMAND):], []byte("\n"))
+	if !found || !validLabel(string(line)) {
+		return "", data, false
+	}
+	return string(line), rest, true
+}
+
+// SetConnectionLabel names the connection from addr in the web interface,
+// adding it if no data was received from it yet
+func (ws *WebUIServer) SetConnectionLabel(addr, label string) {
+	if !ws.details {
+		return
+	}
+
+	ws.stats.mu.Lock()
+	defer ws.stats.mu.Unlock()
+
+	conn, ok := ws.stats.byAddr[addr]
+	if !ok {
+		conn = &ConnectionInfo{
+			RemoteAddr:  addr,
+			ConnectedAt: time.Now(),
+			LastActive:  time.Now(),
+			IsActive:    true,
+		}
+		ws.stats.Connections = append(ws.stats.Connections, conn)
+		ws.stats.byAddr[addr] = conn
+	}
+	conn.Label = label
+	ws.events.Publish("connection", *conn)
+}
+
+// labelClient handles the label handshake in the first data received from
+// a client and returns the data that followed it
+func (pipe *TCPPipe) labelClient(clientID string, data []byte) []byte {
+	label, rest, ok := parseLabel(data)
+	if !ok {
+		return data
+	}
+
+	fmt.Fprintf(os.Stderr, "Connection from %s labeled %s\n", clientID, label)
+	if pipe.web != nil {
+		pipe.web.SetConnectionLabel(clientID, label)
+	}
+	return rest
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+)
+
+// listEntry is a discovered service as printed by np list --json
+type listEntry struct {
+	Name      string   `json:"name"`
+	Host      string   `json:"host"`
+	Port      int      `json:"port"`
+	Protocol  string   `json:"protocol"`
+	Version   string   `json:"version"`
+	Addresses []string `json:"addresses"`
+}
+
+// runList browses the local network for --timeout and prints the NP
+// services found, as a table or as JSON with --json
+func runList(config *Config) error {
+	discovery := NewDiscoveryService(config)
+	defer discovery.Close()
+
+	// Ctrl-C ends the search early and lists what was found so far
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	fmt.Fprintf(os.Stderr, "Searching for NP services on the local network for %s...\n", config.listTimeout)
+	services, err := discovery.FindServiceContext(ctx, config.listTimeout)
+	if errors.Is(err, context.Canceled) && len(services) > 0 {
+		fmt.Fprintf(os.Stderr, "Search interrupted, listing the services found so far\n")
+	} else if errors.Is(err, context.Canceled) {
+		return fmt.Errorf("search interrupted before any NP service was found")
+	} else if err != nil {
+		return err
+	}
+
+	entries := make([]listEntry, 0, len(services))
+	for _, service := range services {
+		host := service.Host
+		if len(service.Addresses) > 0 {
+			host = service.Addresses[0]
+		}
+		entries = append(entries, listEntry{
+			Name:      unescapeInstance(service.Name),
+			Host:      host,
+			Port:      service.Port,
+			Protocol:  service.Protocol,
+			Version:   service.Version,
+			Addresses: service.Addresses,
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Name != entries[j].Name {
+			return entries[i].Name < entries[j].Name
+		}
+		return entries[i].Host < entries[j].Host
+	})
+
+	if config.listJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(entries)
+	}
+
+	table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "NAME\tHOST\tPORT\tPROTOCOL\tVERSION")
+	for _, entry := range entries {
+		// Instances from before version announcement don't send it
+		version := entry.Version
+		if version == "" {
+			version = "-"
+		}
+		fmt.Fprintf(table, "%s\t%s\t%d\t%s\t%s\n", entry.Name, entry.Host, entry.Port, entry.Protocol, version)
+	}
+	return table.Flush()
+}
+
+// unescapeInstance removes the backslashes zeroconf adds before spaces and
+// punctuation in DNS-SD instance names
+func unescapeInstance(name string) string {
+	var b strings.Builder
+	escaped := false
+	for _, r := range name {
+		if r == '\\' && !escaped {
+			escaped = true
+			continue
+		}
+		escaped = false
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -1,13 +1,17 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"compress/gzip"
 	"compress/zlib"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
+	"strings"
 	"sync"
 
 	"github.com/klauspost/compress/zstd"
@@ -32,6 +36,29 @@ var CompressionHeader = map[CompressionType][]byte{
 	ZstdCompression: []byte{0x28, 0xB5, 0x2F, 0xFD}, // Zstandard frame magic
 }
 
+// Multiplexed message framing: with --compression, each message sent by the
+// multiplexer is a frame so the receiver can find its boundaries, however
+// TCP splits or merges the reads
+const (
+	MUX_FRAME_MAGIC  = "NPZ"                    // Start of every frame
+	MUX_FRAME_HEADER = len(MUX_FRAME_MAGIC) + 5 // Magic, compression type and 4-byte big-endian payload length
+)
+
+// compressions lists the algorithms accepted by --compression, where auto
+// only decodes and is left out for bench, which has nothing to decode
+var compressions = []string{"none", "gzip", "zlib", "zstd", "auto"}
+
+// validCompression reports whether algorithm can be given to --compression,
+// counting auto only when decoding is allowed
+func validCompression(algorithm string, decode bool) bool {
+	for _, name := range compressions {
+		if algorithm == name && (decode || name != "auto") {
+			return true
+		}
+	}
+	return false
+}
+
 // ZstdReadCloser is a wrapper that implements io.ReadCloser for zstd.Decoder
 // This is needed because zstd.Decoder alone doesn't properly implement the interface
 type ZstdReadCloser struct {
@@ -44,16 +71,38 @@ func (z *ZstdReadCloser) Close() error {
 	return nil
 }
 
+// connDecoder is the decompressor for a connection and the algorithm it decodes
+type connDecoder struct {
+	compType CompressionType
+	reader   io.ReadCloser
+}
+
+// muxReader reads the messages of a connection. Whether the peer sends
+// frames is decided once, from the start of the connection or from what
+// follows its --label, which is always sent unframed.
+type muxReader struct {
+	reader   *bufio.Reader
+	labelled bool // Whether the start of the connection was checked for a label
+	checked  bool // Whether the start of the connection was checked for frames
+	framed   bool // Whether the peer sends frames
+}
+
 // MultiplexManager handles multiple network connections and applies compression
 // It serves as an abstraction layer for sending and receiving data across all connections
 type MultiplexManager struct {
-	config        *Config                   // Application configuration
-	connections   map[string]net.Conn       // Active connections by ID
-	mutex         sync.RWMutex              // Mutex for thread-safe connection access
-	compression   CompressionType           // Active compression algorithm
-	compressLevel int                       // Compression level (1-9)
-	encoders      map[string]io.WriteCloser // Compression encoders by connection ID
-	decoders      map[string]io.ReadCloser  // Compression decoders by connection ID
+	config        *Config                      // Application configuration
+	connections   map[string]net.Conn          // Active connections by ID
+	mutex         sync.RWMutex                 // Mutex for thread-safe connection access
+	compression   CompressionType              // Active compression algorithm
+	compressLevel int                          // Compression level (1-9)
+	compressMin   int                          // Messages smaller than this are sent uncompressed
+	decode        bool                         // Decode frames from peers, always on receivers
+	encoders      map[string]io.WriteCloser    // Compression encoders by connection ID
+	decoders      map[string]*connDecoder      // Compression decoders by connection ID, created on first use
+	readers       map[string]*muxReader        // Message readers by connection ID, created on first use
+	pending       map[string][]byte            // Decompressed data that didn't fit the caller's buffer, by connection ID
+	stats         map[string]*compressionStats // Compression stats by connection ID
+	web           *WebUIServer                 // Optional web interface recording traffic
 }
 
 // NewMultiplexManager creates a new multiplexing manager
@@ -62,15 +111,26 @@ func NewMultiplexManager(config *Config) *MultiplexManager {
 		config:      config,
 		connections: make(map[string]net.Conn),
 		encoders:    make(map[string]io.WriteCloser),
-		decoders:    make(map[string]io.ReadCloser),
+		decoders:    make(map[string]*connDecoder),
+		readers:     make(map[string]*muxReader),
+		pending:     make(map[string][]byte),
+		stats:       make(map[string]*compressionStats),
 		compression: NoCompression,
+		decode:      config.mode == "receiver" || config.compression != "none",
 	}
 }
 
-// SetCompression configures the compression type and level to be used
-func (mm *MultiplexManager) SetCompression(compType CompressionType, level int) {
+// SetCompression configures the compression type and level to be used.
+// Messages shorter than minSize bytes are sent uncompressed.
+func (mm *MultiplexManager) SetCompression(compType CompressionType, level int, minSize int) {
 	mm.compression = compType
 	mm.compressLevel = level
+	mm.compressMin = minSize
+}
+
+// SetWebUI assigns the web interface that records multiplexed traffic
+func (mm *MultiplexManager) SetWebUI(web *WebUIServer) {
+	mm.web = web
 }
 
 // GetCompressionName returns a human-readable name for a compression type
@@ -95,13 +155,14 @@ func (mm *MultiplexManager) AddConnection(id string, conn net.Conn) {
 	defer mm.mutex.Unlock()
 
 	mm.connections[id] = conn
+	mm.stats[id] = &compressionStats{}
 
 	// Log the new connection if web UI is enabled
-	if mm.config.webUI {
-		RecordMessage("Multiplexed connection added", "system", 0, conn.RemoteAddr().String(), conn.LocalAddr().String())
+	if mm.web != nil {
+		mm.web.RecordMessage("Multiplexed connection added", "system", 0, conn.RemoteAddr().String(), conn.LocalAddr().String())
 	}
 
-	fmt.Fprintf(os.Stderr, "Multiplex: Added connection %s: %s -> %s\n",
+	mm.config.debugf("Multiplex: Added connection %s: %s -> %s",
 		id, conn.RemoteAddr().String(), conn.LocalAddr().String())
 }
 
@@ -121,19 +182,22 @@ func (mm *MultiplexManager) RemoveConnection(id string) {
 		}
 
 		if decoder, ok := mm.decoders[id]; ok {
-			decoder.Close()
+			decoder.reader.Close()
 			delete(mm.decoders, id)
 		}
 
 		// Remove from the list
 		delete(mm.connections, id)
+		delete(mm.stats, id)
+		delete(mm.pending, id)
+		delete(mm.readers, id)
 
 		// Record for the web interface, if enabled
-		if mm.config.webUI {
-			RecordMessage("Multiplexed connection removed", "system", 0, conn.RemoteAddr().String(), conn.LocalAddr().String())
+		if mm.web != nil {
+			mm.web.RecordMessage("Multiplexed connection removed", "system", 0, conn.RemoteAddr().String(), conn.LocalAddr().String())
 		}
 
-		fmt.Fprintf(os.Stderr, "Multiplex: Removed connection %s\n", id)
+		mm.config.debugf("Multiplex: Removed connection %s", id)
 	}
 }
 
@@ -189,7 +253,9 @@ func (mm *MultiplexManager) SendToAll(data []byte) {
 	wg.Wait()
 }
 
-// SendTo sends data to a specific connection, with compression if configured
+// SendTo sends data to a specific connection, with compression if configured.
+// With compression every message is sent as a frame, and each compressed
+// message is a complete stream, so the receiver can decode it on its own.
 func (mm *MultiplexManager) SendTo(id string, data []byte) error {
 	mm.mutex.Lock()
 	conn, exists := mm.connections[id]
@@ -198,181 +264,409 @@ func (mm *MultiplexManager) SendTo(id string, data []byte) error {
 		return fmt.Errorf("connection %s not found", id)
 	}
 
-	// If no compression, send directly
-	if mm.compression == NoCompression {
+	// If no compression, or the message is too small to benefit, send it
+	// as is, in an uncompressed frame when compression is on
+	if mm.compression == NoCompression || len(data) < mm.compressMin {
 		mm.mutex.Unlock()
-		_, err := conn.Write(data)
+		var n, wire int
+		var err error
+		if mm.compression == NoCompression {
+			n, err = writeFull(conn, data)
+			wire = n
+		} else {
+			wire, err = writeFrame(conn, NoCompression, data)
+			n = wire - MUX_FRAME_HEADER
+			if n < 0 {
+				n = 0
+			}
+		}
+		mm.recordSent(id, n, wire)
 
 		// Record for the web interface
-		if err == nil && mm.config.webUI {
+		if n > 0 && mm.web != nil {
 			remoteAddr := conn.RemoteAddr().String()
-			RecordSentData(uint64(len(data)), remoteAddr)
-			RecordMessage(string(data), "out", len(data), conn.LocalAddr().String(), remoteAddr)
+			mm.web.RecordSentData(uint64(wire), remoteAddr)
+			mm.web.RecordMessage(string(data[:n]), "out", n, conn.LocalAddr().String(), remoteAddr)
 		}
 
 		return err
 	}
 
-	// Get or create a compressor for this connection
+	// Compress the data with this connection's compressor, created on first use
+	var buf bytes.Buffer
 	encoder, ok := mm.encoders[id]
-	if !ok {
-		var err error
-		var buf bytes.Buffer
-
-		switch mm.compression {
-		case GzipCompression:
-			encoder, err = gzip.NewWriterLevel(&buf, mm.compressLevel)
-		case ZlibCompression:
-			encoder, err = zlib.NewWriterLevel(&buf, mm.compressLevel)
-		case ZstdCompression:
-			encoder, err = zstd.NewWriter(&buf)
-		default:
+	if ok {
+		if err := resetEncoder(encoder, &buf); err != nil {
 			mm.mutex.Unlock()
-			return fmt.Errorf("unsupported compression type")
+			return fmt.Errorf("error resetting compressor: %v", err)
 		}
-
+	} else {
+		var err error
+		encoder, err = mm.newEncoder(&buf)
 		if err != nil {
 			mm.mutex.Unlock()
 			return fmt.Errorf("error creating compressor: %v", err)
 		}
-
 		mm.encoders[id] = encoder
 	}
 
-	mm.mutex.Unlock()
-
-	// Compress the data
-	var buf bytes.Buffer
-	writer, ok := encoder.(io.Writer)
-	if !ok {
-		return fmt.Errorf("error getting compressor writer")
-	}
-
-	_, err := writer.Write(data)
-	if err != nil {
+	if _, err := encoder.Write(data); err != nil {
+		mm.mutex.Unlock()
 		return fmt.Errorf("error compressing data: %v", err)
 	}
 
-	// Get the compressed data
-	if flusher, ok := encoder.(interface{ Flush() error }); ok {
-		err = flusher.Flush()
-		if err != nil {
-			return fmt.Errorf("error flushing compressor: %v", err)
-		}
+	// Closing ends the stream; the encoder is reset before its next use
+	if err := encoder.Close(); err != nil {
+		mm.mutex.Unlock()
+		return fmt.Errorf("error flushing compressor: %v", err)
 	}
 
+	mm.mutex.Unlock()
+
 	// Send the compressed data
-	_, err = conn.Write(buf.Bytes())
+	n, err := writeFrame(conn, mm.compression, buf.Bytes())
+	if err == nil {
+		mm.recordSent(id, len(data), n)
+	} else {
+		mm.recordSent(id, 0, n)
+	}
 
 	// Record for the web interface
-	if err == nil && mm.config.webUI {
+	if n > 0 && mm.web != nil {
 		remoteAddr := conn.RemoteAddr().String()
-		RecordSentData(uint64(buf.Len()), remoteAddr)
+		mm.web.RecordSentData(uint64(n), remoteAddr)
 		recordMsg := fmt.Sprintf("[Compressed: %s] %s", GetCompressionName(mm.compression), string(data))
-		RecordMessage(recordMsg, "out", buf.Len(), conn.LocalAddr().String(), remoteAddr)
+		mm.web.RecordCompressedMessage(recordMsg, "out", n, conn.LocalAddr().String(), remoteAddr)
 	}
 
 	return err
 }
 
-// ReceiveFrom receives data from a specific connection, decompressing if necessary
+// newEncoder creates a compressor for the configured algorithm writing to dst
+func (mm *MultiplexManager) newEncoder(dst io.Writer) (io.WriteCloser, error) {
+	return newEncoder(mm.compression, mm.compressLevel, dst)
+}
+
+// newEncoder creates a compressor for compType at the given level writing
+// to dst
+func newEncoder(compType CompressionType, level int, dst io.Writer) (io.WriteCloser, error) {
+	switch compType {
+	case GzipCompression:
+		return gzip.NewWriterLevel(dst, level)
+	case ZlibCompression:
+		return zlib.NewWriterLevel(dst, level)
+	case ZstdCompression:
+		return zstd.NewWriter(dst)
+	default:
+		return nil, fmt.Errorf("unsupported compression type")
+	}
+}
+
+// resetEncoder points an existing compressor at new output, starting a new stream
+func resetEncoder(encoder io.WriteCloser, dst io.Writer) error {
+	switch e := encoder.(type) {
+	case *gzip.Writer:
+		e.Reset(dst)
+	case *zlib.Writer:
+		e.Reset(dst)
+	case *zstd.Encoder:
+		e.Reset(dst)
+	default:
+		return fmt.Errorf("compressor can't be reset")
+	}
+	return nil
+}
+
+// writeFull writes all of data to w, retrying after partial writes. It
+// returns the number of bytes written, which is less than len(data) only
+// if an error occurred.
+func writeFull(w io.Writer, data []byte) (int, error) {
+	written := 0
+	for written < len(data) {
+		n, err := w.Write(data[written:])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		if n == 0 {
+			return written, io.ErrShortWrite
+		}
+	}
+	return written, nil
+}
+
+// writeFrame sends payload to w as one frame of compType
+func writeFrame(w io.Writer, compType CompressionType, payload []byte) (int, error) {
+	frame := make([]byte, MUX_FRAME_HEADER, MUX_FRAME_HEADER+len(payload))
+	copy(frame, MUX_FRAME_MAGIC)
+	frame[len(MUX_FRAME_MAGIC)] = byte(compType)
+	binary.BigEndian.PutUint32(frame[len(MUX_FRAME_MAGIC)+1:], uint32(len(payload)))
+	return writeFull(w, append(frame, payload...))
+}
+
+// peekPrefix reports whether the next data from reader starts with prefix.
+// It only waits for more data while what arrived so far could still be it,
+// so an interactive peer sending a few bytes isn't held back.
+func peekPrefix(reader *bufio.Reader, prefix string) (bool, error) {
+	for {
+		buffered, _ := reader.Peek(reader.Buffered())
+		if len(buffered) >= len(prefix) {
+			return string(buffered[:len(prefix)]) == prefix, nil
+		}
+		if !strings.HasPrefix(prefix, string(buffered)) {
+			return false, nil
+		}
+		if _, err := reader.Peek(len(buffered) + 1); err != nil {
+			if len(buffered) > 0 && err == io.EOF {
+				return false, nil
+			}
+			return false, err
+		}
+	}
+}
+
+// ReceiveFrom receives data from a specific connection. On receivers, and
+// senders with --compression set, a peer that sends frames has each message
+// decoded with the algorithm it names; anything else is returned exactly as
+// it was read. Decompressed messages longer than buffer are returned over
+// several calls.
 func (mm *MultiplexManager) ReceiveFrom(id string, buffer []byte) (int, error) {
 	mm.mutex.Lock()
 	conn, exists := mm.connections[id]
-	if !exists {
+	if n := mm.takePending(id, buffer); n > 0 {
 		mm.mutex.Unlock()
+		return n, nil
+	}
+	reader, ok := mm.readers[id]
+	if exists && !ok {
+		reader = &muxReader{reader: bufio.NewReaderSize(conn, BUFFER_SIZE)}
+		mm.readers[id] = reader
+	}
+	mm.mutex.Unlock()
+	if !exists {
 		return 0, fmt.Errorf("connection %s not found", id)
 	}
 
-	// Read data from the connection
-	n, err := conn.Read(buffer)
+	// Only one goroutine reads each connection, so the reader needs no lock.
+	// The label line is returned on its own for the caller to handle.
+	if mm.decode && !reader.labelled {
+		reader.labelled = true
+		label, err := peekPrefix(reader.reader, LABEL_COMMAND)
+		if err != nil {
+			return 0, err
+		}
+		if label {
+			line, err := reader.reader.ReadSlice('\n')
+			if err != nil {
+				return 0, fmt.Errorf("invalid label: %v", err)
+			}
+			mm.mutex.Lock()
+			mm.pending[id] = append([]byte(nil), line...)
+			n := mm.takePending(id, buffer)
+			mm.mutex.Unlock()
+			return n, nil
+		}
+	}
+	if !reader.checked {
+		if mm.decode {
+			framed, err := peekPrefix(reader.reader, MUX_FRAME_MAGIC)
+			if err != nil {
+				return 0, err
+			}
+			reader.framed = framed
+		}
+		reader.checked = true
+	}
+
+	if !reader.framed {
+		n, err := reader.reader.Read(buffer)
+		if err != nil {
+			return 0, err
+		}
+		mm.recordRaw(id, conn, buffer[:n])
+		return n, nil
+	}
+
+	compType, payload, err := mm.readFrame(reader.reader)
 	if err != nil {
-		mm.mutex.Unlock()
 		return 0, err
 	}
+	n := len(payload) + MUX_FRAME_HEADER
 
-	// Check if the data is compressed
-	compType := NoCompression
-	data := buffer[:n]
-
-	for t, header := range CompressionHeader {
-		if n >= len(header) && bytes.Equal(data[:len(header)], header) {
-			compType = t
-			break
+	var decompressed []byte
+	if compType == NoCompression {
+		decompressed = payload
+	} else {
+		decompressed, err = mm.decompress(id, compType, payload)
+		if err == errDecompressedTooLarge {
+			return 0, fmt.Errorf("%s message decompresses to more than %d bytes, see --max-decompressed", GetCompressionName(compType), mm.config.maxDecompress)
+		}
+		if err != nil {
+			return 0, err
 		}
 	}
 
-	// If not compressed, return the data as is
+	// Uncompressed frames are recorded like unframed data
 	if compType == NoCompression {
-		mm.mutex.Unlock()
-
-		// Record for the web interface
-		if mm.config.webUI {
+		mm.recordReceived(id, compType, len(payload), n)
+		if mm.web != nil {
+			remoteAddr := conn.RemoteAddr().String()
+			mm.web.RecordReceivedData(uint64(n), remoteAddr)
+			mm.web.RecordMessage(string(payload), "in", len(payload), remoteAddr, conn.LocalAddr().String())
+		}
+	} else {
+		mm.recordReceived(id, compType, len(decompressed), n)
+		if mm.web != nil {
 			remoteAddr := conn.RemoteAddr().String()
-			RecordReceivedData(uint64(n), remoteAddr)
-			RecordMessage(string(data), "in", n, remoteAddr, conn.LocalAddr().String())
+			mm.web.RecordReceivedData(uint64(n), remoteAddr)
+			recordMsg := fmt.Sprintf("[Decompressed: %s] %s", GetCompressionName(compType), string(decompressed))
+			mm.web.RecordCompressedMessage(recordMsg, "in", n, remoteAddr, conn.LocalAddr().String())
 		}
+	}
 
-		return n, nil
+	// Return what fits in the buffer and keep the rest for the next calls
+	mm.mutex.Lock()
+	mm.pending[id] = decompressed
+	n = mm.takePending(id, buffer)
+	mm.mutex.Unlock()
+	return n, nil
+}
+
+// readFrame reads the next frame from a peer that sends frames
+func (mm *MultiplexManager) readFrame(reader *bufio.Reader) (CompressionType, []byte, error) {
+	header := make([]byte, MUX_FRAME_HEADER)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = errors.New("connection closed in the middle of a message")
+		}
+		return NoCompression, nil, err
+	}
+	if string(header[:len(MUX_FRAME_MAGIC)]) != MUX_FRAME_MAGIC {
+		return NoCompression, nil, errors.New("corrupt message frame")
+	}
+
+	compType := CompressionType(header[len(MUX_FRAME_MAGIC)])
+	if compType != NoCompression && GetCompressionName(compType) == "Unknown" {
+		return NoCompression, nil, fmt.Errorf("message frame with unknown compression type %d", compType)
+	}
+	length := binary.BigEndian.Uint32(header[len(MUX_FRAME_MAGIC)+1:])
+	// The length comes from the peer, so it is checked before allocating
+	if int64(length) > mm.config.maxFrame {
+		return NoCompression, nil, fmt.Errorf("message frame of %d bytes is larger than --max-frame", length)
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = errors.New("connection closed in the middle of a message")
+		}
+		return NoCompression, nil, err
 	}
+	return compType, payload, nil
+}
+
+// recordRaw records data read as is, without frames
+func (mm *MultiplexManager) recordRaw(id string, conn net.Conn, data []byte) {
+	n := len(data)
+	mm.recordReceived(id, NoCompression, n, n)
+
+	// Record for the web interface
+	if mm.web != nil {
+		remoteAddr := conn.RemoteAddr().String()
+		mm.web.RecordReceivedData(uint64(n), remoteAddr)
+		mm.web.RecordMessage(string(data), "in", n, remoteAddr, conn.LocalAddr().String())
+	}
+}
+
+// takePending copies as much of the connection's pending decompressed data
+// as fits into buffer; the caller must hold mutex
+func (mm *MultiplexManager) takePending(id string, buffer []byte) int {
+	pending := mm.pending[id]
+	n := copy(buffer, pending)
+	if n == len(pending) {
+		delete(mm.pending, id)
+	} else {
+		mm.pending[id] = pending[n:]
+	}
+	return n
+}
+
+// errDecompressedTooLarge is returned by decompress for messages larger
+// than --max-decompressed once decoded
+var errDecompressedTooLarge = errors.New("decompressed data too large")
+
+// decompress decodes data with the connection's decoder for compType,
+// creating it on first use and replacing it if the peer switched algorithms
+func (mm *MultiplexManager) decompress(id string, compType CompressionType, data []byte) ([]byte, error) {
+	mm.mutex.Lock()
+	defer mm.mutex.Unlock()
+
+	src := bytes.NewReader(data)
 
-	// Get or create a decompressor for this connection
 	decoder, ok := mm.decoders[id]
-	if !ok {
-		var err error
-		buf := bytes.NewReader(data)
-
-		switch compType {
-		case GzipCompression:
-			decoder, err = gzip.NewReader(buf)
-		case ZlibCompression:
-			decoder, err = zlib.NewReader(buf)
-		case ZstdCompression:
-			zstdDecoder, err := zstd.NewReader(buf)
-			if err != nil {
-				mm.mutex.Unlock()
-				return 0, fmt.Errorf("error creating zstd decompressor: %v", err)
-			}
-			decoder = &ZstdReadCloser{zstdDecoder}
-		default:
-			mm.mutex.Unlock()
-			return 0, fmt.Errorf("unrecognized compression format")
+	if ok && decoder.compType == compType {
+		if err := resetDecoder(decoder.reader, src); err != nil {
+			return nil, fmt.Errorf("error resetting decompressor: %v", err)
+		}
+	} else {
+		if ok {
+			decoder.reader.Close()
+			delete(mm.decoders, id)
 		}
 
+		reader, err := newDecoder(compType, src)
 		if err != nil {
-			mm.mutex.Unlock()
-			return 0, fmt.Errorf("error creating decompressor: %v", err)
+			return nil, fmt.Errorf("error creating decompressor: %v", err)
 		}
 
+		decoder = &connDecoder{compType: compType, reader: reader}
 		mm.decoders[id] = decoder
 	}
 
-	mm.mutex.Unlock()
-
-	// Decompress the data
+	// Each frame holds a complete stream, so a truncated one is an error.
+	// Reading one byte past the limit tells a bomb from a message that fits.
 	var buf bytes.Buffer
-	_, err = io.Copy(&buf, decoder)
+	_, err := io.Copy(&buf, io.LimitReader(decoder.reader, mm.config.maxDecompress+1))
 	if err != nil {
-		return 0, fmt.Errorf("error decompressing data: %v", err)
+		return nil, fmt.Errorf("error decompressing data: %v", err)
 	}
-
-	// Copy the decompressed data to the buffer
-	decompressed := buf.Bytes()
-	if len(decompressed) > len(buffer) {
-		return 0, fmt.Errorf("buffer too small for decompressed data")
+	if int64(buf.Len()) > mm.config.maxDecompress {
+		return nil, errDecompressedTooLarge
 	}
 
-	copy(buffer, decompressed)
+	return buf.Bytes(), nil
+}
 
-	// Record for the web interface
-	if mm.config.webUI {
-		remoteAddr := conn.RemoteAddr().String()
-		RecordReceivedData(uint64(n), remoteAddr)
-		recordMsg := fmt.Sprintf("[Decompressed: %s] %s", GetCompressionName(compType), string(decompressed))
-		RecordMessage(recordMsg, "in", n, remoteAddr, conn.LocalAddr().String())
+// newDecoder creates a decompressor for compType reading from src
+func newDecoder(compType CompressionType, src io.Reader) (io.ReadCloser, error) {
+	switch compType {
+	case GzipCompression:
+		return gzip.NewReader(src)
+	case ZlibCompression:
+		return zlib.NewReader(src)
+	case ZstdCompression:
+		zstdDecoder, err := zstd.NewReader(src)
+		if err != nil {
+			return nil, err
+		}
+		return &ZstdReadCloser{zstdDecoder}, nil
+	default:
+		return nil, fmt.Errorf("unrecognized compression format")
 	}
+}
 
-	return len(decompressed), nil
+// resetDecoder points an existing decompressor at new input
+func resetDecoder(decoder io.ReadCloser, src io.Reader) error {
+	switch d := decoder.(type) {
+	case *gzip.Reader:
+		return d.Reset(src)
+	case zlib.Resetter:
+		return d.Reset(src, nil)
+	case *ZstdReadCloser:
+		return d.Decoder.Reset(src)
+	default:
+		return fmt.Errorf("decompressor can't be reset")
+	}
 }
 
 // StartListening starts listening on all connections
@@ -388,7 +682,8 @@ func (mm *MultiplexManager) StartListening(handler func(id string, data []byte))
 
 // listenConnection listens for data on a specific connection
 func (mm *MultiplexManager) listenConnection(id string, handler func(id string, data []byte)) {
-	buffer := make([]byte, BUFFER_SIZE)
+	buffer := getBuffer(mm.config, BUFFER_SIZE)
+	defer putBuffer(mm.config, buffer)
 
 	for {
 		mm.mutex.RLock()
@@ -408,10 +703,13 @@ func (mm *MultiplexManager) listenConnection(id string, handler func(id string,
 			break
 		}
 
+		// The handler gets its own copy, given back to the pool once it
+		// returns with --buffer-pool
 		if n > 0 {
-			data := make([]byte, n)
+			data := getBuffer(mm.config, n)
 			copy(data, buffer[:n])
 			handler(id, data)
+			putBuffer(mm.config, data)
 		}
 	}
 }
@@ -429,11 +727,11 @@ func (mm *MultiplexManager) Close() {
 		}
 
 		if decoder, ok := mm.decoders[id]; ok {
-			decoder.Close()
+			decoder.reader.Close()
 		}
 	}
 
 	mm.connections = make(map[string]net.Conn)
 	mm.encoders = make(map[string]io.WriteCloser)
-	mm.decoders = make(map[string]io.ReadCloser)
+	mm.decoders = make(map[string]*connDecoder)
 }
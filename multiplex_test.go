@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"testing"
+)
+
+// recordConn keeps everything written to it
+type recordConn struct {
+	net.Conn
+	written bytes.Buffer
+}
+
+func (c *recordConn) Write(p []byte) (int, error) {
+	return c.written.Write(p)
+}
+
+// throttledConn accepts at most limit bytes per write, like a socket whose
+// send buffer is nearly full
+type throttledConn struct {
+	recordConn
+	limit  int
+	writes int
+}
+
+func (c *throttledConn) Write(p []byte) (int, error) {
+	c.writes++
+	if len(p) > c.limit {
+		p = p[:c.limit]
+	}
+	return c.recordConn.Write(p)
+}
+
+// chunkConn returns data at most chunk bytes per read, then io.EOF
+type chunkConn struct {
+	net.Conn
+	data  *bytes.Reader
+	chunk int
+}
+
+func (c *chunkConn) Read(p []byte) (int, error) {
+	if len(p) > c.chunk {
+		p = p[:c.chunk]
+	}
+	return c.data.Read(p)
+}
+
+// newTestConn returns a connection with addresses for the multiplexer
+func newTestConn(t *testing.T) net.Conn {
+	t.Helper()
+	a, b := net.Pipe()
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	return a
+}
+
+// testMessages returns small, repetitive and random messages
+func testMessages() [][]byte {
+	random := make([]byte, 5000)
+	rand.New(rand.NewSource(1)).Read(random)
+	return [][]byte{
+		[]byte("hi\n"),
+		[]byte(strings.Repeat("line of a repetitive log\n", 400)),
+		random,
+		[]byte("short"),
+		[]byte(strings.Repeat("x", 64)),
+	}
+}
+
+// sendMessages sends messages through a multiplexer compressing with
+// compression and returns what went over the wire
+func sendMessages(t *testing.T, compression string, messages [][]byte) []byte {
+	t.Helper()
+	config := &Config{compression: compression, maxDecompress: 1 << 20, maxFrame: 1 << 20}
+	mm := NewMultiplexManager(config)
+	mm.SetCompression(getCompressType(compression), 6, 64)
+
+	conn := &recordConn{Conn: newTestConn(t)}
+	mm.AddConnection("out", conn)
+	for _, message := range messages {
+		if err := mm.SendTo("out", message); err != nil {
+			t.Fatalf("SendTo: %v", err)
+		}
+	}
+	return conn.written.Bytes()
+}
+
+// receiveAll reads wire through a receiver with compression, chunk bytes
+// per read, until the end
+func receiveAll(t *testing.T, compression string, wire []byte, chunk int) ([]byte, error) {
+	t.Helper()
+	config := &Config{mode: "receiver", compression: compression, maxDecompress: 1 << 20, maxFrame: 1 << 20}
+	mm := NewMultiplexManager(config)
+
+	conn := &chunkConn{Conn: newTestConn(t), data: bytes.NewReader(wire), chunk: chunk}
+	mm.AddConnection("in", conn)
+
+	var received []byte
+	buffer := make([]byte, 100)
+	for {
+		n, err := mm.ReceiveFrom("in", buffer)
+		received = append(received, buffer[:n]...)
+		if err == io.EOF {
+			return received, nil
+		}
+		if err != nil {
+			return received, err
+		}
+	}
+}
+
+func TestMultiplexRoundTrip(t *testing.T) {
+	messages := testMessages()
+	want := bytes.Join(messages, nil)
+
+	for _, compression := range []string{"gzip", "zlib", "zstd"} {
+		wire := sendMessages(t, compression, messages)
+
+		// 1 and 7 split frames across reads, the last merges every frame into one
+		for _, chunk := range []int{1, 7, 512, len(wire)} {
+			for _, receiver := range []string{compression, "auto"} {
+				got, err := receiveAll(t, receiver, wire, chunk)
+				if err != nil {
+					t.Fatalf("%s to %s, %d-byte reads: %v", compression, receiver, chunk, err)
+				}
+				if !bytes.Equal(got, want) {
+					t.Errorf("%s to %s, %d-byte reads: got %d bytes, want %d", compression, receiver, chunk, len(got), len(want))
+				}
+			}
+		}
+	}
+}
+
+func TestMultiplexPartialWrites(t *testing.T) {
+	message := []byte(strings.Repeat("line of a repetitive log\n", 400))
+
+	// Uncompressed, compressed, and too small to compress
+	for _, tc := range []struct {
+		compression string
+		minSize     int
+	}{{"none", 64}, {"gzip", 64}, {"zstd", len(message) + 1}} {
+		mm := NewMultiplexManager(&Config{compression: tc.compression, maxDecompress: 1 << 20, maxFrame: 1 << 20})
+		mm.SetCompression(getCompressType(tc.compression), 6, tc.minSize)
+		conn := &throttledConn{recordConn: recordConn{Conn: newTestConn(t)}, limit: 7}
+		mm.AddConnection("out", conn)
+
+		if err := mm.SendTo("out", message); err != nil {
+			t.Fatalf("%s: SendTo: %v", tc.compression, err)
+		}
+		wire := conn.written.Bytes()
+		if conn.writes < 2 {
+			t.Fatalf("%s: sent in %d write, want partial writes", tc.compression, conn.writes)
+		}
+
+		got, err := receiveAll(t, "none", wire, len(wire))
+		if err != nil {
+			t.Fatalf("%s: %v", tc.compression, err)
+		}
+		if !bytes.Equal(got, message) {
+			t.Errorf("%s: received %d bytes, want %d", tc.compression, len(got), len(message))
+		}
+
+		stats := mm.stats["out"]
+		if raw := stats.rawOut.Load(); raw != uint64(len(message)) {
+			t.Errorf("%s: recorded %d bytes sent, want %d", tc.compression, raw, len(message))
+		}
+		if sent := stats.wireOut.Load(); sent != uint64(len(wire)) {
+			t.Errorf("%s: recorded %d bytes on the wire, want %d", tc.compression, sent, len(wire))
+		}
+	}
+}
+
+func TestMultiplexRoundTripWithLabel(t *testing.T) {
+	messages := testMessages()
+	wire := append([]byte(LABEL_COMMAND+"build-7\n"), sendMessages(t, "zstd", messages)...)
+
+	for _, chunk := range []int{1, len(wire)} {
+		got, err := receiveAll(t, "auto", wire, chunk)
+		if err != nil {
+			t.Fatalf("%d-byte reads: %v", chunk, err)
+		}
+		label, rest, ok := parseLabel(got)
+		if !ok || label != "build-7" {
+			t.Fatalf("%d-byte reads: label %q not received first", chunk, label)
+		}
+		if !bytes.Equal(rest, bytes.Join(messages, nil)) {
+			t.Errorf("%d-byte reads: got %d bytes after the label, want %d", chunk, len(rest), len(bytes.Join(messages, nil)))
+		}
+	}
+}
+
+func TestMultiplexPlainReceiverDecodes(t *testing.T) {
+	messages := testMessages()
+	wire := sendMessages(t, "gzip", messages)
+
+	for _, chunk := range []int{1, 100, len(wire)} {
+		got, err := receiveAll(t, "none", wire, chunk)
+		if err != nil {
+			t.Fatalf("%d-byte reads: %v", chunk, err)
+		}
+		if !bytes.Equal(got, bytes.Join(messages, nil)) {
+			t.Errorf("%d-byte reads: got %d bytes, want %d", chunk, len(got), len(bytes.Join(messages, nil)))
+		}
+	}
+}
+
+func TestMultiplexPlainReceiverPassesFilesThrough(t *testing.T) {
+	// Raw gzip data, like a .gz file piped to a receiver
+	var file bytes.Buffer
+	gz := gzip.NewWriter(&file)
+	gz.Write(bytes.Repeat([]byte("data that isn't meant to be decompressed\n"), 1000))
+	gz.Close()
+	wire := file.Bytes()
+
+	for _, chunk := range []int{1, 100, len(wire)} {
+		got, err := receiveAll(t, "none", wire, chunk)
+		if err != nil {
+			t.Fatalf("%d-byte reads: %v", chunk, err)
+		}
+		if !bytes.Equal(got, wire) {
+			t.Errorf("%d-byte reads: got %d bytes, want the %d sent unchanged", chunk, len(got), len(wire))
+		}
+	}
+}
+
+func TestMultiplexDecoderPassesUnframedDataThrough(t *testing.T) {
+	wire := []byte("\x1f\x8b not a real gzip stream, from a sender without compression")
+
+	got, err := receiveAll(t, "gzip", wire, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, wire) {
+		t.Errorf("got %q, want %q", got, wire)
+	}
+}
+
+func TestMultiplexTruncatedFrame(t *testing.T) {
+	wire := sendMessages(t, "zstd", testMessages())
+
+	_, err := receiveAll(t, "zstd", wire[:len(wire)-10], 512)
+	if err == nil {
+		t.Fatal("truncated frame was accepted")
+	}
+}
+
+func TestMultiplexDecompressedTooLarge(t *testing.T) {
+	wire := sendMessages(t, "gzip", [][]byte{bytes.Repeat([]byte("a"), 1<<20+1)})
+
+	_, err := receiveAll(t, "gzip", wire, len(wire))
+	if err == nil || !strings.Contains(err.Error(), "--max-decompressed") {
+		t.Fatalf("got %v, want an error about --max-decompressed", err)
+	}
+}
+
+func TestMultiplexFrameTooLarge(t *testing.T) {
+	// A header announcing a 4GB frame, with none of it sent
+	wire := append([]byte(MUX_FRAME_MAGIC), byte(GzipCompression), 0xFF, 0xFF, 0xFF, 0xFF)
+
+	_, err := receiveAll(t, "none", wire, len(wire))
+	if err == nil || !strings.Contains(err.Error(), "--max-frame") {
+		t.Fatalf("got %v, want an error about --max-frame", err)
+	}
+}
+
+// benchmarkMultiplex sends and receives a repetitive message through
+// multiplexers using compression
+func benchmarkMultiplex(b *testing.B, compression string) {
+	sender := NewMultiplexManager(&Config{compression: compression, maxDecompress: 1 << 20, maxFrame: 1 << 20})
+	sender.SetCompression(getCompressType(compression), 6, 64)
+	a, c := net.Pipe()
+	defer a.Close()
+	defer c.Close()
+	out := &recordConn{Conn: a}
+	sender.AddConnection("out", out)
+
+	receiver := NewMultiplexManager(&Config{compression: compression, maxDecompress: 1 << 20, maxFrame: 1 << 20})
+	in := &chunkConn{Conn: c, data: bytes.NewReader(nil), chunk: BUFFER_SIZE}
+	receiver.AddConnection("in", in)
+
+	message := []byte(strings.Repeat("2026-10-16T00:00:00Z INFO request served in 3ms\n", 80))
+	buffer := make([]byte, BUFFER_SIZE)
+	b.SetBytes(int64(len(message)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		out.written.Reset()
+		if err := sender.SendTo("out", message); err != nil {
+			b.Fatal(err)
+		}
+		in.data.Reset(out.written.Bytes())
+		for received := 0; received < len(message); {
+			n, err := receiver.ReceiveFrom("in", buffer)
+			if err != nil {
+				b.Fatal(err)
+			}
+			received += n
+		}
+	}
+}
+
+func BenchmarkMultiplexNone(b *testing.B) { benchmarkMultiplex(b, "none") }
+func BenchmarkMultiplexGzip(b *testing.B) { benchmarkMultiplex(b, "gzip") }
+func BenchmarkMultiplexZlib(b *testing.B) { benchmarkMultiplex(b, "zlib") }
+func BenchmarkMultiplexZstd(b *testing.B) { benchmarkMultiplex(b, "zstd") }
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync/atomic"
+)
+
+// compressionStats counts a connection's bytes before and after compression
+type compressionStats struct {
+	rawOut   atomic.Uint64 // Bytes sent, before compression
+	wireOut  atomic.Uint64 // Bytes sent on the wire
+	rawIn    atomic.Uint64 // Bytes received, after decompression
+	wireIn   atomic.Uint64 // Bytes received on the wire
+	lastComp atomic.Int32  // CompressionType of the last message received
+}
+
+// MultiplexConnectionInfo describes the compression of a multiplexed
+// connection for GET /api/multiplex
+type MultiplexConnectionInfo struct {
+	ID                  string  `json:"id"`                  // Connection ID
+	RemoteAddr          string  `json:"remoteAddr"`          // Remote address (IP:port)
+	Compression         string  `json:"compression"`         // Algorithm used for sent data
+	Level               int     `json:"level"`               // Compression level for sent data
+	MinSize             int     `json:"minSize"`             // Messages smaller than this are sent uncompressed
+	BytesOut            uint64  `json:"bytesOut"`            // Bytes sent, before compression
+	WireBytesOut        uint64  `json:"wireBytesOut"`        // Bytes sent on the wire
+	SendRatio           float64 `json:"sendRatio"`           // wireBytesOut / bytesOut, 0 before any data
+	BytesIn             uint64  `json:"bytesIn"`             // Bytes received, after decompression
+	WireBytesIn         uint64  `json:"wireBytesIn"`         // Bytes received on the wire
+	ReceiveRatio        float64 `json:"receiveRatio"`        // wireBytesIn / bytesIn, 0 before any data
+	ReceivedCompression string  `json:"receivedCompression"` // Algorithm of the last message received
+}
+
+// recordSent adds a sent message to the connection's compression stats
+func (mm *MultiplexManager) recordSent(id string, raw, wire int) {
+	mm.mutex.RLock()
+	stats := mm.stats[id]
+	mm.mutex.RUnlock()
+
+	if stats != nil {
+		stats.rawOut.Add(uint64(raw))
+		stats.wireOut.Add(uint64(wire))
+	}
+}
+
+// recordReceived adds a received message to the connection's compression stats
+func (mm *MultiplexManager) recordReceived(id string, compType CompressionType, raw, wire int) {
+	mm.mutex.RLock()
+	stats := mm.stats[id]
+	mm.mutex.RUnlock()
+
+	if stats != nil {
+		stats.rawIn.Add(uint64(raw))
+		stats.wireIn.Add(uint64(wire))
+		stats.lastComp.Store(int32(compType))
+	}
+}
+
+// ConnectionStats returns the compression state of every connection,
+// sorted by ID
+func (mm *MultiplexManager) ConnectionStats() []MultiplexConnectionInfo {
+	mm.mutex.RLock()
+	defer mm.mutex.RUnlock()
+
+	result := make([]MultiplexConnectionInfo, 0, len(mm.connections))
+	for id, conn := range mm.connections {
+		info := MultiplexConnectionInfo{
+			ID:          id,
+			RemoteAddr:  conn.RemoteAddr().String(),
+			Compression: GetCompressionName(mm.compression),
+			Level:       mm.compressLevel,
+			MinSize:     mm.compressMin,
+		}
+
+		if stats := mm.stats[id]; stats != nil {
+			info.BytesOut = stats.rawOut.Load()
+			info.WireBytesOut = stats.wireOut.Load()
+			info.BytesIn = stats.rawIn.Load()
+			info.WireBytesIn = stats.wireIn.Load()
+			info.ReceivedCompression = GetCompressionName(CompressionType(stats.lastComp.Load()))
+		}
+		if info.BytesOut > 0 {
+			info.SendRatio = float64(info.WireBytesOut) / float64(info.BytesOut)
+		}
+		if info.BytesIn > 0 {
+			info.ReceiveRatio = float64(info.WireBytesIn) / float64(info.BytesIn)
+		}
+
+		result = append(result, info)
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i].ID < result[j].ID })
+	return result
+}
+
+// SetMultiplexManager assigns the multiplexer shown by GET /api/multiplex
+func (ws *WebUIServer) SetMultiplexManager(manager *MultiplexManager) {
+	ws.multiplexer = manager
+}
+
+// handleMultiplex returns the compression state of the multiplexed
+// connections in JSON format, or an empty list without a multiplexer
+func (ws *WebUIServer) handleMultiplex(w http.ResponseWriter, r *http.Request) {
+	connections := []MultiplexConnectionInfo{}
+	if ws.multiplexer != nil {
+		connections = ws.multiplexer.ConnectionStats()
+	}
+
+	writeJSON(w, r, connections)
+}
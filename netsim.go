@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"time"
+)
+
+// NetworkSimulator degrades the sender's traffic for testing: it delays
+// every message and drops a fraction of them
+type NetworkSimulator struct {
+	dropRate float64       // Fraction of messages dropped, between 0 and 1
+	delay    time.Duration // Added before every message is sent
+	rng      *rand.Rand    // Random source, seeded for reproducible runs
+}
+
+// NewNetworkSimulator returns a simulator for the configured --drop-rate and
+// --delay, or nil when neither is set
+func NewNetworkSimulator(config *Config) *NetworkSimulator {
+	if config.dropRate <= 0 && config.delay <= 0 {
+		return nil
+	}
+
+	seed := config.seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+
+	fmt.Fprintf(os.Stderr, "Simulating network: dropping %.1f%% of messages, %v delay (seed %d)\n",
+		config.dropRate*100, config.delay, seed)
+
+	return &NetworkSimulator{
+		dropRate: config.dropRate,
+		delay:    config.delay,
+		rng:      rand.New(rand.NewSource(seed)),
+	}
+}
+
+// Deliver waits for the configured delay and reports whether the message
+// should be sent. The send loops call it from a single goroutine.
+func (ns *NetworkSimulator) Deliver() bool {
+	if ns == nil {
+		return true
+	}
+
+	if ns.delay > 0 {
+		time.Sleep(ns.delay)
+	}
+	return ns.rng.Float64() >= ns.dropRate
+}
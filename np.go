@@ -2,21 +2,41 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"net"
 	"os"
+	"os/signal"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
+// Version of NP, set at build time by the Makefile and announced via mDNS
+var Version = "dev"
+
 // Network configuration defaults
 const (
-	DEFAULT_PORT = 4242
-	DEFAULT_HOST = "127.0.0.1"
-	DEFAULT_BIND = "0.0.0.0"
-	BUFFER_SIZE  = 4096
+	DEFAULT_PORT         = 4242
+	DEFAULT_HOST         = "127.0.0.1"
+	DEFAULT_BIND         = "0.0.0.0"
+	BUFFER_SIZE          = 4096
+	DEFAULT_COMPRESS_MIN = 64                     // Smaller messages aren't worth compressing
+	DEFAULT_MAX_DECOMP   = "64MB"                 // Largest message accepted after decompression
+	DEFAULT_MAX_FRAME    = "16MB"                 // Largest message frame accepted before decoding
+	DEFAULT_MAX_LINE     = bufio.MaxScanTokenSize // Longest line sent over UDP
+)
+
+// UDP retry settings for transient "connection refused" errors
+const (
+	UDP_SEND_RETRIES = 3
+	UDP_RETRY_DELAY  = 500 * time.Millisecond
 )
 
 // Authentication constants
@@ -28,29 +48,113 @@ const (
 
 // Web UI defaults
 const (
-	DEFAULT_WEB_PORT = 8080
+	DEFAULT_WEB_PORT  = 8080
+	DEFAULT_WEB_FLUSH = 100 * time.Millisecond // Interval between message history updates
+
+	DEFAULT_UDP_IDLE_TIMEOUT = 5 * time.Minute // Idle time after which a UDP source leaves the connection list
 )
 
 // Config holds all application configuration parameters
 type Config struct {
-	mode          string // "sender" or "receiver"
-	port          int    // Port for the network connection
-	host          string // Host to connect to (for sender mode)
-	bindAddr      string // Address to bind to (for receiver mode)
-	webUI         bool   // Whether to enable the web UI
-	webUIPort     int    // Port for the web UI
-	webUIBind     string // Address to bind web UI to
-	useTCP        bool   // Use TCP instead of UDP
-	enableMDNS    bool   // Enable multicast DNS discovery
-	compression   string // Compression algorithm (none, gzip, zlib, zstd)
-	compressLevel int    // Compression level (1-9)
-	multiConn     bool   // Enable multiple connections
+	mode           string          // "sender", "receiver", "ping", "bench", "list" or "ifaces"
+	port           int             // Port for the network connection
+	host           string          // Host to connect to (for sender mode)
+	bindAddr       string          // Address to bind to (for receiver mode)
+	webUI          bool            // Whether to enable the web UI
+	webUIPort      int             // Port for the web UI
+	webUIBind      string          // Address to bind web UI to
+	useTCP         bool            // Use TCP instead of UDP
+	nagle          bool            // Keep Nagle's algorithm on TCP connections, batching small writes
+	noHandshake    bool            // Skip the TCP banner handshake, for raw TCP peers such as netcat
+	tfo            bool            // Use TCP Fast Open where the platform supports it
+	enableMDNS     bool            // Enable multicast DNS discovery
+	mdnsService    string          // mDNS service type announced and browsed
+	mdnsRetries    int             // Times to retry announcing the mDNS service before giving up
+	serviceToken   string          // Token announced in the mDNS TXT records (for receiver mode)
+	expectToken    string          // Only use discovered services announcing this token (for sender mode)
+	label          string          // Name sent to TCP receivers to identify this connection
+	discoveryCache string          // File where discovered services are saved between runs (for sender mode)
+	compression    string          // Compression algorithm (none, gzip, zlib, zstd)
+	compressLevel  int             // Compression level (1-9)
+	compressMin    int             // Smallest message size in bytes that gets compressed
+	maxDecompress  int64           // Largest received message in bytes after decompression
+	maxFrame       int64           // Largest received message frame in bytes, checked before reading it
+	multiConn      bool            // Enable multiple connections
+	chat           bool            // Interactive chat interface instead of raw piping
+	maxLine        int             // Maximum line length read from stdin in UDP sender mode
+	outputBuffer   int             // Size of the stdout write buffer (0 disables buffering)
+	bufferPool     bool            // Share read buffers through a pool instead of allocating them
+	flushInterval  time.Duration   // Maximum time received data stays buffered
+	lines          bool            // Flush stdout after every line
+	ignoreRefused  bool            // Treat UDP "connection refused" errors as transient
+	printConfig    bool            // Print the resolved configuration and exit
+	count          int             // Exit after receiving this many chunks (0 means unlimited)
+	statsInterval  time.Duration   // Interval between stats summaries on stderr (0 disables them)
+	summaryJSON    string          // File the exit summary is written to as JSON
+	webToken       string          // Token required by the web UI control endpoints
+	webFlush       time.Duration   // Interval at which recorded messages are added to the web UI history
+	webSplitLines  bool            // Record each line of received data as its own web UI message
+	webNoContent   bool            // Keep message metadata but not contents in the web UI
+	webRequired    bool            // Exit if the web UI can't start instead of continuing without it
+	benchSize      int64           // Bytes of generated data sent by np bench
+	sink           bool            // Discard received data instead of writing it to stdout (--sink, --no-stdout)
+	outRate        string          // Maximum rate of stdout writes, lines ("100/s") or bytes ("64KB/s")
+	tee            string          // File that also receives a copy of the data written to stdout
+	transforms     *TransformChain // Transforms applied to sent data and reversed on received data
+	connectRetries int             // Times to retry the initial connection to the peer or relay
+	connectBackoff time.Duration   // Delay before the first connection retry, doubled each time
+	debug          bool            // Print debug messages to stderr
+	relayAddr      string          // Relay server address (host or host:port)
+	session        string          // Relay session ID shared with the peer (empty disables the relay)
+	relayRetries   int             // Times to retry rejoining a dropped relay session
+	relayRole      string          // Role declared to the relay: host, guest or empty
+	outputFormat   string          // How received data is written to stdout: raw, hex, json or peek
+	colorMode      string          // When to color terminal decorations: auto, always or never
+	color          bool            // Whether decorations are colored, resolved from colorMode
+	pingInterval   time.Duration   // Time between probes in ping mode
+	listTimeout    time.Duration   // Time spent browsing for services in list mode
+	listJSON       bool            // Print the services found as JSON in list mode
+	ifacesJSON     bool            // Print the interfaces as JSON in ifaces mode
+	authToken      string          // Shared token for the UDP instance probe (empty uses ISNP/OK)
+	noAuth         bool            // Disable the UDP instance probe
+	authSecret     string          // Shared secret for the TCP challenge-response authentication
+	authCmd        string          // Program run on each new TCP connection to authenticate the peer
+	keepOpen       bool            // Keep receiving after the input ends, until the peer closes (for sender mode)
+	stdinFile      string          // File to send instead of stdin (for sender mode)
+	systemd        bool            // Use the socket passed by systemd socket activation (for receiver mode)
+	reusePort      bool            // Set SO_REUSEPORT on the listening socket (for receiver mode)
+	backlog        int             // Length of the TCP listen queue, 0 for the system default (for receiver mode)
+	proxyProtocol  bool            // Read the client address from a PROXY protocol header (for receiver mode)
+	bindDevice     string          // Network interface sockets are pinned to with SO_BINDTODEVICE
+	maxWorkers     int             // Maximum concurrent TCP client handlers, 0 for no limit (for receiver mode)
+	drain          time.Duration   // Time Close waits for TCP clients to finish before closing them (for receiver mode)
+	notifyPeers    bool            // Tell the remaining TCP clients when a client disconnects (for receiver mode)
+	onConnect      string          // URL posted to when a TCP client connects (for receiver mode)
+	onDisconnect   string          // URL posted to when a TCP client disconnects (for receiver mode)
+	udpIdleTimeout time.Duration   // Idle time after which UDP sources are removed from the statistics (for receiver mode)
+	dedup          bool            // Drop duplicate UDP datagrams (for receiver mode)
+	checksum       bool            // Prefix UDP datagrams with a CRC-32, verified on receive
+	mtu            int             // Largest UDP datagram sent, longer messages are chunked (for sender mode)
+	ack            bool            // Retransmit UDP datagrams until the receiver acknowledges them (for sender mode)
+	ackTimeout     time.Duration   // Time to wait for an ACK before retransmitting
+	ackRetries     int             // Retransmissions before giving up on a datagram
+	streamCompress string          // Compress the whole TCP stream from the sender with gzip or zstd
+	dedupWindow    time.Duration   // Time within which a repeated datagram is a duplicate
+	dedupSize      int             // Maximum number of recent datagrams remembered for --dedup
+	rejectExcess   bool            // Close connections over --max-workers instead of queueing them
+	dropRate       float64         // Fraction of messages the sender drops, for network simulation
+	delay          time.Duration   // Delay the sender adds before each message, for network simulation
+	seed           int64           // Seed of the network simulation (0 picks one)
+	files          []string        // Files sent back-to-back instead of stdin (for sender mode)
+	fileDelimiter  string          // Sent between two --file inputs
+	skipMissing    bool            // Skip --file inputs that can't be opened instead of aborting
 }
 
 // ConnHandler is an interface for different connection types
 type ConnHandler interface {
 	Start() error
 	Close() error
+	Shutdown() error // Stop accepting connections, drain the active ones and close
 }
 
 // NetworkPipe is the original (UDP) implementation
@@ -58,6 +162,20 @@ type NetworkPipe struct {
 	config     *Config
 	conn       *net.UDPConn
 	bufferSize int
+	input      io.Reader         // Source of data to send (stdin or --stdin-file)
+	simulator  *NetworkSimulator // Optional --drop-rate/--delay simulation of sent data
+	dedup      *DedupWindow      // Optional --dedup window of received datagrams
+	chunks     *ChunkAssembler   // Reassembles messages split by --mtu
+	messageID  uint32            // ID of the last message sent in chunks
+	acks       *AckTracker       // Datagrams waiting for an ACK, with --ack
+	ackWindow  *AckWindow        // Sequence numbers received from --ack senders
+	codec      *DatagramCodec    // Per-datagram --compression
+	sendAcks   bool              // Whether the receiver answers --ack, set before sending
+	output     io.Writer
+	web        *WebUIServer
+	received   int       // Datagrams written to the output, for --count
+	closeOnce  sync.Once // Ensures the socket is only closed once
+	closeErr   error     // Result of the first Close
 }
 
 // askForMode prompts the user to select operational mode
@@ -80,6 +198,49 @@ func askForMode() string {
 	return "receiver"
 }
 
+// Short flags that are aliases of a long flag, used for environment lookups
+var flagAliases = map[string]string{
+	"p": "port",
+	"b": "bind",
+	"H": "host",
+}
+
+// envVarName returns the environment variable for a long flag name,
+// e.g. "web-port" becomes NP_WEB_PORT
+func envVarName(name string) string {
+	return "NP_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// applyEnvironment sets every flag that wasn't given on the command line
+// from its NP_* environment variable, if present. Flags take precedence
+// over the environment, which takes precedence over the defaults.
+func applyEnvironment(cmd *flag.FlagSet) {
+	explicit := make(map[string]bool)
+	cmd.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+		if long, ok := flagAliases[f.Name]; ok {
+			explicit[long] = true
+		}
+	})
+
+	cmd.VisitAll(func(f *flag.Flag) {
+		if _, isAlias := flagAliases[f.Name]; isAlias || explicit[f.Name] {
+			return
+		}
+
+		name := envVarName(f.Name)
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return
+		}
+
+		if err := cmd.Set(f.Name, value); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: invalid value %q for %s: %v\n", value, name, err)
+			os.Exit(1)
+		}
+	})
+}
+
 // parseFlags processes command line arguments and returns configuration
 func parseFlags() *Config {
 	config := &Config{}
@@ -96,11 +257,72 @@ func parseFlags() *Config {
 	receiverWebUI := receiverCmd.Bool("web-ui", false, "Enable web interface")
 	receiverWebUIPort := receiverCmd.Int("web-port", DEFAULT_WEB_PORT, "Port for web interface")
 	receiverWebUIBind := receiverCmd.String("web-bind", DEFAULT_BIND, "Address to bind web interface to")
+	receiverWebRequired := receiverCmd.Bool("web-required", false, "Exit if the web interface can't start instead of continuing without it")
+	receiverWebToken := receiverCmd.String("web-token", "", "Token required by web interface control endpoints such as shutdown")
+	receiverWebFlush := receiverCmd.Duration("web-flush", DEFAULT_WEB_FLUSH, "Interval at which recorded messages are added to the web interface history")
+	receiverWebNoContent := receiverCmd.Bool("web-no-content", false, "Keep only the size, direction and addresses of messages in the web interface, not their contents")
+	receiverWebSplitLines := receiverCmd.Bool("web-split-lines", false, "Show each line of received data as a separate message in the web interface")
+	receiverDebug := receiverCmd.Bool("debug", false, "Print debug messages")
+	receiverRelay := receiverCmd.String("relay", DEFAULT_RELAY, "Relay server address")
+	receiverSession := receiverCmd.String("session", "", "Relay session ID to join instead of listening (implies --tcp)")
+	receiverRelayRetries := receiverCmd.Int("relay-retries", DEFAULT_RELAY_RETRIES, "Times to retry rejoining a dropped relay session")
+	receiverRelayRole := receiverCmd.String("relay-role", "", "Role declared to the relay (host or guest); a session pairs one host with one guest")
+	receiverConnectRetries := receiverCmd.Int("connect-retries", 0, "Times to retry joining the relay session before giving up")
+	receiverConnectBackoff := receiverCmd.Duration("connect-backoff", DEFAULT_CONNECT_BACKOFF, "Delay before the first connection retry, doubled after each attempt")
 	receiverUseTCP := receiverCmd.Bool("tcp", false, "Use TCP instead of UDP")
+	receiverTFO := receiverCmd.Bool("tfo", false, "Accept TCP Fast Open data sent in the SYN by --tfo senders (Linux only)")
+	receiverNagle := receiverCmd.Bool("nagle", false, "Enable Nagle's algorithm on TCP connections, batching small writes for bulk transfers")
+	receiverNoHandshake := receiverCmd.Bool("no-handshake", false, "Don't greet TCP clients with the NP banner, for raw TCP clients such as netcat")
+	receiverBindDevice := receiverCmd.String("bind-device", "", "Only send and receive through this network interface, e.g. eth0 (Linux only)")
 	receiverEnableMDNS := receiverCmd.Bool("mdns", false, "Enable mDNS service announcement")
+	receiverMDNSRetries := receiverCmd.Int("mdns-retries", DEFAULT_MDNS_RETRIES, "Times to retry announcing the mDNS service while the network isn't ready, waiting --connect-backoff doubled after each attempt")
+	receiverMDNSService := receiverCmd.String("mdns-service", SERVICE_TYPE, "mDNS service type announced, e.g. _myapp._tcp")
+	receiverUDPIdleTimeout := receiverCmd.Duration("udp-idle-timeout", DEFAULT_UDP_IDLE_TIMEOUT, "Forget UDP sources idle for this long in the connection statistics (0 keeps them)")
+	receiverChecksum := receiverCmd.Bool("checksum", false, "Verify the CRC-32 sent with each UDP datagram by --checksum senders, dropping corrupt ones")
+	receiverStreamCompress := receiverCmd.String("stream-compress", "", "Decompress the whole TCP stream from --stream-compress senders: gzip or zstd")
+	receiverDedup := receiverCmd.Bool("dedup", false, "Drop UDP datagrams that repeat one from the same sender within --dedup-window")
+	receiverDedupWindow := receiverCmd.Duration("dedup-window", DEFAULT_DEDUP_WINDOW, "Time within which a repeated datagram is dropped by --dedup")
+	receiverDedupSize := receiverCmd.Int("dedup-size", DEFAULT_DEDUP_SIZE, "Maximum number of recent datagrams remembered by --dedup")
+	receiverOnConnectURL := receiverCmd.String("on-connect-url", "", "URL to POST a JSON event to when a TCP client connects")
+	receiverOnDisconnectURL := receiverCmd.String("on-disconnect-url", "", "URL to POST a JSON event to when a TCP client disconnects")
+	receiverNotifyPeers := receiverCmd.Bool("notify-peers", false, "Send \"[peer X left]\" to the remaining TCP clients when a client disconnects")
+	receiverDrain := receiverCmd.Duration("drain", 0, "On exit, wait up to this long for connected TCP clients to finish before closing them (0 closes them right away, or waits for them on SIGTERM)")
+	receiverMaxWorkers := receiverCmd.Int("max-workers", 0, "Maximum number of TCP clients handled at once, 0 for no limit")
+	receiverRejectExcess := receiverCmd.Bool("reject-excess", false, "Close connections over --max-workers instead of queueing them")
+	receiverReusePort := receiverCmd.Bool("reuseport", false, "Set SO_REUSEPORT so several receivers can share the port")
+	receiverProxyProtocol := receiverCmd.Bool("proxy-protocol", false, "Read the real client address from the PROXY protocol v1/v2 header sent by a load balancer, rejecting connections without one")
+	receiverBacklog := receiverCmd.Int("backlog", 0, "Length of the queue of TCP connections waiting to be accepted, 0 for the system default (capped by somaxconn)")
+	receiverSystemd := receiverCmd.Bool("systemd", false, "Use the socket passed by systemd socket activation instead of binding one")
+	receiverServiceToken := receiverCmd.String("service-token", "", "Token announced in the mDNS TXT records, matched by senders with --expect-token")
 	receiverMultiConn := receiverCmd.Bool("multi", false, "Enable multiple connections")
-	receiverCompression := receiverCmd.String("compression", "none", "Compression algorithm (none, gzip, zlib, zstd)")
+	receiverCompression := receiverCmd.String("compression", "none", "Compression algorithm (none, gzip, zlib, zstd, or auto to only decode)")
 	receiverCompressLevel := receiverCmd.Int("compress-level", 6, "Compression level (1-9)")
+	receiverCompressMin := receiverCmd.Int("compress-min", DEFAULT_COMPRESS_MIN, "Send messages smaller than this many bytes uncompressed")
+	receiverMaxDecomp := receiverCmd.String("max-decompressed", DEFAULT_MAX_DECOMP, "Close connections sending a compressed message larger than this once decompressed, e.g. 16MB")
+	receiverMaxFrame := receiverCmd.String("max-frame", DEFAULT_MAX_FRAME, "Close connections sending a message frame larger than this, before reading it, e.g. 1MB")
+	receiverChat := receiverCmd.Bool("chat", false, "Interactive chat interface (requires --tcp)")
+	receiverOutputBuffer := receiverCmd.Int("output-buffer", DEFAULT_OUTPUT_BUFFER, "Size of the stdout write buffer in bytes (0 disables buffering)")
+	receiverBufferPool := receiverCmd.Bool("buffer-pool", false, "Reuse read buffers across connections and messages to reduce garbage collection at high message rates")
+	receiverFlushInterval := receiverCmd.Duration("flush-interval", DEFAULT_FLUSH_INTERVAL, "Maximum time received data stays buffered")
+	receiverLines := receiverCmd.Bool("lines", false, "Flush stdout after every line")
+	receiverOutRate := receiverCmd.String("out-rate", "", "Maximum rate at which received data is written to stdout, in lines (e.g. 100/s) or bytes (e.g. 64KB/s)")
+	receiverTransform := receiverCmd.String("transform", "", "Comma-separated transforms reversed on received data, matching the sender's (upper, base64, gzip)")
+	receiverSink := receiverCmd.Bool("sink", false, "Discard received data instead of writing it to stdout, e.g. for np bench")
+	receiverTee := receiverCmd.String("tee", "", "Also write received data to this file, keeping stdout (the file is truncated)")
+	receiverNoStdout := receiverCmd.Bool("no-stdout", false, "Don't write received data to stdout, only record it in the web interface and statistics (same as --sink)")
+	receiverPeek := receiverCmd.Bool("peek", false, "Print direction, size, source and a hex preview of each message instead of its content (same as --output-format peek)")
+	receiverOutputFormat := receiverCmd.String("output-format", OUTPUT_RAW, "How received data is written to stdout: raw, hex, json or peek")
+	receiverColor := receiverCmd.String("color", COLOR_AUTO, "Color chat lines, notices and peek lines by direction: auto (on a terminal), always or never")
+	receiverNoColor := receiverCmd.Bool("no-color", false, "Never color output, overriding --color (same as --color never)")
+	receiverStatsInterval := receiverCmd.Duration("stats-interval", 0, "Print a traffic summary to stderr at this interval (0 disables it)")
+	receiverSummaryJSON := receiverCmd.String("summary-json", "", "Write the exit summary as JSON to this file")
+	receiverCount := receiverCmd.Int("count", 0, "Exit after receiving this many messages (0 means unlimited)")
+	receiverPrintConfig := receiverCmd.Bool("print-config", false, "Print the resolved configuration as JSON and exit")
+	receiverIgnoreRefused := receiverCmd.Bool("ignore-refused", false, "Ignore UDP connection refused errors instead of stopping")
+	receiverAuthToken := receiverCmd.String("auth-token", "", "Shared token used by the UDP instance probe instead of the default handshake")
+	receiverAuthSecret := receiverCmd.String("auth-secret", "", "Shared secret TCP clients must prove they know before sending data")
+	receiverAuthCmd := receiverCmd.String("auth-cmd", "", "Program run with each TCP client connection as stdin and stdout; the client is accepted if it exits with status 0")
+	receiverNoAuth := receiverCmd.Bool("no-auth", false, "Disable the UDP instance probe")
 
 	// Sender flags
 	senderPort := senderCmd.Int("p", DEFAULT_PORT, "Port to connect to")
@@ -110,100 +332,586 @@ func parseFlags() *Config {
 	senderWebUI := senderCmd.Bool("web-ui", false, "Enable web interface")
 	senderWebUIPort := senderCmd.Int("web-port", DEFAULT_WEB_PORT, "Port for web interface")
 	senderWebUIBind := senderCmd.String("web-bind", DEFAULT_BIND, "Address to bind web interface to")
+	senderWebRequired := senderCmd.Bool("web-required", false, "Exit if the web interface can't start instead of continuing without it")
+	senderWebToken := senderCmd.String("web-token", "", "Token required by web interface control endpoints such as shutdown")
+	senderWebFlush := senderCmd.Duration("web-flush", DEFAULT_WEB_FLUSH, "Interval at which recorded messages are added to the web interface history")
+	senderWebNoContent := senderCmd.Bool("web-no-content", false, "Keep only the size, direction and addresses of messages in the web interface, not their contents")
+	senderWebSplitLines := senderCmd.Bool("web-split-lines", false, "Show each line of received data as a separate message in the web interface")
+	senderConnectRetries := senderCmd.Int("connect-retries", 0, "Times to retry the initial connection before giving up")
+	senderConnectBackoff := senderCmd.Duration("connect-backoff", DEFAULT_CONNECT_BACKOFF, "Delay before the first connection retry, doubled after each attempt")
+	senderDebug := senderCmd.Bool("debug", false, "Print debug messages")
+	senderRelay := senderCmd.String("relay", DEFAULT_RELAY, "Relay server address")
+	senderSession := senderCmd.String("session", "", "Relay session ID to join instead of connecting directly (implies --tcp)")
+	senderRelayRetries := senderCmd.Int("relay-retries", DEFAULT_RELAY_RETRIES, "Times to retry rejoining a dropped relay session")
+	senderRelayRole := senderCmd.String("relay-role", "", "Role declared to the relay (host or guest); a session pairs one host with one guest")
 	senderUseTCP := senderCmd.Bool("tcp", false, "Use TCP instead of UDP")
+	senderTFO := senderCmd.Bool("tfo", false, "Send the first data in the SYN with TCP Fast Open, saving a round trip on repeated connections (Linux only)")
+	senderNagle := senderCmd.Bool("nagle", false, "Enable Nagle's algorithm on TCP connections, batching small writes for bulk transfers")
+	senderNoHandshake := senderCmd.Bool("no-handshake", false, "Don't wait for the NP banner from the TCP receiver, for raw TCP servers such as netcat")
+	senderBindDevice := senderCmd.String("bind-device", "", "Only send and receive through this network interface, e.g. eth0 (Linux only)")
 	senderEnableMDNS := senderCmd.Bool("mdns", false, "Enable mDNS service discovery")
+	senderMDNSService := senderCmd.String("mdns-service", SERVICE_TYPE, "mDNS service type browsed, e.g. _myapp._tcp")
+	senderExpectToken := senderCmd.String("expect-token", "", "Only connect to discovered services announcing this token")
+	senderTransform := senderCmd.String("transform", "", "Comma-separated transforms applied in order to sent data and reversed on received data (upper, base64, gzip)")
+	senderLabel := senderCmd.String("label", "", "Name sent to TCP receivers to identify this connection in their web interface")
+	senderDiscoveryCache := senderCmd.String("discovery-cache", "", "File where discovered services are saved, to connect right away on the next run")
 	senderMultiConn := senderCmd.Bool("multi", false, "Enable connection to multiple servers")
-	senderCompression := senderCmd.String("compression", "none", "Compression algorithm (none, gzip, zlib, zstd)")
+	senderCompression := senderCmd.String("compression", "none", "Compression algorithm (none, gzip, zlib, zstd, or auto to only decode)")
 	senderCompressLevel := senderCmd.Int("compress-level", 6, "Compression level (1-9)")
-
-	// Check if any arguments were provided
+	senderCompressMin := senderCmd.Int("compress-min", DEFAULT_COMPRESS_MIN, "Send messages smaller than this many bytes uncompressed")
+	senderMaxDecomp := senderCmd.String("max-decompressed", DEFAULT_MAX_DECOMP, "Close connections sending a compressed message larger than this once decompressed, e.g. 16MB")
+	senderMaxFrame := senderCmd.String("max-frame", DEFAULT_MAX_FRAME, "Close connections sending a message frame larger than this, before reading it, e.g. 1MB")
+	senderChat := senderCmd.Bool("chat", false, "Interactive chat interface (requires --tcp)")
+	senderOutputBuffer := senderCmd.Int("output-buffer", DEFAULT_OUTPUT_BUFFER, "Size of the stdout write buffer in bytes (0 disables buffering)")
+	senderBufferPool := senderCmd.Bool("buffer-pool", false, "Reuse read buffers across messages to reduce garbage collection at high message rates")
+	senderFlushInterval := senderCmd.Duration("flush-interval", DEFAULT_FLUSH_INTERVAL, "Maximum time received data stays buffered")
+	senderLines := senderCmd.Bool("lines", false, "Flush stdout after every line")
+	senderKeepOpen := senderCmd.Bool("keep-open", false, "Keep the TCP connection open after the input ends, receiving until the peer closes it")
+	senderTee := senderCmd.String("tee", "", "Also write received data to this file, keeping stdout (the file is truncated)")
+	senderNoStdout := senderCmd.Bool("no-stdout", false, "Don't write received data to stdout, only record it in the web interface and statistics")
+	senderPeek := senderCmd.Bool("peek", false, "Print direction, size, source and a hex preview of each message instead of its content (same as --output-format peek)")
+	senderOutputFormat := senderCmd.String("output-format", OUTPUT_RAW, "How received data is written to stdout: raw, hex, json or peek")
+	senderColor := senderCmd.String("color", COLOR_AUTO, "Color chat lines, notices and peek lines by direction: auto (on a terminal), always or never")
+	senderNoColor := senderCmd.Bool("no-color", false, "Never color output, overriding --color (same as --color never)")
+	senderStatsInterval := senderCmd.Duration("stats-interval", 0, "Print a traffic summary to stderr at this interval (0 disables it)")
+	senderSummaryJSON := senderCmd.String("summary-json", "", "Write the exit summary as JSON to this file")
+	senderPrintConfig := senderCmd.Bool("print-config", false, "Print the resolved configuration as JSON and exit")
+	senderIgnoreRefused := senderCmd.Bool("ignore-refused", false, "Retry sends and ignore UDP connection refused errors instead of stopping")
+	senderMaxLine := senderCmd.Int("max-line", DEFAULT_MAX_LINE, "Maximum line length in bytes for UDP sending")
+	senderMTU := senderCmd.Int("mtu", DEFAULT_MTU, "Largest UDP datagram to send; longer messages are split into chunks the receiver reassembles (0 disables chunking)")
+	senderAck := senderCmd.Bool("ack", false, "Retransmit each UDP datagram until the receiver acknowledges it")
+	senderAckTimeout := senderCmd.Duration("ack-timeout", DEFAULT_ACK_TIMEOUT, "Time to wait for an acknowledgement before retransmitting")
+	senderAckRetries := senderCmd.Int("ack-retries", DEFAULT_ACK_RETRIES, "Retransmissions before giving up on an unacknowledged datagram")
+	senderChecksum := senderCmd.Bool("checksum", false, "Prefix each UDP datagram with a CRC-32 verified by --checksum receivers")
+	senderStreamCompress := senderCmd.String("stream-compress", "", "Compress the whole TCP stream as one gzip or zstd stream, for receivers with the same option")
+	senderDropRate := senderCmd.Float64("drop-rate", 0, "Fraction of messages to drop, between 0 and 1, to simulate a lossy network")
+	senderDelay := senderCmd.Duration("delay", 0, "Delay added before each message to simulate latency")
+	senderSeed := senderCmd.Int64("seed", 0, "Seed for --drop-rate, for reproducible runs (0 picks one)")
+	senderStdinFile := senderCmd.String("stdin-file", "", "Send the contents of this file instead of reading stdin")
+	var senderFiles fileList
+	senderCmd.Var(&senderFiles, "file", "Send this file instead of reading stdin (repeatable, files are sent in order)")
+	senderFileDelimiter := senderCmd.String("file-delimiter", "", "Delimiter sent between two --file inputs (escapes such as \\n are allowed)")
+	senderSkipMissing := senderCmd.Bool("skip-missing", false, "Skip --file inputs that can't be opened instead of aborting")
+	senderAuthToken := senderCmd.String("auth-token", "", "Shared token used by the UDP instance probe instead of the default handshake")
+	senderAuthSecret := senderCmd.String("auth-secret", "", "Shared secret used to answer the TCP receiver's authentication challenge")
+	senderAuthCmd := senderCmd.String("auth-cmd", "", "Program run with the TCP connection as stdin and stdout to authenticate to the receiver; continues if it exits with status 0")
+	senderNoAuth := senderCmd.Bool("no-auth", false, "Disable the UDP instance probe")
+
+	// Ping flags
+	pingCmd := flag.NewFlagSet("ping", flag.ExitOnError)
+	pingPort := pingCmd.Int("p", DEFAULT_PORT, "Port of the receiver")
+	pingPortLong := pingCmd.Int("port", DEFAULT_PORT, "Port of the receiver")
+	pingHost := pingCmd.String("H", DEFAULT_HOST, "Host of the receiver")
+	pingHostLong := pingCmd.String("host", DEFAULT_HOST, "Host of the receiver")
+	pingCount := pingCmd.Int("count", 0, "Stop after sending this many probes (0 means until interrupted)")
+	pingInterval := pingCmd.Duration("interval", DEFAULT_PING_INTERVAL, "Time between probes")
+	pingWebUI := pingCmd.Bool("web-ui", false, "Enable web interface")
+	pingWebUIPort := pingCmd.Int("web-port", DEFAULT_WEB_PORT, "Port for web interface")
+	pingWebUIBind := pingCmd.String("web-bind", DEFAULT_BIND, "Address to bind web interface to")
+	pingWebRequired := pingCmd.Bool("web-required", false, "Exit if the web interface can't start instead of continuing without it")
+	pingDebug := pingCmd.Bool("debug", false, "Print debug messages")
+	pingPrintConfig := pingCmd.Bool("print-config", false, "Print the resolved configuration as JSON and exit")
+
+	// Bench flags
+	benchCmd := flag.NewFlagSet("bench", flag.ExitOnError)
+	benchPort := benchCmd.Int("p", DEFAULT_PORT, "Port of the receiver")
+	benchPortLong := benchCmd.Int("port", DEFAULT_PORT, "Port of the receiver")
+	benchHost := benchCmd.String("H", DEFAULT_HOST, "Host of the receiver")
+	benchHostLong := benchCmd.String("host", DEFAULT_HOST, "Host of the receiver")
+	benchSize := benchCmd.String("size", DEFAULT_BENCH_SIZE, "Amount of data to send, e.g. 512MB or 1GB")
+	benchCompression := benchCmd.String("compression", "none", "Compression algorithm (none, gzip, zlib, zstd)")
+	benchCompressLevel := benchCmd.Int("compress-level", 6, "Compression level (1-9)")
+	benchCompressMin := benchCmd.Int("compress-min", DEFAULT_COMPRESS_MIN, "Send messages smaller than this many bytes uncompressed")
+	benchNagle := benchCmd.Bool("nagle", false, "Enable Nagle's algorithm on the TCP connection")
+	benchNoHandshake := benchCmd.Bool("no-handshake", false, "Don't wait for the NP banner from the receiver, for raw TCP servers")
+	benchBindDevice := benchCmd.String("bind-device", "", "Only send through this network interface, e.g. eth0 (Linux only)")
+	benchDebug := benchCmd.Bool("debug", false, "Print debug messages")
+	benchPrintConfig := benchCmd.Bool("print-config", false, "Print the resolved configuration as JSON and exit")
+
+	// List flags
+	listCmd := flag.NewFlagSet("list", flag.ExitOnError)
+	listTimeout := listCmd.Duration("timeout", DISCOVERY_TIMEOUT, "How long to browse the local network for NP services")
+	listJSON := listCmd.Bool("json", false, "Print the services found as JSON")
+	listMDNSService := listCmd.String("mdns-service", SERVICE_TYPE, "mDNS service type to browse, e.g. _myapp._tcp")
+	listDebug := listCmd.Bool("debug", false, "Print debug messages")
+	listPrintConfig := listCmd.Bool("print-config", false, "Print the resolved configuration as JSON and exit")
+
+	// Ifaces flags
+	ifacesCmd := flag.NewFlagSet("ifaces", flag.ExitOnError)
+	ifacesJSON := ifacesCmd.Bool("json", false, "Print the interfaces and their addresses as JSON")
+	ifacesDebug := ifacesCmd.Bool("debug", false, "Print debug messages")
+	ifacesPrintConfig := ifacesCmd.Bool("print-config", false, "Print the resolved configuration as JSON and exit")
+
+	// Check if any arguments were provided. Interactive mode parses an empty
+	// argument list so defaults and environment variables still apply.
+	var args []string
 	if len(os.Args) == 1 {
 		config.mode = askForMode()
 	} else {
 		switch os.Args[1] {
 		case "--receiver":
 			config.mode = "receiver"
-			receiverCmd.Parse(os.Args[2:])
 		case "--sender":
 			config.mode = "sender"
-			senderCmd.Parse(os.Args[2:])
+		case "ping":
+			config.mode = "ping"
+		case "bench":
+			config.mode = "bench"
+		case "list":
+			config.mode = "list"
+		case "ifaces":
+			config.mode = "ifaces"
 		default:
 			fmt.Println("Error: Invalid mode specified")
 			os.Exit(1)
 		}
+		args = os.Args[2:]
+	}
+
+	cmd := senderCmd
+	switch config.mode {
+	case "receiver":
+		cmd = receiverCmd
+	case "ping":
+		cmd = pingCmd
+	case "bench":
+		cmd = benchCmd
+	case "list":
+		cmd = listCmd
+	case "ifaces":
+		cmd = ifacesCmd
 	}
+	cmd.Parse(args)
+	applyEnvironment(cmd)
 
 	// Set configuration based on mode
-	if config.mode == "receiver" {
-		if receiverCmd.Parsed() {
-			config.port = *receiverPort
-			if *receiverPortLong != DEFAULT_PORT {
-				config.port = *receiverPortLong
+	var transformSpec string
+	maxDecompSpec := DEFAULT_MAX_DECOMP
+	maxFrameSpec := DEFAULT_MAX_FRAME
+	if config.mode == "ping" {
+		config.port = *pingPort
+		if *pingPortLong != DEFAULT_PORT {
+			config.port = *pingPortLong
+		}
+		config.host = *pingHost
+		if *pingHostLong != DEFAULT_HOST {
+			config.host = *pingHostLong
+		}
+		config.count = *pingCount
+		config.pingInterval = *pingInterval
+		config.webUI = *pingWebUI
+		config.webUIPort = *pingWebUIPort
+		config.webUIBind = *pingWebUIBind
+		config.webRequired = *pingWebRequired
+		config.debug = *pingDebug
+		config.printConfig = *pingPrintConfig
+	} else if config.mode == "bench" {
+		config.port = *benchPort
+		if *benchPortLong != DEFAULT_PORT {
+			config.port = *benchPortLong
+		}
+		config.host = *benchHost
+		if *benchHostLong != DEFAULT_HOST {
+			config.host = *benchHostLong
+		}
+		size, err := parseSize(*benchSize)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: --size: %v\n", err)
+			os.Exit(1)
+		}
+		config.benchSize = size
+		config.useTCP = true
+		config.compression = *benchCompression
+		config.compressLevel = *benchCompressLevel
+		config.compressMin = *benchCompressMin
+		// Senders only compress through the multiplexer
+		config.multiConn = config.compression != "none"
+		config.nagle = *benchNagle
+		config.noHandshake = *benchNoHandshake
+		config.bindDevice = *benchBindDevice
+		config.outputBuffer = DEFAULT_OUTPUT_BUFFER
+		config.outputFormat = OUTPUT_RAW
+		config.debug = *benchDebug
+		config.printConfig = *benchPrintConfig
+	} else if config.mode == "list" {
+		config.listTimeout = *listTimeout
+		config.listJSON = *listJSON
+		config.mdnsService = *listMDNSService
+		config.debug = *listDebug
+		config.printConfig = *listPrintConfig
+
+		if config.listTimeout <= 0 {
+			fmt.Fprintf(os.Stderr, "Error: --timeout must be positive\n")
+			os.Exit(1)
+		}
+		if !validServiceType(config.mdnsService) {
+			fmt.Fprintf(os.Stderr, "Error: --mdns-service must be a DNS-SD service type such as %s\n", SERVICE_TYPE)
+			os.Exit(1)
+		}
+	} else if config.mode == "ifaces" {
+		config.ifacesJSON = *ifacesJSON
+		config.debug = *ifacesDebug
+		config.printConfig = *ifacesPrintConfig
+	} else if config.mode == "receiver" {
+		config.port = *receiverPort
+		if *receiverPortLong != DEFAULT_PORT {
+			config.port = *receiverPortLong
+		}
+		config.bindAddr = *receiverBind
+		if *receiverBindLong != DEFAULT_BIND {
+			config.bindAddr = *receiverBindLong
+		}
+		config.webUI = *receiverWebUI
+		config.webUIPort = *receiverWebUIPort
+		config.webUIBind = *receiverWebUIBind
+		config.webRequired = *receiverWebRequired
+		config.webToken = *receiverWebToken
+		config.webFlush = *receiverWebFlush
+		config.webSplitLines = *receiverWebSplitLines
+		config.webNoContent = *receiverWebNoContent
+		config.debug = *receiverDebug
+		config.relayAddr = *receiverRelay
+		config.session = *receiverSession
+		config.relayRetries = *receiverRelayRetries
+		config.relayRole = *receiverRelayRole
+		config.connectRetries = *receiverConnectRetries
+		config.connectBackoff = *receiverConnectBackoff
+		config.useTCP = *receiverUseTCP
+		config.nagle = *receiverNagle
+		config.noHandshake = *receiverNoHandshake
+		config.tfo = *receiverTFO
+		config.bindDevice = *receiverBindDevice
+		config.enableMDNS = *receiverEnableMDNS
+		config.mdnsService = *receiverMDNSService
+		config.mdnsRetries = *receiverMDNSRetries
+		config.serviceToken = *receiverServiceToken
+		config.systemd = *receiverSystemd
+		config.reusePort = *receiverReusePort
+		config.backlog = *receiverBacklog
+		config.proxyProtocol = *receiverProxyProtocol
+		config.maxWorkers = *receiverMaxWorkers
+		config.drain = *receiverDrain
+		config.notifyPeers = *receiverNotifyPeers
+		config.onConnect = *receiverOnConnectURL
+		config.onDisconnect = *receiverOnDisconnectURL
+		for _, target := range []string{config.onConnect, config.onDisconnect} {
+			if target != "" && !validWebhookURL(target) {
+				fmt.Fprintf(os.Stderr, "Error: invalid webhook URL %q, expected an http or https URL\n", target)
+				os.Exit(1)
 			}
-			config.bindAddr = *receiverBind
-			if *receiverBindLong != DEFAULT_BIND {
-				config.bindAddr = *receiverBindLong
+		}
+		config.udpIdleTimeout = *receiverUDPIdleTimeout
+		config.dedup = *receiverDedup
+		config.checksum = *receiverChecksum
+		config.streamCompress = *receiverStreamCompress
+		config.dedupWindow = *receiverDedupWindow
+		config.dedupSize = *receiverDedupSize
+		config.rejectExcess = *receiverRejectExcess
+		config.multiConn = *receiverMultiConn
+		config.compression = *receiverCompression
+		config.compressLevel = *receiverCompressLevel
+		config.compressMin = *receiverCompressMin
+		maxDecompSpec = *receiverMaxDecomp
+		maxFrameSpec = *receiverMaxFrame
+		config.chat = *receiverChat
+		config.outputBuffer = *receiverOutputBuffer
+		config.bufferPool = *receiverBufferPool
+		config.flushInterval = *receiverFlushInterval
+		config.lines = *receiverLines
+		config.sink = *receiverSink || *receiverNoStdout
+		config.outRate = *receiverOutRate
+		config.tee = *receiverTee
+		transformSpec = *receiverTransform
+		if config.outRate == "0" || config.outRate == "0/s" {
+			config.outRate = ""
+		}
+		if config.outRate != "" {
+			if _, _, err := parseRate(config.outRate); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: --out-rate: %v\n", err)
+				os.Exit(1)
 			}
-			config.webUI = *receiverWebUI
-			config.webUIPort = *receiverWebUIPort
-			config.webUIBind = *receiverWebUIBind
-			config.useTCP = *receiverUseTCP
-			config.enableMDNS = *receiverEnableMDNS
-			config.multiConn = *receiverMultiConn
-			config.compression = *receiverCompression
-			config.compressLevel = *receiverCompressLevel
-		} else {
-			config.port = DEFAULT_PORT
-			config.bindAddr = DEFAULT_BIND
-			config.webUI = false
-			config.webUIPort = DEFAULT_WEB_PORT
-			config.webUIBind = DEFAULT_BIND
-			config.useTCP = false
-			config.enableMDNS = false
-			config.multiConn = false
-			config.compression = "none"
-			config.compressLevel = 6
 		}
+		config.outputFormat = *receiverOutputFormat
+		config.colorMode = *receiverColor
+		if *receiverNoColor {
+			config.colorMode = COLOR_NEVER
+		}
+		if *receiverPeek {
+			config.outputFormat = OUTPUT_PEEK
+		}
+		config.ignoreRefused = *receiverIgnoreRefused
+		config.authToken = *receiverAuthToken
+		config.authSecret = *receiverAuthSecret
+		config.authCmd = *receiverAuthCmd
+		config.noAuth = *receiverNoAuth
+		config.printConfig = *receiverPrintConfig
+		config.count = *receiverCount
+		config.statsInterval = *receiverStatsInterval
+		config.summaryJSON = *receiverSummaryJSON
 	} else {
-		if senderCmd.Parsed() {
-			config.port = *senderPort
-			if *senderPortLong != DEFAULT_PORT {
-				config.port = *senderPortLong
-			}
-			config.host = *senderHost
-			if *senderHostLong != DEFAULT_HOST {
-				config.host = *senderHostLong
+		config.port = *senderPort
+		if *senderPortLong != DEFAULT_PORT {
+			config.port = *senderPortLong
+		}
+		config.host = *senderHost
+		if *senderHostLong != DEFAULT_HOST {
+			config.host = *senderHostLong
+		}
+		config.webUI = *senderWebUI
+		config.webUIPort = *senderWebUIPort
+		config.webUIBind = *senderWebUIBind
+		config.webRequired = *senderWebRequired
+		config.webToken = *senderWebToken
+		config.webFlush = *senderWebFlush
+		config.webSplitLines = *senderWebSplitLines
+		config.webNoContent = *senderWebNoContent
+		config.connectRetries = *senderConnectRetries
+		config.connectBackoff = *senderConnectBackoff
+		config.debug = *senderDebug
+		config.relayAddr = *senderRelay
+		config.session = *senderSession
+		config.relayRetries = *senderRelayRetries
+		config.relayRole = *senderRelayRole
+		config.useTCP = *senderUseTCP
+		config.nagle = *senderNagle
+		config.noHandshake = *senderNoHandshake
+		config.tfo = *senderTFO
+		config.bindDevice = *senderBindDevice
+		config.enableMDNS = *senderEnableMDNS
+		config.mdnsService = *senderMDNSService
+		config.expectToken = *senderExpectToken
+		config.discoveryCache = *senderDiscoveryCache
+		config.label = *senderLabel
+		transformSpec = *senderTransform
+		config.stdinFile = *senderStdinFile
+		config.dropRate = *senderDropRate
+		config.checksum = *senderChecksum
+		config.mtu = *senderMTU
+		config.ack = *senderAck
+		config.ackTimeout = *senderAckTimeout
+		config.ackRetries = *senderAckRetries
+		config.streamCompress = *senderStreamCompress
+		config.delay = *senderDelay
+		config.seed = *senderSeed
+		config.files = senderFiles
+		config.fileDelimiter = unescapeDelimiter(*senderFileDelimiter)
+		config.skipMissing = *senderSkipMissing
+		config.multiConn = *senderMultiConn
+		config.compression = *senderCompression
+		config.compressLevel = *senderCompressLevel
+		config.compressMin = *senderCompressMin
+		maxDecompSpec = *senderMaxDecomp
+		maxFrameSpec = *senderMaxFrame
+		config.chat = *senderChat
+		config.outputBuffer = *senderOutputBuffer
+		config.bufferPool = *senderBufferPool
+		config.flushInterval = *senderFlushInterval
+		config.lines = *senderLines
+		config.sink = *senderNoStdout
+		config.tee = *senderTee
+		config.keepOpen = *senderKeepOpen
+		config.outputFormat = *senderOutputFormat
+		config.colorMode = *senderColor
+		if *senderNoColor {
+			config.colorMode = COLOR_NEVER
+		}
+		if *senderPeek {
+			config.outputFormat = OUTPUT_PEEK
+		}
+		config.ignoreRefused = *senderIgnoreRefused
+		config.authToken = *senderAuthToken
+		config.authSecret = *senderAuthSecret
+		config.authCmd = *senderAuthCmd
+		config.noAuth = *senderNoAuth
+		config.printConfig = *senderPrintConfig
+		config.statsInterval = *senderStatsInterval
+		config.summaryJSON = *senderSummaryJSON
+		config.maxLine = *senderMaxLine
+
+		if config.dropRate < 0 || config.dropRate > 1 {
+			fmt.Fprintf(os.Stderr, "Error: --drop-rate must be between 0 and 1\n")
+			os.Exit(1)
+		}
+		if config.mtu != 0 && (config.mtu < MIN_MTU || config.mtu > MAX_MTU) {
+			fmt.Fprintf(os.Stderr, "Error: --mtu must be 0 or between %d and %d\n", MIN_MTU, MAX_MTU)
+			os.Exit(1)
+		}
+		if config.ack && (config.useTCP || config.session != "") {
+			fmt.Fprintf(os.Stderr, "Error: --ack is only supported over UDP, TCP already delivers reliably\n")
+			os.Exit(1)
+		}
+		if config.ackTimeout <= 0 || config.ackRetries < 0 {
+			fmt.Fprintf(os.Stderr, "Error: --ack-timeout must be positive and --ack-retries can't be negative\n")
+			os.Exit(1)
+		}
+		if config.label != "" && !validLabel(config.label) {
+			fmt.Fprintf(os.Stderr, "Error: --label must be up to %d letters, digits and . _ : @ - characters\n", LABEL_MAX_LENGTH)
+			os.Exit(1)
+		}
+		if len(config.files) > 0 && config.stdinFile != "" {
+			fmt.Fprintf(os.Stderr, "Error: --file and --stdin-file cannot be used together\n")
+			os.Exit(1)
+		}
+	}
+
+	// Catch typos in addresses before the socket layer reports them
+	if config.mode == "receiver" {
+		if err := validateAddress("--bind", config.bindAddr); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	} else if config.mode == "sender" || config.mode == "ping" || config.mode == "bench" {
+		if err := validateAddress("--host", config.host); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	// Ping, bench, list and ifaces modes don't have both flags
+	if config.mode == "receiver" || config.mode == "sender" {
+		if !validServiceType(config.mdnsService) {
+			fmt.Fprintf(os.Stderr, "Error: --mdns-service must be a DNS-SD service type such as %s\n", SERVICE_TYPE)
+			os.Exit(1)
+		}
+		if !validOutputFormat(config.outputFormat) {
+			fmt.Fprintf(os.Stderr, "Error: --output-format must be one of %s\n", strings.Join(outputFormats, ", "))
+			os.Exit(1)
+		}
+		if !validColorMode(config.colorMode) {
+			fmt.Fprintf(os.Stderr, "Error: --color must be one of %s\n", strings.Join(colorModes, ", "))
+			os.Exit(1)
+		}
+		config.color = useColor(config.colorMode, os.Stdout)
+	}
+	if config.mode == "receiver" || config.mode == "sender" || config.mode == "bench" {
+		config.compression = strings.ToLower(config.compression)
+		decode := config.mode != "bench"
+		if !validCompression(config.compression, decode) {
+			names := compressions
+			if !decode {
+				names = compressions[:len(compressions)-1]
 			}
-			config.webUI = *senderWebUI
-			config.webUIPort = *senderWebUIPort
-			config.webUIBind = *senderWebUIBind
-			config.useTCP = *senderUseTCP
-			config.enableMDNS = *senderEnableMDNS
-			config.multiConn = *senderMultiConn
-			config.compression = *senderCompression
-			config.compressLevel = *senderCompressLevel
-		} else {
-			config.port = DEFAULT_PORT
-			config.host = DEFAULT_HOST
-			config.webUI = false
-			config.webUIPort = DEFAULT_WEB_PORT
-			config.webUIBind = DEFAULT_BIND
-			config.useTCP = false
-			config.enableMDNS = false
-			config.multiConn = false
-			config.compression = "none"
-			config.compressLevel = 6
+			fmt.Fprintf(os.Stderr, "Error: --compression must be one of %s\n", strings.Join(names, ", "))
+			os.Exit(1)
 		}
 	}
+	if config.checksum && (config.useTCP || config.session != "") {
+		fmt.Fprintf(os.Stderr, "Error: --checksum is only supported over UDP, TCP data has no message framing to carry it\n")
+		os.Exit(1)
+	}
+	if config.proxyProtocol && (!config.useTCP || config.session != "") {
+		fmt.Fprintf(os.Stderr, "Error: --proxy-protocol requires a TCP receiver listening for connections\n")
+		os.Exit(1)
+	}
+	if (config.authSecret != "" || config.authCmd != "") && (!config.useTCP || config.session != "") {
+		fmt.Fprintf(os.Stderr, "Error: --auth-secret and --auth-cmd require TCP without a relay session; UDP uses --auth-token\n")
+		os.Exit(1)
+	}
+	if config.authSecret != "" && config.authCmd != "" {
+		fmt.Fprintf(os.Stderr, "Error: --auth-secret and --auth-cmd cannot be combined\n")
+		os.Exit(1)
+	}
+	if config.authCmd != "" && config.proxyProtocol {
+		fmt.Fprintf(os.Stderr, "Error: --auth-cmd cannot be combined with --proxy-protocol, whose connections can't be handed to a program\n")
+		os.Exit(1)
+	}
+	if config.tfo && !config.useTCP && config.session == "" {
+		fmt.Fprintf(os.Stderr, "Error: --tfo requires TCP, since UDP has no handshake to shorten\n")
+		os.Exit(1)
+	}
+	if config.noHandshake && !config.useTCP && config.session == "" {
+		fmt.Fprintf(os.Stderr, "Error: --no-handshake requires TCP; UDP senders probe the receiver instead\n")
+		os.Exit(1)
+	}
+	if !validStreamCompression(config.streamCompress) {
+		fmt.Fprintf(os.Stderr, "Error: --stream-compress must be one of %s\n", strings.Join(streamCompressions, ", "))
+		os.Exit(1)
+	}
+	if config.streamCompress != "" && !config.useTCP && config.session == "" {
+		fmt.Fprintf(os.Stderr, "Error: --stream-compress is only supported over TCP, where the stream is ordered\n")
+		os.Exit(1)
+	}
+	if config.streamCompress != "" && (config.multiConn || config.compression != "none") {
+		fmt.Fprintf(os.Stderr, "Error: --stream-compress cannot be combined with --multi or --compression\n")
+		os.Exit(1)
+	}
+
+	maxDecompress, err := parseSize(maxDecompSpec)
+	if err != nil || maxDecompress <= 0 {
+		fmt.Fprintf(os.Stderr, "Error: --max-decompressed must be a positive size such as %s\n", DEFAULT_MAX_DECOMP)
+		os.Exit(1)
+	}
+	config.maxDecompress = maxDecompress
+
+	maxFrame, err := parseSize(maxFrameSpec)
+	if err != nil || maxFrame <= 0 {
+		fmt.Fprintf(os.Stderr, "Error: --max-frame must be a positive size such as %s\n", DEFAULT_MAX_FRAME)
+		os.Exit(1)
+	}
+	config.maxFrame = maxFrame
+
+	transforms, err := parseTransforms(transformSpec)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: --transform: %v\n", err)
+		os.Exit(1)
+	}
+	config.transforms = transforms
+
+	if _, ok := relayRoles[config.relayRole]; config.relayRole != "" && !ok {
+		fmt.Fprintf(os.Stderr, "Error: --relay-role must be host or guest\n")
+		os.Exit(1)
+	}
 
 	return config
 }
 
+// openInput returns the source of data to send: the --file inputs, the
+// --stdin-file, or stdin
+func openInput(config *Config) (io.Reader, error) {
+	if len(config.files) > 0 {
+		return NewMultiFileReader(config.files, config.fileDelimiter, config.skipMissing), nil
+	}
+
+	if config.stdinFile == "" {
+		return os.Stdin, nil
+	}
+
+	file, err := os.Open(config.stdinFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open input file: %v", err)
+	}
+	return file, nil
+}
+
 // NewNetworkPipe creates an instance of the original UDP pipe
 func NewNetworkPipe(config *Config) (*NetworkPipe, error) {
+	input, err := openInput(config)
+	if err != nil {
+		return nil, err
+	}
+
+	output, err := newStdoutWriter(config)
+	if err != nil {
+		return nil, err
+	}
+
 	np := &NetworkPipe{
 		config:     config,
 		bufferSize: BUFFER_SIZE,
+		input:      input,
+		output:     output,
+		simulator:  NewNetworkSimulator(config),
+		messageID:  uint32(time.Now().UnixNano()),
+	}
+	np.chunks = NewChunkAssembler(np.recordIncomplete)
+	np.codec = NewDatagramCodec(config)
+	np.ackWindow = NewAckWindow()
+	if config.mode == "sender" && config.ack {
+		np.acks = NewAckTracker(config.ackTimeout, config.ackRetries, np.recordUnacked)
+	}
+
+	if config.mode == "receiver" && config.dedup {
+		np.dedup = NewDedupWindow(config.dedupWindow, config.dedupSize)
 	}
 
 	var bindAddr string
@@ -213,23 +921,32 @@ func NewNetworkPipe(config *Config) (*NetworkPipe, error) {
 		bindAddr = "0.0.0.0"
 	}
 
-	addr := &net.UDPAddr{
-		IP:   net.ParseIP(bindAddr),
-		Port: config.port,
+	// Use the socket passed by systemd instead of binding one
+	if config.mode == "receiver" && config.systemd {
+		np.conn, err = systemdPacketConn()
+		if err != nil {
+			return nil, err
+		}
+		return np, nil
 	}
 
-	var err error
-	np.conn, err = net.ListenUDP("udp", addr)
+	// Host names given to --bind resolve to the address to listen on
+	addr, err := net.ResolveUDPAddr("udp", hostPort(bindAddr, config.port))
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve bind address: %v", err)
+	}
+
+	np.conn, err = listenUDP(config, addr)
 	if err != nil {
 		if config.mode == "receiver" {
-			if isNPRunning(bindAddr, config.port) {
+			if !config.noAuth && isNPRunning(config, bindAddr, config.port) {
 				fmt.Fprintf(os.Stderr, "Another NP instance is already running and listening\n")
 				os.Exit(1)
 			}
 			return nil, fmt.Errorf("port %d is in use by another application", config.port)
 		}
 		// For sending mode, use any available port
-		np.conn, err = net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(bindAddr), Port: 0})
+		np.conn, err = listenUDP(config, &net.UDPAddr{IP: addr.IP, Zone: addr.Zone})
 		if err != nil {
 			return nil, fmt.Errorf("failed to bind to any port: %v", err)
 		}
@@ -238,15 +955,26 @@ func NewNetworkPipe(config *Config) (*NetworkPipe, error) {
 	return np, nil
 }
 
+// authMessages returns the probe and reply of the UDP instance handshake.
+// With --auth-token, both carry the token so unrelated deployments don't match.
+func (config *Config) authMessages() (command string, response string) {
+	if config.authToken == "" {
+		return AUTH_COMMAND, AUTH_RESPONSE
+	}
+	return AUTH_COMMAND + " " + config.authToken, AUTH_RESPONSE + " " + config.authToken
+}
+
 // isNPRunning checks if an NP instance is already running
-func isNPRunning(host string, port int) bool {
-	conn, err := net.DialTimeout("udp", fmt.Sprintf("%s:%d", host, port), AUTH_TIMEOUT)
+func isNPRunning(config *Config, host string, port int) bool {
+	command, response := config.authMessages()
+
+	conn, err := net.DialTimeout("udp", hostPort(host, port), AUTH_TIMEOUT)
 	if err != nil {
 		return false
 	}
 	defer conn.Close()
 
-	_, err = conn.Write([]byte(AUTH_COMMAND))
+	_, err = conn.Write([]byte(command))
 	if err != nil {
 		return false
 	}
@@ -258,12 +986,27 @@ func isNPRunning(host string, port int) bool {
 		return false
 	}
 
-	return string(buffer[:n]) == AUTH_RESPONSE
+	return string(buffer[:n]) == response
 }
 
 func (np *NetworkPipe) handleAuth(data []byte, addr *net.UDPAddr) bool {
-	if string(data) == AUTH_COMMAND {
-		np.conn.WriteToUDP([]byte(AUTH_RESPONSE), addr)
+	if !np.config.noAuth {
+		command, response := np.config.authMessages()
+		if string(data) == command {
+			np.conn.WriteToUDP([]byte(response), addr)
+			return true
+		}
+
+		// Probes from deployments with a different token go unanswered
+		if string(data) == AUTH_COMMAND || strings.HasPrefix(string(data), AUTH_COMMAND+" ") {
+			return true
+		}
+	}
+
+	// Echo latency probes from "np ping" back with their payload
+	if bytes.HasPrefix(data, []byte(PING_COMMAND)) {
+		reply := append([]byte(PING_RESPONSE), data[len(PING_COMMAND):]...)
+		np.conn.WriteToUDP(reply, addr)
 		return true
 	}
 	return false
@@ -272,28 +1015,114 @@ func (np *NetworkPipe) handleAuth(data []byte, addr *net.UDPAddr) bool {
 func (np *NetworkPipe) handleReceive(wg *sync.WaitGroup) {
 	defer wg.Done()
 
-	buffer := make([]byte, np.bufferSize)
+	buffer := getBuffer(np.config, np.bufferSize)
+	defer putBuffer(np.config, buffer)
 	for {
 		n, addr, err := np.conn.ReadFromUDP(buffer)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
 		if err != nil {
+			// An ICMP port unreachable from an earlier send can surface here
+			if np.config.ignoreRefused && isConnRefused(err) {
+				continue
+			}
 			fmt.Fprintf(os.Stderr, "Error reading: %v\n", err)
 			return
 		}
 
+		// Answer --ack probes and take ACKs before instance probes
+		if string(buffer[:n]) == ACK_PROBE {
+			np.conn.WriteToUDP([]byte(ACK_PROBE_RESPONSE), addr)
+			continue
+		}
+		if seq, ok := parseAck(buffer[:n]); ok {
+			if np.acks != nil {
+				np.acks.Ack(seq)
+			}
+			continue
+		}
+
 		if np.handleAuth(buffer[:n], addr) {
 			continue
 		}
 
+		// Drop datagrams that fail the --checksum, keeping the payload
+		data := buffer[:n]
+		if np.config.checksum {
+			payload, ok := verifyChecksum(data)
+			if !ok {
+				fmt.Fprintf(os.Stderr, "Dropped corrupt datagram of %d bytes from %s\n", n, addr)
+				if np.web != nil {
+					np.web.RecordChecksumError()
+				}
+				continue
+			}
+			data = payload
+		}
+
+		// Acknowledge --ack datagrams, dropping retransmits whose first
+		// ACK was lost
+		if seq, payload, ok := parseSequence(data); ok {
+			np.conn.WriteToUDP(newAck(seq), addr)
+			if np.ackWindow.Duplicate(addr.String(), seq) {
+				np.config.debugf("Dropped retransmitted datagram %d from %s", seq, addr)
+				continue
+			}
+			data = payload
+		}
+
+		// Decompress datagrams compressed by the sender, each on its own
+		data, compType, err := np.codec.Decompress(data)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Dropped datagram from %s: %v\n", addr, err)
+			continue
+		}
+
+		// Put messages chunked by the sender's --mtu back together
+		data, ok := np.chunks.Add(addr.String(), data)
+		if !ok {
+			continue
+		}
+
+		// Drop datagrams retransmitted by the sender within the --dedup window
+		if np.dedup != nil && np.dedup.Duplicate(addr.String(), data) {
+			np.config.debugf("Dropped duplicate datagram of %d bytes from %s", n, addr)
+			if np.web != nil {
+				np.web.RecordDuplicate()
+			}
+			continue
+		}
+
 		// Record for the web interface
-		if np.config.webUI {
-			content := string(buffer[:n])
-			RecordReceivedData(uint64(n), addr.String())
-			RecordMessage(content, "in", n, addr.String(), np.conn.LocalAddr().String())
+		if np.web != nil {
+			content := string(data)
+			np.web.RecordReceivedData(uint64(len(data)), addr.String())
+			np.web.PublishTail(data)
+			if compType != NoCompression {
+				content = fmt.Sprintf("[Decompressed: %s] %s", GetCompressionName(compType), content)
+				np.web.RecordCompressedMessage(content, "in", len(data), addr.String(), np.conn.LocalAddr().String())
+			} else {
+				np.web.RecordMessage(content, "in", len(data), addr.String(), np.conn.LocalAddr().String())
+			}
 		}
 
-		os.Stdout.Write(buffer[:n])
-		if !strings.HasSuffix(string(buffer[:n]), "\n") {
-			os.Stdout.Write([]byte{'\n'})
+		// Undo the --transform chain, dropping datagrams it can't undo
+		data, err = np.config.transforms.Reverse(data)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Dropped datagram from %s: %v\n", addr, err)
+			continue
+		}
+		writeFormatted(np.output, np.config.outputFormat, np.config.color, addr.String(), data)
+		if np.config.outputFormat == OUTPUT_RAW && !bytes.HasSuffix(data, []byte("\n")) {
+			np.output.Write([]byte{'\n'})
+		}
+
+		// Stop once --count datagrams have been written
+		np.received++
+		if np.config.count > 0 && np.received >= np.config.count {
+			np.Close()
+			return
 		}
 	}
 }
@@ -301,68 +1130,248 @@ func (np *NetworkPipe) handleReceive(wg *sync.WaitGroup) {
 func (np *NetworkPipe) handleSend(wg *sync.WaitGroup) {
 	defer wg.Done()
 
-	if !isNPRunning(np.config.host, np.config.port) {
-		fmt.Fprintf(os.Stderr, "Warning: Remote host is not running NP or is unreachable\n")
-		return
+	if !np.config.noAuth {
+		err := retryConnect(np.config, np.config.connectRetries, "Checking for NP on "+np.config.host, func() error {
+			if !isNPRunning(np.config, np.config.host, np.config.port) {
+				return fmt.Errorf("no NP response")
+			}
+			return nil
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: Remote host is not running NP or is unreachable\n")
+			return
+		}
 	}
 
-	scanner := bufio.NewScanner(os.Stdin)
-	remoteAddr := &net.UDPAddr{
-		IP:   net.ParseIP(np.config.host),
-		Port: np.config.port,
+	// Receivers from before --ack would write the sequence numbers out
+	if np.acks != nil {
+		np.sendAcks = ackSupported(np.config.host, np.config.port)
+		if !np.sendAcks {
+			fmt.Fprintf(os.Stderr, "Warning: Receiver doesn't acknowledge datagrams, sending without --ack\n")
+		}
+	}
+
+	scanner := bufio.NewScanner(np.input)
+	initialSize := BUFFER_SIZE
+	if np.config.maxLine < initialSize {
+		initialSize = np.config.maxLine
+	}
+	scanner.Buffer(make([]byte, 0, initialSize), np.config.maxLine)
+	remoteAddr, err := net.ResolveUDPAddr("udp", hostPort(np.config.host, np.config.port))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: failed to resolve %s: %v\n", np.config.host, err)
+		return
 	}
 
 	for scanner.Scan() {
-		data := scanner.Bytes()
-		_, err := np.conn.WriteToUDP(data, remoteAddr)
+		data, err := np.config.transforms.Apply(scanner.Bytes())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v, skipping %d bytes\n", err, len(scanner.Bytes()))
+			continue
+		}
+		if !np.simulator.Deliver() {
+			np.config.debugf("Simulated drop of %d bytes", len(data))
+			continue
+		}
+
+		err = np.sendMessage(data, remoteAddr)
+		if err != nil && np.config.ignoreRefused && isConnRefused(err) {
+			fmt.Fprintf(os.Stderr, "Warning: %s refused the data, dropping %d bytes\n", remoteAddr, len(data))
+			continue
+		}
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Error sending: %v\n", err)
 			return
 		}
 
 		// Record for the web interface
-		if np.config.webUI {
+		if np.web != nil {
 			content := string(data)
 			size := len(data)
-			RecordSentData(uint64(size), remoteAddr.String())
-			RecordMessage(content, "out", size, np.conn.LocalAddr().String(), remoteAddr.String())
+			np.web.RecordSentData(uint64(size), remoteAddr.String())
+			np.web.RecordMessage(content, "out", size, np.conn.LocalAddr().String(), remoteAddr.String())
 		}
 	}
 
-	if err := scanner.Err(); err != nil {
-		fmt.Fprintf(os.Stderr, "Error reading from stdin: %v\n", err)
+	if err := scanner.Err(); err == bufio.ErrTooLong {
+		fmt.Fprintf(os.Stderr, "Error: input line exceeds the maximum of %d bytes, increase it with --max-line\n", np.config.maxLine)
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading input: %v\n", err)
 	}
 }
 
-func (np *NetworkPipe) Start() error {
-	var wg sync.WaitGroup
-	wg.Add(2)
+// sendMessage sends data to addr, split into chunks when it doesn't fit
+// in a datagram of --mtu bytes
+func (np *NetworkPipe) sendMessage(data []byte, addr *net.UDPAddr) error {
+	overhead := 0
+	if np.config.checksum {
+		overhead = CHECKSUM_SIZE
+	}
+	if np.sendAcks {
+		overhead += SEQ_HEADER_SIZE
+	}
+
+	np.messageID++
+	datagrams, err := splitMessage(data, np.messageID, np.config.mtu, overhead)
+	if err != nil {
+		return err
+	}
 
-	// Initialize the web interface, if enabled
-	if np.config.webUI {
-		webConfig := &WebUIConfig{
-			Address: np.config.webUIBind,
-			Port:    np.config.webUIPort,
-			Enabled: true,
+	for _, datagram := range datagrams {
+		if err := np.sendDatagram(datagram, addr); err != nil {
+			return err
 		}
-		StartWebUI(webConfig, np.config)
+	}
+	return nil
+}
+
+// sendDatagram writes data to addr, compressed on its own with
+// --compression. With --ignore-refused, "connection refused" errors caused
+// by a restarting receiver are retried a few times.
+func (np *NetworkPipe) sendDatagram(data []byte, addr *net.UDPAddr) error {
+	data, err := np.codec.Compress(data)
+	if err != nil {
+		return err
+	}
+
+	var seq uint32
+	if np.sendAcks {
+		seq, data = np.acks.Next(data)
+	}
+	if np.config.checksum {
+		data = addChecksum(data)
+	}
+
+	// Wait for the ACK from before writing, since it can arrive right away
+	if np.sendAcks {
+		np.acks.Sent(seq, data, addr)
 	}
 
+	_, err = np.conn.WriteToUDP(data, addr)
+	for retry := 0; err != nil && np.config.ignoreRefused && isConnRefused(err) && retry < UDP_SEND_RETRIES; retry++ {
+		time.Sleep(UDP_RETRY_DELAY)
+		_, err = np.conn.WriteToUDP(data, addr)
+	}
+	if err != nil && np.sendAcks {
+		np.acks.Ack(seq)
+	}
+	return err
+}
+
+// isConnRefused reports whether err is an ECONNREFUSED, which UDP sockets
+// report after the remote host answered an earlier datagram with ICMP port
+// unreachable
+func isConnRefused(err error) bool {
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) {
+		return false
+	}
+	return errors.Is(opErr.Err, syscall.ECONNREFUSED)
+}
+
+func (np *NetworkPipe) Start() error {
+	var wg sync.WaitGroup
+
+	wg.Add(1)
 	go np.handleReceive(&wg)
 
 	if np.config.mode == "sender" {
+		wg.Add(1)
 		go np.handleSend(&wg)
 	}
 
+	// Give up on chunked messages even when no more datagrams arrive
+	stop := make(chan struct{})
+	go np.expireChunks(stop)
+	if np.acks != nil {
+		go np.retransmit(stop)
+	}
+	defer close(stop)
+
 	wg.Wait()
 	return nil
 }
 
-func (np *NetworkPipe) Close() error {
-	if np.conn != nil {
-		return np.conn.Close()
+// expireChunks periodically drops the chunked messages whose missing
+// chunks never arrived, until stop is closed
+func (np *NetworkPipe) expireChunks(stop chan struct{}) {
+	ticker := time.NewTicker(CHUNK_TIMEOUT / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			np.chunks.Expire()
+			np.ackWindow.Expire()
+		}
 	}
-	return nil
+}
+
+// retransmit periodically sends again the --ack datagrams whose ACK is
+// overdue, until stop is closed
+func (np *NetworkPipe) retransmit(stop chan struct{}) {
+	interval := np.config.ackTimeout / 2
+	if interval <= 0 {
+		interval = np.config.ackTimeout
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			for _, pending := range np.acks.Due() {
+				np.config.debugf("Retransmitting %d bytes to %s, attempt %d", len(pending.datagram), pending.addr, pending.attempts)
+				if _, err := np.conn.WriteToUDP(pending.datagram, pending.addr); err != nil {
+					np.config.debugf("Error retransmitting: %v", err)
+				}
+			}
+		}
+	}
+}
+
+// recordIncomplete counts a chunked message dropped before all its chunks
+// arrived
+func (np *NetworkPipe) recordIncomplete() {
+	if np.web != nil {
+		np.web.RecordIncomplete()
+	}
+}
+
+// recordUnacked counts a datagram given up on after --ack-retries
+func (np *NetworkPipe) recordUnacked() {
+	if np.web != nil {
+		np.web.RecordUnacked()
+	}
+}
+
+// SetWebUI assigns the web interface that records this pipe's traffic
+func (np *NetworkPipe) SetWebUI(web *WebUIServer) {
+	np.web = web
+}
+
+// Shutdown closes the pipe; UDP has no connections to drain
+func (np *NetworkPipe) Shutdown() error {
+	return np.Close()
+}
+
+func (np *NetworkPipe) Close() error {
+	np.closeOnce.Do(func() {
+		if out, ok := np.output.(*OutputWriter); ok {
+			out.Close()
+		}
+		if closer, ok := np.input.(io.Closer); ok && np.input != io.Reader(os.Stdin) {
+			closer.Close()
+		}
+		if np.conn != nil {
+			np.closeErr = np.conn.Close()
+		}
+	})
+	return np.closeErr
 }
 
 // getCompressType gets the compression type from the string
@@ -379,72 +1388,247 @@ func getCompressType(compression string) CompressionType {
 	}
 }
 
-// createConnHandler creates the appropriate connection handler based on the configuration
-func createConnHandler(config *Config) (ConnHandler, error) {
-	// If using TCP
-	if config.useTCP {
+// printResolvedConfig writes the fully resolved configuration to stdout as JSON
+func printResolvedConfig(config *Config) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(map[string]interface{}{
+		"mode":            config.mode,
+		"port":            config.port,
+		"host":            config.host,
+		"bindAddr":        config.bindAddr,
+		"webUI":           config.webUI,
+		"webUIPort":       config.webUIPort,
+		"webUIBind":       config.webUIBind,
+		"webTokenSet":     config.webToken != "",
+		"webFlush":        config.webFlush.String(),
+		"webSplitLines":   config.webSplitLines,
+		"webNoContent":    config.webNoContent,
+		"webRequired":     config.webRequired,
+		"useTCP":          config.useTCP,
+		"nagle":           config.nagle,
+		"tfo":             config.tfo,
+		"noHandshake":     config.noHandshake,
+		"enableMDNS":      config.enableMDNS,
+		"mdnsService":     config.mdnsService,
+		"mdnsRetries":     config.mdnsRetries,
+		"serviceTokenSet": config.serviceToken != "",
+		"expectTokenSet":  config.expectToken != "",
+		"discoveryCache":  config.discoveryCache,
+		"label":           config.label,
+		"compression":     config.compression,
+		"compressionType": GetCompressionName(getCompressType(config.compression)),
+		"compressLevel":   config.compressLevel,
+		"compressMin":     config.compressMin,
+		"maxDecompress":   config.maxDecompress,
+		"maxFrame":        config.maxFrame,
+		"multiConn":       config.multiConn,
+		"chat":            config.chat,
+		"maxLine":         config.maxLine,
+		"outputBuffer":    config.outputBuffer,
+		"bufferPool":      config.bufferPool,
+		"flushInterval":   config.flushInterval.String(),
+		"lines":           config.lines,
+		"keepOpen":        config.keepOpen,
+		"outputFormat":    config.outputFormat,
+		"color":           config.colorMode,
+		"pingInterval":    config.pingInterval.String(),
+		"listTimeout":     config.listTimeout.String(),
+		"listJSON":        config.listJSON,
+		"ifacesJSON":      config.ifacesJSON,
+		"benchSize":       config.benchSize,
+		"sink":            config.sink,
+		"tee":             config.tee,
+		"outRate":         config.outRate,
+		"transform":       config.transforms.String(),
+		"authTokenSet":    config.authToken != "",
+		"noAuth":          config.noAuth,
+		"authSecretSet":   config.authSecret != "",
+		"authCmd":         config.authCmd,
+		"stdinFile":       config.stdinFile,
+		"systemd":         config.systemd,
+		"reusePort":       config.reusePort,
+		"backlog":         config.backlog,
+		"proxyProtocol":   config.proxyProtocol,
+		"bindDevice":      config.bindDevice,
+		"maxWorkers":      config.maxWorkers,
+		"drain":           config.drain.String(),
+		"notifyPeers":     config.notifyPeers,
+		"onConnectURL":    config.onConnect,
+		"onDisconnectURL": config.onDisconnect,
+		"udpIdleTimeout":  config.udpIdleTimeout.String(),
+		"dedup":           config.dedup,
+		"checksum":        config.checksum,
+		"mtu":             config.mtu,
+		"ack":             config.ack,
+		"ackTimeout":      config.ackTimeout.String(),
+		"ackRetries":      config.ackRetries,
+		"streamCompress":  config.streamCompress,
+		"dedupWindow":     config.dedupWindow.String(),
+		"dedupSize":       config.dedupSize,
+		"rejectExcess":    config.rejectExcess,
+		"dropRate":        config.dropRate,
+		"delay":           config.delay.String(),
+		"seed":            config.seed,
+		"files":           config.files,
+		"fileDelimiter":   config.fileDelimiter,
+		"skipMissing":     config.skipMissing,
+		"ignoreRefused":   config.ignoreRefused,
+		"count":           config.count,
+		"statsInterval":   config.statsInterval.String(),
+		"summaryJSON":     config.summaryJSON,
+		"connectRetries":  config.connectRetries,
+		"connectBackoff":  config.connectBackoff.String(),
+		"debug":           config.debug,
+		"relayAddr":       config.relayAddr,
+		"session":         redactSession(config.session),
+		"relayRetries":    config.relayRetries,
+		"relayRole":       config.relayRole,
+	})
+}
+
+// startDiscovery announces the receiver via mDNS or, for senders without an
+// explicit host, looks for a receiver and updates the configuration to use
+// the first one found. Services without the --expect-token are skipped.
+func startDiscovery(config *Config) *DiscoveryService {
+	discovery := NewDiscoveryService(config)
+
+	if config.mode == "receiver" {
+		// Announce the service on the network
+		serviceName := fmt.Sprintf("NP Server (%s)", config.bindAddr)
+		err := discovery.StartAnnounce(serviceName, config.port, config.useTCP)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: Failed to announce mDNS service: %v\n", err)
+		}
+		return discovery
+	}
+
+	// Seed the services with the ones found by previous runs, so a known
+	// receiver is used right away while mDNS verifies it in the background
+	if config.discoveryCache != "" {
+		if err := discovery.LoadCache(config.discoveryCache); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+		}
+	}
+
+	// Discover services on the network
+	err := discovery.StartBrowse()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: Failed to start mDNS discovery: %v\n", err)
+		return discovery
+	}
+	fmt.Fprintf(os.Stderr, "Started mDNS discovery for NP services\n")
+
+	// If no specific host is provided, try to find one via mDNS
+	if config.host != DEFAULT_HOST {
+		return discovery
+	}
+
+	if discovery.useService(config) {
+		return discovery
+	}
+
+	fmt.Fprintf(os.Stderr, "Looking for NP services on the network...\n")
+	// Wait a few seconds to discover services
+	time.Sleep(2 * time.Second)
+
+	if !discovery.useService(config) {
+		fmt.Fprintf(os.Stderr, "No matching NP service found, using %s\n", config.host)
+	}
+	return discovery
+}
+
+// useService points config at the first discovered service matching
+// --expect-token and reports whether one was found
+func (ds *DiscoveryService) useService(config *Config) bool {
+	for _, service := range ds.GetServices() {
+		if config.expectToken != "" && service.Token != config.expectToken {
+			reason := "token does not match"
+			if service.Token == "" {
+				reason = "no token announced"
+			}
+			fmt.Fprintf(os.Stderr, "Skipping NP service %s at %s:%d: %s\n",
+				service.Name, service.Host, service.Port, reason)
+			continue
+		}
+
+		// Use the first matching service
+		source := "Found"
+		if service.Cached {
+			source = "Using cached"
+		}
+		fmt.Fprintf(os.Stderr, "%s NP service: %s at %s:%d\n",
+			source, service.Name, service.Host, service.Port)
+
+		config.host = service.Host
+		config.port = service.Port
+		config.useTCP = service.IsTCP
+		ds.selected = &service
+		return true
+	}
+	return false
+}
+
+// createConnHandler creates the appropriate connection handler based on the
+// configuration. web may be nil when monitoring is disabled.
+func createConnHandler(config *Config, web *WebUIServer) (ConnHandler, error) {
+	// Discover the receiver before connecting, since it decides the
+	// host, port and protocol
+	var discovery *DiscoveryService
+	if config.enableMDNS {
+		discovery = startDiscovery(config)
+		if web != nil {
+			web.SetTarget(config.host, config.port, config.useTCP)
+		}
+	}
+
+	// If using TCP. Relay sessions always run over TCP.
+	if config.useTCP || config.session != "" {
 		tcpPipe, err := NewTCPPipe(config)
+		if err != nil && discovery != nil && discovery.selected != nil && discovery.selected.Cached {
+			// The cached receiver is gone: forget it and wait for mDNS
+			stale := *discovery.selected
+			fmt.Fprintf(os.Stderr, "Cached NP service %s is unreachable, removing it from the cache\n", stale.Name)
+			discovery.PruneCached(stale)
+
+			time.Sleep(2 * time.Second)
+			if discovery.useService(config) && config.useTCP {
+				if web != nil {
+					web.SetTarget(config.host, config.port, config.useTCP)
+				}
+				tcpPipe, err = NewTCPPipe(config)
+			}
+		}
 		if err != nil {
 			return nil, err
 		}
 
-		// If multiple connections, configure the multiplex
-		if config.multiConn {
+		if web != nil {
+			tcpPipe.SetWebUI(web)
+		}
+
+		// If multiple connections, configure the multiplex. Listening
+		// receivers always use it so compressed data from any sender is
+		// detected and decoded, whatever their own --compression is.
+		receiver := config.mode == "receiver" && config.session == ""
+		if config.multiConn || receiver {
 			manager := NewMultiplexManager(config)
 
-			// Configure compression, if requested
+			// Configure compression for sent data, if requested
 			if config.compression != "none" {
 				compType := getCompressType(config.compression)
-				manager.SetCompression(compType, config.compressLevel)
+				manager.SetCompression(compType, config.compressLevel, config.compressMin)
 			}
 
 			// For TCP, the multiplex manager is managed by TCPPipe
 			tcpPipe.SetMultiplexManager(manager)
-		}
-
-		// Configure mDNS discovery, if requested
-		if config.enableMDNS {
-			discovery := NewDiscoveryService(config)
-
-			if config.mode == "receiver" {
-				// Announce the service on the network
-				serviceName := fmt.Sprintf("NP Server (%s)", config.bindAddr)
-				err := discovery.StartAnnounce(serviceName, config.port, config.useTCP)
-				if err != nil {
-					fmt.Fprintf(os.Stderr, "Warning: Failed to announce mDNS service: %v\n", err)
-				} else {
-					fmt.Fprintf(os.Stderr, "Announced service via mDNS\n")
-				}
-			} else {
-				// Discover services on the network
-				err := discovery.StartBrowse()
-				if err != nil {
-					fmt.Fprintf(os.Stderr, "Warning: Failed to start mDNS discovery: %v\n", err)
-				} else {
-					fmt.Fprintf(os.Stderr, "Started mDNS discovery for NP services\n")
-
-					// If no specific host is provided, try to find one via mDNS
-					if config.host == DEFAULT_HOST {
-						fmt.Fprintf(os.Stderr, "Looking for NP services on the network...\n")
-						// Wait a few seconds to discover services
-						time.Sleep(2 * time.Second)
-
-						services := discovery.GetServices()
-						if len(services) > 0 {
-							// Use the first service found
-							service := services[0]
-							fmt.Fprintf(os.Stderr, "Found NP service: %s at %s:%d\n",
-								service.Name, service.Host, service.Port)
-
-							config.host = service.Host
-							config.port = service.Port
-							config.useTCP = service.IsTCP
-						}
-					}
-				}
+			if web != nil {
+				web.SetMultiplexManager(manager)
 			}
+		}
 
-			// Set the discovery service for the TCPPipe
+		// Keep the mDNS announcement or browser running with the pipe
+		if discovery != nil {
 			tcpPipe.SetDiscoveryService(discovery)
 		}
 
@@ -452,20 +1636,135 @@ func createConnHandler(config *Config) (ConnHandler, error) {
 	}
 
 	// Otherwise, use the original NetworkPipe (UDP)
-	return NewNetworkPipe(config)
+	if config.chat {
+		fmt.Fprintf(os.Stderr, "Warning: Chat mode requires --tcp, using plain mode\n")
+	}
+
+	udpPipe, err := NewNetworkPipe(config)
+	if err != nil {
+		return nil, err
+	}
+
+	if web != nil {
+		udpPipe.SetWebUI(web)
+	}
+	return udpPipe, nil
 }
 
 func main() {
 	config := parseFlags()
 
+	if config.printConfig {
+		if err := printResolvedConfig(config); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Start monitoring first so the web interface is up even if the pipe fails
+	web, err := startMonitoring(config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if config.mode == "ping" {
+		if err := runPing(config, web); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if config.mode == "bench" {
+		if err := runBench(config, web); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if config.mode == "list" {
+		if err := runList(config); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if config.mode == "ifaces" {
+		if err := runIfaces(config); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// Create the appropriate connection handler
-	handler, err := createConnHandler(config)
+	handler, err := createConnHandler(config, web)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		web.writeSummaryJSON(config.summaryJSON, EXIT_ERROR, err)
+
+		// Keep the web interface running so the failure can be inspected
+		if config.webUI {
+			web.RecordMessage(fmt.Sprintf("Failed to start: %v", err), "system", 0, "", "")
+			fmt.Fprintf(os.Stderr, "Web interface still available at http://%s, press Ctrl+C to exit\n",
+				hostPort(config.webUIBind, config.webUIPort))
+			select {}
+		}
 		os.Exit(1)
 	}
 	defer handler.Close()
 
+	// Report the totals and exit, once, however np stops
+	var finishOnce sync.Once
+	var shuttingDown atomic.Bool
+	finish := func(reason string, code int) {
+		finishOnce.Do(func() {
+			web.printSummary()
+			web.writeSummaryJSON(config.summaryJSON, reason, nil)
+			os.Exit(code)
+		})
+	}
+
+	// Drain and exit on SIGTERM or when requested through the web interface
+	var shutdownOnce sync.Once
+	shutdown := func(reason string) {
+		shutdownOnce.Do(func() {
+			shuttingDown.Store(true)
+			if err := handler.Shutdown(); err != nil {
+				fmt.Fprintf(os.Stderr, "Error during shutdown: %v\n", err)
+			}
+			finish(reason, 0)
+		})
+	}
+	web.SetShutdownHandler(func() { shutdown(EXIT_SHUTDOWN) })
+
+	// Ctrl+C closes the connections right away, without waiting for
+	// clients to finish beyond --drain. A second signal exits even if
+	// closing or draining is still in progress.
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		sig := <-signals
+		fmt.Fprintf(os.Stderr, "Received %v, shutting down\n", sig)
+		if sig == os.Interrupt {
+			go func() {
+				shuttingDown.Store(true)
+				handler.Close()
+				finish(EXIT_SIGNAL, 130)
+			}()
+		} else {
+			go shutdown(EXIT_SIGNAL)
+		}
+
+		sig = <-signals
+		fmt.Fprintf(os.Stderr, "Received %v, exiting now\n", sig)
+		os.Exit(1)
+	}()
+
 	// Display configuration information
 	if config.mode == "receiver" {
 		protocol := "UDP"
@@ -473,13 +1772,24 @@ func main() {
 			protocol = "TCP"
 		}
 
-		fmt.Fprintf(os.Stderr, "Listening on %s:%d (%s)\n", config.bindAddr, config.port, protocol)
+		if config.session != "" {
+			fmt.Fprintf(os.Stderr, "Joined relay session %s (TCP)\n", redactSession(config.session))
+		} else if config.systemd {
+			fmt.Fprintf(os.Stderr, "Listening on socket passed by systemd (%s)\n", protocol)
+		} else {
+			fmt.Fprintf(os.Stderr, "Listening on %s (%s)\n", hostPort(config.bindAddr, config.port), protocol)
+		}
 
 		if config.multiConn {
 			fmt.Fprintf(os.Stderr, "Multiple connections mode enabled\n")
 		}
 
-		if config.compression != "none" {
+		if config.compression == "auto" {
+			fmt.Fprintf(os.Stderr, "Decoding compressed data from senders, sending uncompressed\n")
+		} else if config.compression != "none" && protocol == "UDP" {
+			fmt.Fprintf(os.Stderr, "Compression enabled: %s (level %d), each datagram compressed independently\n",
+				config.compression, config.compressLevel)
+		} else if config.compression != "none" {
 			fmt.Fprintf(os.Stderr, "Compression enabled: %s (level %d)\n",
 				config.compression, config.compressLevel)
 		}
@@ -489,8 +1799,8 @@ func main() {
 		}
 
 		if config.webUI {
-			fmt.Fprintf(os.Stderr, "Web interface available at http://%s:%d\n",
-				config.webUIBind, config.webUIPort)
+			fmt.Fprintf(os.Stderr, "Web interface available at http://%s\n",
+				hostPort(config.webUIBind, config.webUIPort))
 		}
 	} else {
 		protocol := "UDP"
@@ -498,13 +1808,22 @@ func main() {
 			protocol = "TCP"
 		}
 
-		fmt.Fprintf(os.Stderr, "Connected to %s:%d (%s)\n", config.host, config.port, protocol)
+		if config.session != "" {
+			fmt.Fprintf(os.Stderr, "Joined relay session %s (TCP)\n", redactSession(config.session))
+		} else {
+			fmt.Fprintf(os.Stderr, "Connected to %s (%s)\n", hostPort(config.host, config.port), protocol)
+		}
 
 		if config.multiConn {
 			fmt.Fprintf(os.Stderr, "Multiple connections mode enabled\n")
 		}
 
-		if config.compression != "none" {
+		if config.compression == "auto" {
+			fmt.Fprintf(os.Stderr, "Decoding compressed data from the receiver, sending uncompressed\n")
+		} else if config.compression != "none" && protocol == "UDP" {
+			fmt.Fprintf(os.Stderr, "Compression enabled: %s (level %d), each datagram compressed independently\n",
+				config.compression, config.compressLevel)
+		} else if config.compression != "none" {
 			fmt.Fprintf(os.Stderr, "Compression enabled: %s (level %d)\n",
 				config.compression, config.compressLevel)
 		}
@@ -514,13 +1833,23 @@ func main() {
 		}
 
 		if config.webUI {
-			fmt.Fprintf(os.Stderr, "Web interface available at http://%s:%d\n",
-				config.webUIBind, config.webUIPort)
+			fmt.Fprintf(os.Stderr, "Web interface available at http://%s\n",
+				hostPort(config.webUIBind, config.webUIPort))
 		}
 	}
 
-	if err := handler.Start(); err != nil {
+	err = handler.Start()
+	if shuttingDown.Load() {
+		// Stopped by a signal or shutdown, which report the totals and exit
+		select {}
+	}
+	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		web.writeSummaryJSON(config.summaryJSON, EXIT_ERROR, err)
 		os.Exit(1)
 	}
+
+	// Flush the output before reporting the totals
+	handler.Close()
+	finish(EXIT_COMPLETED, 0)
 }
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Output buffering defaults
+const (
+	DEFAULT_OUTPUT_BUFFER  = 32 * 1024              // Size of the stdout write buffer
+	DEFAULT_FLUSH_INTERVAL = 100 * time.Millisecond // Maximum time data stays buffered
+)
+
+// OutputWriter coalesces writes to the underlying writer. Buffered data is
+// flushed when the buffer fills up, periodically, on Close and, in line mode,
+// after every newline.
+type OutputWriter struct {
+	writer    *bufio.Writer // Buffered writer around the destination
+	lineMode  bool          // Flush after each write that contains a newline
+	mutex     sync.Mutex    // Serializes writes from concurrent connections
+	done      chan struct{} // Stops the periodic flush
+	closeOnce sync.Once     // Ensures Close only runs once
+}
+
+// NewOutputWriter wraps w with a buffer of the given size that is flushed
+// at least every interval
+func NewOutputWriter(w io.Writer, size int, interval time.Duration, lineMode bool) *OutputWriter {
+	ow := &OutputWriter{
+		writer:   bufio.NewWriterSize(w, size),
+		lineMode: lineMode,
+		done:     make(chan struct{}),
+	}
+
+	if interval > 0 {
+		go ow.flushPeriodically(interval)
+	}
+
+	return ow
+}
+
+// newStdoutWriter returns the destination for received data: stdout, copied
+// to the --tee file, paced by --out-rate and buffered unless --output-buffer
+// is 0, or nothing with --sink. Line mode is implied when stdout is a
+// terminal.
+func newStdoutWriter(config *Config) (io.Writer, error) {
+	if config.sink && config.tee == "" {
+		return io.Discard, nil
+	}
+
+	var stdout io.Writer = os.Stdout
+	if config.sink {
+		stdout = io.Discard
+	}
+	if config.tee != "" {
+		tee, err := NewTeeWriter(stdout, config.tee)
+		if err != nil {
+			return nil, err
+		}
+		stdout = tee
+	}
+
+	if config.outRate != "" {
+		rate, lines, _ := parseRate(config.outRate)
+		stdout = NewRateLimitedWriter(stdout, rate, lines)
+	}
+
+	if config.outputBuffer <= 0 {
+		return stdout, nil
+	}
+
+	lineMode := config.lines || isTerminal(os.Stdout)
+	return NewOutputWriter(stdout, config.outputBuffer, config.flushInterval, lineMode), nil
+}
+
+// Write buffers p, flushing right away in line mode when p ends a line
+func (ow *OutputWriter) Write(p []byte) (int, error) {
+	ow.mutex.Lock()
+	defer ow.mutex.Unlock()
+
+	n, err := ow.writer.Write(p)
+	if err != nil {
+		return n, err
+	}
+
+	if ow.lineMode && bytes.IndexByte(p, '\n') >= 0 {
+		err = ow.writer.Flush()
+	}
+	return n, err
+}
+
+// Flush writes any buffered data to the underlying writer
+func (ow *OutputWriter) Flush() error {
+	ow.mutex.Lock()
+	defer ow.mutex.Unlock()
+
+	return ow.writer.Flush()
+}
+
+// Close stops the periodic flush and writes out the remaining data
+func (ow *OutputWriter) Close() error {
+	ow.closeOnce.Do(func() {
+		close(ow.done)
+	})
+	return ow.Flush()
+}
+
+// flushPeriodically bounds how long data can stay in the buffer
+func (ow *OutputWriter) flushPeriodically(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ow.done:
+			return
+		case <-ticker.C:
+			ow.Flush()
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestOutputWriterLineMode(t *testing.T) {
+	var out bytes.Buffer
+	ow := NewOutputWriter(&out, 1024, 0, true)
+
+	ow.Write([]byte("partial"))
+	if out.Len() != 0 {
+		t.Fatalf("flushed %q before the end of the line", out.String())
+	}
+	ow.Write([]byte(" line\n"))
+	if out.String() != "partial line\n" {
+		t.Fatalf("got %q after the newline, want %q", out.String(), "partial line\n")
+	}
+
+	ow.Write([]byte("rest"))
+	ow.Close()
+	if out.String() != "partial line\nrest" {
+		t.Fatalf("got %q after Close, want %q", out.String(), "partial line\nrest")
+	}
+}
+
+// benchmarkOutput writes small chunks, like received messages, to the null
+// device through w
+func benchmarkOutput(b *testing.B, wrap func(io.Writer) io.Writer) {
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer devNull.Close()
+
+	w := wrap(devNull)
+	chunk := bytes.Repeat([]byte("x"), 100)
+	b.SetBytes(int64(len(chunk)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w.Write(chunk)
+	}
+	if closer, ok := w.(io.Closer); ok {
+		closer.Close()
+	}
+}
+
+func BenchmarkOutputUnbuffered(b *testing.B) {
+	benchmarkOutput(b, func(w io.Writer) io.Writer { return w })
+}
+
+func BenchmarkOutputBuffered(b *testing.B) {
+	benchmarkOutput(b, func(w io.Writer) io.Writer {
+		return NewOutputWriter(w, DEFAULT_OUTPUT_BUFFER, DEFAULT_FLUSH_INTERVAL, false)
+	})
+}
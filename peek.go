@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// PEEK_PREVIEW_SIZE is the number of bytes shown in hex for each message in --peek mode
+const PEEK_PREVIEW_SIZE = 16
+
+// writePeek writes a one-line summary of a message to w instead of its
+// content: direction, size, source and a hex preview of the first bytes.
+// With color, the line is colored by direction.
+func writePeek(w io.Writer, direction string, source string, data []byte, color bool) error {
+	preview := data
+	ellipsis := ""
+	if len(preview) > PEEK_PREVIEW_SIZE {
+		preview = preview[:PEEK_PREVIEW_SIZE]
+		ellipsis = " ..."
+	}
+
+	line := fmt.Sprintf("%-3s %8d B  %-22s % x%s", direction, len(data), source, preview, ellipsis)
+	if direction == "out" {
+		line = colorize(color, COLOR_OUT, line)
+	} else {
+		line = colorize(color, COLOR_IN, line)
+	}
+	_, err := fmt.Fprintln(w, line)
+	return err
+}
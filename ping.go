@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Latency probes echoed by UDP receivers, alongside the auth handshake
+const (
+	PING_COMMAND  = "NPPING " // Followed by the probe sequence number and send time
+	PING_RESPONSE = "NPPONG " // Followed by the payload of the probe
+	PING_TIMEOUT  = AUTH_TIMEOUT
+)
+
+// Ping defaults
+const (
+	DEFAULT_PING_INTERVAL = time.Second // Time between probes
+	LATENCY_HISTORY_SIZE  = 1000        // Samples kept for the web interface
+)
+
+// LatencySample is a single round-trip time measurement
+type LatencySample struct {
+	Timestamp time.Time `json:"timestamp"` // When the probe was sent
+	Addr      string    `json:"addr"`      // Address of the receiver
+	Seq       int       `json:"seq"`       // Probe sequence number
+	RTT       float64   `json:"rtt"`       // Round-trip time in milliseconds
+}
+
+// LatencyHistory stores recent latency samples for the web interface
+type LatencyHistory struct {
+	Samples []LatencySample // Samples in the order they were taken
+	mu      sync.RWMutex    // Mutex for thread-safe access
+}
+
+// runPing sends timestamped probes to a UDP receiver until --count probes
+// were sent or it is interrupted, then prints ping-like statistics
+func runPing(config *Config, web *WebUIServer) error {
+	addr := hostPort(config.host, config.port)
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s: %v", addr, err)
+	}
+	defer conn.Close()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	fmt.Printf("PING %s\n", addr)
+
+	var rtts []time.Duration
+	sent := 0
+
+	ticker := time.NewTicker(config.pingInterval)
+	defer ticker.Stop()
+
+probes:
+	for seq := 1; config.count == 0 || seq <= config.count; seq++ {
+		if seq > 1 {
+			select {
+			case <-signals:
+				break probes
+			case <-ticker.C:
+			}
+		}
+
+		sentAt := time.Now()
+		rtt, err := sendProbe(conn, seq, sentAt)
+		sent++
+		if err != nil {
+			fmt.Printf("Request timeout for seq=%d\n", seq)
+			config.debugf("Probe %d failed: %v", seq, err)
+			continue
+		}
+
+		rtts = append(rtts, rtt)
+		fmt.Printf("Reply from %s: seq=%d time=%.3f ms\n", addr, seq, durationMillis(rtt))
+
+		if web != nil {
+			web.RecordLatency(LatencySample{Timestamp: sentAt, Addr: addr, Seq: seq, RTT: durationMillis(rtt)})
+		}
+	}
+
+	printPingStats(addr, sent, rtts)
+
+	if len(rtts) == 0 {
+		return fmt.Errorf("no replies from %s", addr)
+	}
+	return nil
+}
+
+// sendProbe sends one probe and waits for its echo, skipping late replies
+// to earlier probes
+func sendProbe(conn net.Conn, seq int, sentAt time.Time) (time.Duration, error) {
+	payload := fmt.Sprintf("%d %d", seq, sentAt.UnixNano())
+	if _, err := conn.Write([]byte(PING_COMMAND + payload)); err != nil {
+		return 0, err
+	}
+
+	expected := []byte(PING_RESPONSE + payload)
+	buffer := make([]byte, 64)
+	conn.SetReadDeadline(sentAt.Add(PING_TIMEOUT))
+
+	for {
+		n, err := conn.Read(buffer)
+		if err != nil {
+			return 0, err
+		}
+		if bytes.Equal(buffer[:n], expected) {
+			return time.Since(sentAt), nil
+		}
+	}
+}
+
+// printPingStats prints the packet loss and min/avg/max/stddev round-trip times
+func printPingStats(addr string, sent int, rtts []time.Duration) {
+	loss := 0.0
+	if sent > 0 {
+		loss = float64(sent-len(rtts)) / float64(sent) * 100
+	}
+
+	fmt.Printf("\n--- %s ping statistics ---\n", addr)
+	fmt.Printf("%d probes transmitted, %d received, %.1f%% loss\n", sent, len(rtts), loss)
+
+	if len(rtts) == 0 {
+		return
+	}
+
+	minRTT, maxRTT, sum := rtts[0], rtts[0], time.Duration(0)
+	for _, rtt := range rtts {
+		if rtt < minRTT {
+			minRTT = rtt
+		}
+		if rtt > maxRTT {
+			maxRTT = rtt
+		}
+		sum += rtt
+	}
+	avg := durationMillis(sum) / float64(len(rtts))
+
+	variance := 0.0
+	for _, rtt := range rtts {
+		diff := durationMillis(rtt) - avg
+		variance += diff * diff
+	}
+	stddev := math.Sqrt(variance / float64(len(rtts)))
+
+	fmt.Printf("rtt min/avg/max/stddev = %.3f/%.3f/%.3f/%.3f ms\n", durationMillis(minRTT), avg, durationMillis(maxRTT), stddev)
+}
+
+// durationMillis converts a duration to fractional milliseconds
+func durationMillis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// RecordLatency adds a latency sample to the history and the event stream
+func (ws *WebUIServer) RecordLatency(sample LatencySample) {
+	if !ws.details {
+		return
+	}
+
+	ws.events.Publish("latency", sample)
+
+	ws.latency.mu.Lock()
+	defer ws.latency.mu.Unlock()
+
+	ws.latency.Samples = append(ws.latency.Samples, sample)
+	if len(ws.latency.Samples) > LATENCY_HISTORY_SIZE {
+		ws.latency.Samples = ws.latency.Samples[len(ws.latency.Samples)-LATENCY_HISTORY_SIZE:]
+	}
+}
+
+// handleLatency returns the recorded latency samples, oldest first, in JSON
+// format. The optional addr query parameter filters them by receiver.
+func (ws *WebUIServer) handleLatency(w http.ResponseWriter, r *http.Request) {
+	addr := r.URL.Query().Get("addr")
+
+	ws.latency.mu.RLock()
+	samples := make([]LatencySample, 0, len(ws.latency.Samples))
+	for _, sample := range ws.latency.Samples {
+		if addr == "" || strings.EqualFold(sample.Addr, addr) {
+			samples = append(samples, sample)
+		}
+	}
+	ws.latency.mu.RUnlock()
+
+	writeJSON(w, r, samples)
+}
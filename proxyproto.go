@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PROXY protocol headers sent by load balancers such as HAProxy in front of
+// a --proxy-protocol receiver, carrying the address of the real client
+const (
+	PROXY_V1_PREFIX      = "PROXY "                    // Start of a text (v1) header
+	PROXY_V1_MAX_LENGTH  = 107                         // Longest v1 header, including the CRLF
+	PROXY_V2_SIGNATURE   = "\r\n\r\n\x00\r\nQUIT\n"    // Start of a binary (v2) header
+	PROXY_V2_HEADER_SIZE = len(PROXY_V2_SIGNATURE) + 4 // Signature, version and command, family and length
+	PROXY_HEADER_TIMEOUT = 5 * time.Second             // Time a new connection has to send its header
+)
+
+// proxiedConn is a connection accepted through a load balancer. It reports
+// the client address from the PROXY header as its remote address.
+type proxiedConn struct {
+	net.Conn
+	reader *bufio.Reader // Data buffered while reading the header
+	remote net.Addr      // Address of the real client
+}
+
+// Read reads the data that followed the header
+func (pc *proxiedConn) Read(p []byte) (int, error) {
+	return pc.reader.Read(p)
+}
+
+// RemoteAddr returns the address of the real client
+func (pc *proxiedConn) RemoteAddr() net.Addr {
+	return pc.remote
+}
+
+// readProxyHeader reads the PROXY protocol v1 or v2 header at the start of
+// conn and returns the connection with the client address it carries.
+// Headers for health checks (LOCAL, UNKNOWN) keep the balancer address.
+func readProxyHeader(conn net.Conn) (net.Conn, error) {
+	conn.SetReadDeadline(time.Now().Add(PROXY_HEADER_TIMEOUT))
+	defer conn.SetReadDeadline(time.Time{})
+
+	reader := bufio.NewReader(conn)
+	signature, err := reader.Peek(len(PROXY_V2_SIGNATURE))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read PROXY header: %v", err)
+	}
+
+	var remote net.Addr
+	switch {
+	case bytes.Equal(signature, []byte(PROXY_V2_SIGNATURE)):
+		remote, err = readProxyV2(reader)
+	case bytes.HasPrefix(signature, []byte(PROXY_V1_PREFIX)):
+		remote, err = readProxyV1(reader)
+	default:
+		err = fmt.Errorf("connection doesn't start with a PROXY header")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if remote == nil {
+		remote = conn.RemoteAddr()
+	}
+	return &proxiedConn{Conn: conn, reader: reader, remote: remote}, nil
+}
+
+// readProxyV1 parses a text header such as
+// "PROXY TCP4 192.0.2.1 192.0.2.2 56324 4242\r\n"
+func readProxyV1(reader *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < PROXY_V1_MAX_LENGTH {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read PROXY header: %v", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+
+	header, found := strings.CutSuffix(string(line), "\r\n")
+	if !found {
+		return nil, fmt.Errorf("malformed PROXY v1 header")
+	}
+
+	fields := strings.Split(header, " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed PROXY v1 header %q", header)
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil || (fields[1] == "TCP4") != (ip.To4() != nil) {
+		return nil, fmt.Errorf("malformed PROXY v1 header %q", header)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 parses a binary header, skipping any TLVs after the addresses
+func readProxyV2(reader *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, PROXY_V2_HEADER_SIZE)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, fmt.Errorf("failed to read PROXY header: %v", err)
+	}
+
+	versionCommand := header[len(PROXY_V2_SIGNATURE)]
+	family := header[len(PROXY_V2_SIGNATURE)+1]
+	length := binary.BigEndian.Uint16(header[len(PROXY_V2_SIGNATURE)+2:])
+	if versionCommand>>4 != 2 || versionCommand&0x0f > 1 {
+		return nil, fmt.Errorf("malformed PROXY v2 header")
+	}
+
+	addresses := make([]byte, length)
+	if _, err := io.ReadFull(reader, addresses); err != nil {
+		return nil, fmt.Errorf("failed to read PROXY header: %v", err)
+	}
+
+	// LOCAL connections come from the balancer itself, e.g. health checks
+	if versionCommand&0x0f == 0 {
+		return nil, nil
+	}
+
+	switch family {
+	case 0x11: // TCP over IPv4
+		if length < 12 {
+			return nil, fmt.Errorf("malformed PROXY v2 header")
+		}
+		return &net.TCPAddr{IP: net.IP(addresses[0:4]), Port: int(binary.BigEndian.Uint16(addresses[8:]))}, nil
+	case 0x21: // TCP over IPv6
+		if length < 36 {
+			return nil, fmt.Errorf("malformed PROXY v2 header")
+		}
+		return &net.TCPAddr{IP: net.IP(addresses[0:16]), Port: int(binary.BigEndian.Uint16(addresses[32:]))}, nil
+	default:
+		// Other families don't carry a TCP client address
+		return nil, nil
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Throughput history for the dashboard sparklines
+const (
+	RATE_HISTORY_SIZE    = 60          // Samples kept, one minute at the default interval
+	RATE_SAMPLE_INTERVAL = time.Second // Time between samples
+)
+
+// RateSample is the send and receive throughput over one sample interval
+type RateSample struct {
+	Timestamp time.Time `json:"timestamp"` // End of the interval
+	Sent      float64   `json:"sent"`      // Bytes sent per second
+	Received  float64   `json:"received"`  // Bytes received per second
+}
+
+// RateHistory stores the most recent throughput samples
+type RateHistory struct {
+	Samples []RateSample // Samples in the order they were taken
+	mu      sync.RWMutex // Mutex for thread-safe access
+}
+
+// sampleRates records the throughput of each interval from the cumulative
+// byte counters, keeping the last RATE_HISTORY_SIZE samples
+func (ws *WebUIServer) sampleRates(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	lastSent, lastReceived := ws.stats.BytesSent.Load(), ws.stats.BytesReceived.Load()
+	lastTime := time.Now()
+
+	for now := range ticker.C {
+		sent, received := ws.stats.BytesSent.Load(), ws.stats.BytesReceived.Load()
+		elapsed := now.Sub(lastTime).Seconds()
+
+		sample := RateSample{
+			Timestamp: now,
+			Sent:      float64(sent-lastSent) / elapsed,
+			Received:  float64(received-lastReceived) / elapsed,
+		}
+		lastSent, lastReceived, lastTime = sent, received, now
+
+		ws.stats.Rates.mu.Lock()
+		ws.stats.Rates.Samples = append(ws.stats.Rates.Samples, sample)
+		if len(ws.stats.Rates.Samples) > RATE_HISTORY_SIZE {
+			ws.stats.Rates.Samples = ws.stats.Rates.Samples[len(ws.stats.Rates.Samples)-RATE_HISTORY_SIZE:]
+		}
+		ws.stats.Rates.mu.Unlock()
+	}
+}
+
+// handleRateHistory returns the throughput samples, oldest first, in JSON
+// format
+func (ws *WebUIServer) handleRateHistory(w http.ResponseWriter, r *http.Request) {
+	ws.stats.Rates.mu.RLock()
+	samples := make([]RateSample, len(ws.stats.Rates.Samples))
+	copy(samples, ws.stats.Rates.Samples)
+	ws.stats.Rates.mu.RUnlock()
+
+	writeJSON(w, r, samples)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RATE_CHUNKS_PER_SECOND splits byte-rate writes into chunks of this
+// fraction of the rate, so output flows evenly instead of in bursts
+const RATE_CHUNKS_PER_SECOND = 10
+
+// RateLimitedWriter paces the writes to the underlying writer to a number
+// of lines or bytes per second. Writes block until they are allowed, so a
+// slow --out-rate also slows down reading from the network.
+type RateLimitedWriter struct {
+	writer io.Writer  // Destination of the paced data
+	rate   float64    // Lines or bytes allowed per second
+	lines  bool       // Whether rate counts lines instead of bytes
+	next   time.Time  // Earliest time the next line or byte may be written
+	mutex  sync.Mutex // Serializes writes from concurrent connections
+}
+
+// NewRateLimitedWriter paces writes to w to rate lines per second, or
+// bytes per second when lines is false
+func NewRateLimitedWriter(w io.Writer, rate float64, lines bool) *RateLimitedWriter {
+	return &RateLimitedWriter{
+		writer: w,
+		rate:   rate,
+		lines:  lines,
+	}
+}
+
+// Write writes p line by line, or in chunks of a tenth of the byte rate,
+// waiting before each one as needed to stay under the rate
+func (rw *RateLimitedWriter) Write(p []byte) (int, error) {
+	rw.mutex.Lock()
+	defer rw.mutex.Unlock()
+
+	written := 0
+	for len(p) > 0 {
+		n, units := rw.nextChunk(p)
+		rw.wait(units)
+
+		m, err := rw.writer.Write(p[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// nextChunk returns the length of the next piece of p to write and how
+// many lines or bytes it counts for. A trailing partial line counts as
+// nothing until its newline is written.
+func (rw *RateLimitedWriter) nextChunk(p []byte) (int, int) {
+	if rw.lines {
+		if i := bytes.IndexByte(p, '\n'); i >= 0 {
+			return i + 1, 1
+		}
+		return len(p), 0
+	}
+
+	chunk := int(rw.rate / RATE_CHUNKS_PER_SECOND)
+	if chunk < 1 {
+		chunk = 1
+	}
+	if chunk > len(p) {
+		chunk = len(p)
+	}
+	return chunk, chunk
+}
+
+// wait sleeps until units lines or bytes may be written. Unused time isn't
+// saved up, so output never bursts above the rate after a quiet period.
+func (rw *RateLimitedWriter) wait(units int) {
+	if units == 0 {
+		return
+	}
+
+	now := time.Now()
+	if rw.next.Before(now) {
+		rw.next = now
+	}
+	time.Sleep(rw.next.Sub(now))
+	rw.next = rw.next.Add(time.Duration(float64(units) / rw.rate * float64(time.Second)))
+}
+
+// parseRate parses an --out-rate value: a number of lines per second such
+// as 100/s, or of bytes with a size unit such as 64KB/s
+func parseRate(value string) (float64, bool, error) {
+	amount, found := strings.CutSuffix(strings.TrimSpace(value), "/s")
+	if !found {
+		return 0, false, fmt.Errorf("invalid rate %q, expected e.g. 100/s or 64KB/s", value)
+	}
+
+	if lines, err := strconv.ParseFloat(amount, 64); err == nil {
+		if !(lines > 0) || math.IsInf(lines, 0) {
+			return 0, false, fmt.Errorf("invalid rate %q", value)
+		}
+		return lines, true, nil
+	}
+
+	size, err := parseSize(amount)
+	if err != nil {
+		return 0, false, fmt.Errorf("invalid rate %q, expected e.g. 100/s or 64KB/s", value)
+	}
+	return float64(size), false, nil
+}
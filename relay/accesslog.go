@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// Reasons a session was closed, as written to the access log
+const (
+	CLOSE_PEER_CLOSED  = "peer closed"
+	CLOSE_READ_ERROR   = "read error"
+	CLOSE_WRITE_ERROR  = "write error"
+	CLOSE_STALLED      = "stalled peer"
+	CLOSE_IDLE         = "idle timeout"
+	CLOSE_PAIR_TIMEOUT = "pair timeout"
+	CLOSE_LIFETIME     = "lifetime exceeded"
+)
+
+// AccessRecord is the access log entry written when a session closes
+type AccessRecord struct {
+	Time     time.Time `json:"time"`
+	Session  string    `json:"session"`
+	Peers    []string  `json:"peers"`
+	Bytes    uint64    `json:"bytes"`    // Bytes relayed in both directions
+	Duration float64   `json:"duration"` // Seconds since the session was created
+	Reason   string    `json:"reason"`
+}
+
+// AccessLogger writes one line per closed session, as text or JSON, to
+// stderr or to a file opened for appending
+type AccessLogger struct {
+	logger *log.Logger
+	json   bool
+}
+
+// NewAccessLogger creates an access logger writing to path, or to stderr
+// if path is empty
+func NewAccessLogger(path string, jsonFormat bool) (*AccessLogger, error) {
+	var out io.Writer = os.Stderr
+	if path != "" {
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open access log: %v", err)
+		}
+		out = file
+	}
+
+	// JSON records carry their own timestamp
+	flags := log.LstdFlags
+	if jsonFormat {
+		flags = 0
+	}
+	return &AccessLogger{logger: log.New(out, "", flags), json: jsonFormat}, nil
+}
+
+// Log writes the record for a closed session
+func (al *AccessLogger) Log(record AccessRecord) {
+	if al.json {
+		line, err := json.Marshal(record)
+		if err != nil {
+			log.Printf("Failed to encode access log record: %v", err)
+			return
+		}
+		al.logger.Println(string(line))
+		return
+	}
+
+	peers := "-"
+	if len(record.Peers) > 0 {
+		peers = strings.Join(record.Peers, ",")
+	}
+	al.logger.Printf("session=%q peers=%s bytes=%d duration=%.3fs reason=%q",
+		record.Session, peers, record.Bytes, record.Duration, record.Reason)
+}
+
+// logSession writes the access log record for a session closing now
+func (rs *RelayServer) logSession(session *RelaySession, reason string) {
+	record := AccessRecord{
+		Time:     time.Now(),
+		Session:  session.ID,
+		Peers:    []string{},
+		Bytes:    session.bytesRelayed.Load(),
+		Duration: time.Since(session.CreatedAt).Seconds(),
+		Reason:   reason,
+	}
+	for _, client := range session.Clients {
+		if client != nil {
+			record.Peers = append(record.Peers, client.Conn.RemoteAddr().String())
+		}
+	}
+	rs.accessLog.Log(record)
+}
@@ -0,0 +1,459 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Framings of datagrams on the TCP side of a bridge, set with -bridge-framing
+const (
+	BRIDGE_FRAMING_LENGTH = "length" // Each datagram is sent as a 2-byte big-endian length and its bytes
+	BRIDGE_FRAMING_RAW    = "raw"    // Each TCP read becomes a datagram, and datagrams are written as is
+)
+
+// Bridge limits
+const (
+	BRIDGE_MAX_DATAGRAM = 65507            // Largest UDP payload over IPv4
+	BRIDGE_DIAL_TIMEOUT = 10 * time.Second // Time to connect to a TCP backend
+	BRIDGE_SESSION      = "bridge"         // Session name of bridged connections in the access log
+	BRIDGE_QUEUE        = 64               // Datagrams from a UDP source waiting for its TCP backend
+)
+
+// BridgeSpec is one -bridge rule: connections or datagrams received on
+// ListenAddr with ListenProto are forwarded to TargetAddr with TargetProto
+type BridgeSpec struct {
+	ListenProto string // "tcp" or "udp"
+	ListenAddr  string // Address to listen on, host:port with an optional host
+	TargetProto string // The other protocol
+	TargetAddr  string // Backend address, host:port
+}
+
+// String returns the rule as given to -bridge
+func (spec BridgeSpec) String() string {
+	return spec.ListenProto + ":" + spec.ListenAddr + "->" + spec.TargetProto + ":" + spec.TargetAddr
+}
+
+// parseBridgeSpecs parses a comma-separated list of -bridge rules such as
+// tcp:4242->udp:host:4242 or udp:4242->tcp:host:4242
+func parseBridgeSpecs(value string) ([]BridgeSpec, error) {
+	var specs []BridgeSpec
+	for _, rule := range strings.Split(value, ",") {
+		listen, target, found := strings.Cut(strings.TrimSpace(rule), "->")
+		if !found {
+			return nil, fmt.Errorf("invalid bridge %q, expected tcp:PORT->udp:HOST:PORT or udp:PORT->tcp:HOST:PORT", rule)
+		}
+
+		var spec BridgeSpec
+		var rest string
+		spec.ListenProto, rest, _ = strings.Cut(listen, ":")
+		if _, err := strconv.Atoi(rest); err == nil {
+			rest = ":" + rest
+		}
+		if _, _, err := net.SplitHostPort(rest); err != nil {
+			return nil, fmt.Errorf("invalid bridge %q: bad listen address %q", rule, rest)
+		}
+		spec.ListenAddr = rest
+
+		spec.TargetProto, rest, _ = strings.Cut(target, ":")
+		if host, _, err := net.SplitHostPort(rest); err != nil || host == "" {
+			return nil, fmt.Errorf("invalid bridge %q: bad target address %q", rule, rest)
+		}
+		spec.TargetAddr = rest
+
+		if !(spec.ListenProto == "tcp" && spec.TargetProto == "udp") && !(spec.ListenProto == "udp" && spec.TargetProto == "tcp") {
+			return nil, fmt.Errorf("invalid bridge %q: it must go from tcp to udp or from udp to tcp", rule)
+		}
+		specs = append(specs, spec)
+	}
+	return specs, nil
+}
+
+// validFraming reports whether framing is a known -bridge-framing value
+func validFraming(framing string) bool {
+	return framing == BRIDGE_FRAMING_LENGTH || framing == BRIDGE_FRAMING_RAW
+}
+
+// frameReader reads the datagrams sent on the TCP side of a bridge
+type frameReader struct {
+	reader  *bufio.Reader
+	framing string
+	buffer  []byte
+}
+
+// newFrameReader creates a reader of the datagrams framed on conn
+func newFrameReader(conn net.Conn, framing string) *frameReader {
+	return &frameReader{
+		reader:  bufio.NewReaderSize(conn, BRIDGE_MAX_DATAGRAM+2),
+		framing: framing,
+		buffer:  make([]byte, BRIDGE_MAX_DATAGRAM),
+	}
+}
+
+// Next returns the next datagram, valid until the following call. With
+// length framing, a frame longer than a datagram can carry is an error.
+func (fr *frameReader) Next() ([]byte, error) {
+	if fr.framing == BRIDGE_FRAMING_RAW {
+		n, err := fr.reader.Read(fr.buffer)
+		return fr.buffer[:n], err
+	}
+
+	var header [2]byte
+	if _, err := io.ReadFull(fr.reader, header[:]); err != nil {
+		return nil, err
+	}
+	length := int(binary.BigEndian.Uint16(header[:]))
+	if length > BRIDGE_MAX_DATAGRAM {
+		return nil, fmt.Errorf("frame of %d bytes is larger than a UDP datagram", length)
+	}
+	if _, err := io.ReadFull(fr.reader, fr.buffer[:length]); err != nil {
+		return nil, err
+	}
+	return fr.buffer[:length], nil
+}
+
+// writeFrame writes a datagram to the TCP side of a bridge
+func writeFrame(conn net.Conn, framing string, datagram []byte) (int, error) {
+	if framing == BRIDGE_FRAMING_RAW {
+		return conn.Write(datagram)
+	}
+
+	frame := make([]byte, 2, 2+len(datagram))
+	binary.BigEndian.PutUint16(frame, uint16(len(datagram)))
+	return conn.Write(append(frame, datagram...))
+}
+
+// bridgeLink is one TCP connection of a bridge and the UDP peer it is
+// paired with
+type bridgeLink struct {
+	tcp       net.Conn
+	mu        sync.Mutex    // Guards tcp and closed while the link to a TCP backend connects
+	closed    bool          // Whether closeBridgeLink ran
+	done      chan struct{} // Closed with the link
+	queue     chan []byte   // Datagrams from a UDP source waiting to be written to its TCP backend
+	client    string        // Address of the client, on whichever side it is
+	backend   string        // Address of the backend
+	createdAt time.Time
+	lastUsed  atomic.Int64  // Unix nanoseconds of the last datagram in either direction
+	bytes     atomic.Uint64 // Bytes forwarded in both directions
+	closeOnce sync.Once
+}
+
+// newBridgeLink creates the link between a client and a backend, one of
+// them reached through tcp, or nil until connected with attach
+func newBridgeLink(tcp net.Conn, client, backend string) *bridgeLink {
+	link := &bridgeLink{tcp: tcp, client: client, backend: backend, createdAt: time.Now(), done: make(chan struct{})}
+	link.touch(0)
+	return link
+}
+
+// attach sets the connection to the TCP backend once connected. It
+// returns false if the link was closed in the meantime.
+func (link *bridgeLink) attach(tcp net.Conn) bool {
+	link.mu.Lock()
+	defer link.mu.Unlock()
+
+	if link.closed {
+		return false
+	}
+	link.tcp = tcp
+	return true
+}
+
+// touch records n bytes forwarded now
+func (link *bridgeLink) touch(n int) {
+	link.lastUsed.Store(time.Now().UnixNano())
+	link.bytes.Add(uint64(n))
+}
+
+// idle reports whether nothing was forwarded for longer than timeout
+func (link *bridgeLink) idle(timeout time.Duration) bool {
+	return time.Since(time.Unix(0, link.lastUsed.Load())) >= timeout
+}
+
+// closeReason maps the error that ended a direction to an access log reason
+func closeReason(err error, write bool) string {
+	switch {
+	case err == nil, err == io.EOF, errors.Is(err, net.ErrClosed):
+		return CLOSE_PEER_CLOSED
+	case isTimeout(err) && write:
+		return CLOSE_STALLED
+	case isTimeout(err):
+		return CLOSE_IDLE
+	case write:
+		return CLOSE_WRITE_ERROR
+	default:
+		return CLOSE_READ_ERROR
+	}
+}
+
+// closeBridgeLink closes the TCP connection of a link once and writes its
+// access log record
+func (rs *RelayServer) closeBridgeLink(link *bridgeLink, reason string) {
+	link.closeOnce.Do(func() {
+		link.mu.Lock()
+		link.closed = true
+		if link.tcp != nil {
+			link.tcp.Close()
+		}
+		link.mu.Unlock()
+		close(link.done)
+
+		rs.accessLog.Log(AccessRecord{
+			Time:     time.Now(),
+			Session:  BRIDGE_SESSION,
+			Peers:    []string{link.client, link.backend},
+			Bytes:    link.bytes.Load(),
+			Duration: time.Since(link.createdAt).Seconds(),
+			Reason:   reason,
+		})
+	})
+}
+
+// startBridge opens the listener of a -bridge rule and forwards what it
+// receives in the background
+func (rs *RelayServer) startBridge(spec BridgeSpec) error {
+	if spec.ListenProto == "tcp" {
+		target, err := net.ResolveUDPAddr("udp", spec.TargetAddr)
+		if err != nil {
+			return fmt.Errorf("bridge %s: %v", spec, err)
+		}
+		listener, err := net.Listen("tcp", spec.ListenAddr)
+		if err != nil {
+			return fmt.Errorf("bridge %s: %v", spec, err)
+		}
+		log.Printf("Bridging TCP on %s to UDP %s (%s framing)", listener.Addr(), target, rs.config.BridgeFraming)
+		go rs.acceptBridge(listener, target)
+		return nil
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", spec.ListenAddr)
+	if err != nil {
+		return fmt.Errorf("bridge %s: %v", spec, err)
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return fmt.Errorf("bridge %s: %v", spec, err)
+	}
+	log.Printf("Bridging UDP on %s to TCP %s (%s framing)", conn.LocalAddr(), spec.TargetAddr, rs.config.BridgeFraming)
+	go rs.serveUDPBridge(conn, spec.TargetAddr)
+	return nil
+}
+
+// acceptBridge pairs each TCP client with its own UDP socket connected to
+// the backend, so replies from the backend reach the right client
+func (rs *RelayServer) acceptBridge(listener net.Listener, target *net.UDPAddr) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Printf("Error accepting bridge connection: %v", err)
+			continue
+		}
+
+		go rs.bridgeTCPClient(conn, target)
+	}
+}
+
+// bridgeTCPClient sends each datagram framed by a TCP client to the UDP
+// backend and frames the backend's datagrams back to the client
+func (rs *RelayServer) bridgeTCPClient(conn net.Conn, target *net.UDPAddr) {
+	udp, err := net.DialUDP("udp", nil, target)
+	if err != nil {
+		log.Printf("Bridge: can't reach %s for %s: %v", target, conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	defer udp.Close()
+
+	link := newBridgeLink(conn, conn.RemoteAddr().String(), target.String())
+	if rs.config.DebugMode {
+		log.Printf("Bridge: %s connected, forwarding to %s", conn.RemoteAddr(), target)
+	}
+
+	// Backend to client. Closing the UDP socket below ends this direction.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buffer := make([]byte, BRIDGE_MAX_DATAGRAM)
+		for {
+			n, err := udp.Read(buffer)
+
+			// The backend not listening yet is reported by the next read
+			if errors.Is(err, syscall.ECONNREFUSED) {
+				continue
+			}
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					rs.closeBridgeLink(link, closeReason(err, false))
+				}
+				return
+			}
+			if _, err := writeFrame(conn, rs.config.BridgeFraming, buffer[:n]); err != nil {
+				rs.closeBridgeLink(link, closeReason(err, true))
+				return
+			}
+			link.touch(n)
+		}
+	}()
+
+	// Client to backend, until the client leaves or both directions are idle
+	frames := newFrameReader(conn, rs.config.BridgeFraming)
+	for {
+		if rs.config.IdleTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(rs.config.IdleTimeout))
+		}
+		datagram, err := frames.Next()
+		if len(datagram) > 0 || (err == nil && rs.config.BridgeFraming == BRIDGE_FRAMING_LENGTH) {
+			if _, err := udp.Write(datagram); err != nil {
+				log.Printf("Bridge: error sending to %s: %v", target, err)
+			}
+			link.touch(len(datagram))
+		}
+		if err != nil {
+			if isTimeout(err) && !link.idle(rs.config.IdleTimeout) {
+				continue
+			}
+			if !errors.Is(err, net.ErrClosed) && err != io.EOF && !isTimeout(err) {
+				log.Printf("Bridge: error reading from %s: %v", conn.RemoteAddr(), err)
+			}
+			rs.closeBridgeLink(link, closeReason(err, false))
+			break
+		}
+	}
+
+	udp.Close()
+	<-done
+}
+
+// serveUDPBridge opens a TCP connection to the backend for each UDP source,
+// forwarding its datagrams framed and sending the backend's frames back to
+// it as datagrams. Sources idle for -idle-timeout are disconnected. Each
+// source's datagrams are queued for its own goroutine, so a slow backend
+// never holds up the others.
+func (rs *RelayServer) serveUDPBridge(conn *net.UDPConn, target string) {
+	var mu sync.Mutex
+	links := make(map[string]*bridgeLink)
+
+	if rs.config.IdleTimeout > 0 {
+		go func() {
+			for range time.Tick(rs.config.IdleTimeout / 2) {
+				mu.Lock()
+				for source, link := range links {
+					if link.idle(rs.config.IdleTimeout) {
+						delete(links, source)
+						rs.closeBridgeLink(link, CLOSE_IDLE)
+					}
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	buffer := make([]byte, BRIDGE_MAX_DATAGRAM)
+	for {
+		n, source, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			log.Printf("Error reading bridge datagram: %v", err)
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+
+		mu.Lock()
+		link, exists := links[source.String()]
+		if !exists {
+			link = newBridgeLink(nil, source.String(), target)
+			link.queue = make(chan []byte, BRIDGE_QUEUE)
+			links[source.String()] = link
+
+			go func(link *bridgeLink, source *net.UDPAddr) {
+				rs.bridgeUDPSource(conn, link, source, target)
+				mu.Lock()
+				if links[source.String()] == link {
+					delete(links, source.String())
+				}
+				mu.Unlock()
+			}(link, source)
+		}
+		mu.Unlock()
+
+		// Like the network, drop datagrams the backend can't keep up with
+		select {
+		case link.queue <- append([]byte(nil), buffer[:n]...):
+		default:
+			if rs.config.DebugMode {
+				log.Printf("Bridge: %s is sending faster than %s accepts, dropping datagram", source, target)
+			}
+		}
+	}
+}
+
+// bridgeUDPSource connects to the TCP backend for a UDP source and writes
+// the source's queued datagrams to it until the link closes
+func (rs *RelayServer) bridgeUDPSource(conn *net.UDPConn, link *bridgeLink, source *net.UDPAddr, target string) {
+	tcp, err := net.DialTimeout("tcp", target, BRIDGE_DIAL_TIMEOUT)
+	if err != nil {
+		log.Printf("Bridge: can't reach %s for %s, dropping datagrams: %v", target, source, err)
+		rs.closeBridgeLink(link, CLOSE_WRITE_ERROR)
+		return
+	}
+	if !link.attach(tcp) {
+		tcp.Close()
+		return
+	}
+	if rs.config.DebugMode {
+		log.Printf("Bridge: %s sent a datagram, forwarding to %s", source, target)
+	}
+
+	go rs.bridgeTCPBackend(conn, link, source)
+
+	for {
+		select {
+		case datagram := <-link.queue:
+			// Bound how long a backend that stopped reading can hold up the link
+			if rs.config.IdleTimeout > 0 {
+				tcp.SetWriteDeadline(time.Now().Add(rs.config.IdleTimeout))
+			}
+			if _, err := writeFrame(tcp, rs.config.BridgeFraming, datagram); err != nil {
+				rs.closeBridgeLink(link, closeReason(err, true))
+				return
+			}
+			link.touch(len(datagram))
+		case <-link.done:
+			return
+		}
+	}
+}
+
+// bridgeTCPBackend sends the datagrams framed by a TCP backend to the UDP
+// source its connection was opened for
+func (rs *RelayServer) bridgeTCPBackend(conn *net.UDPConn, link *bridgeLink, source *net.UDPAddr) {
+	frames := newFrameReader(link.tcp, rs.config.BridgeFraming)
+	for {
+		datagram, err := frames.Next()
+		if len(datagram) > 0 || (err == nil && rs.config.BridgeFraming == BRIDGE_FRAMING_LENGTH) {
+			if _, err := conn.WriteToUDP(datagram, source); err != nil {
+				log.Printf("Bridge: error sending to %s: %v", source, err)
+			}
+			link.touch(len(datagram))
+		}
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) && err != io.EOF {
+				log.Printf("Bridge: error reading from %s: %v", link.tcp.RemoteAddr(), err)
+			}
+			rs.closeBridgeLink(link, closeReason(err, false))
+			return
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// startUDPBridge bridges a local UDP port to the TCP backend at target
+func startUDPBridge(t *testing.T, rs *RelayServer, target string) *net.UDPAddr {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go rs.serveUDPBridge(conn, target)
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+// acceptBackend returns the next connection made to the backend listener
+func acceptBackend(t *testing.T, listener net.Listener) net.Conn {
+	t.Helper()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+
+	select {
+	case conn := <-accepted:
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	case <-time.After(2 * time.Second):
+		t.Fatal("bridge didn't connect to the backend")
+		return nil
+	}
+}
+
+func TestBridgeUDPToTCP(t *testing.T) {
+	rs, _ := newTestRelay(&RelayConfig{IdleTimeout: time.Minute, BridgeFraming: BRIDGE_FRAMING_LENGTH})
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	bridge := startUDPBridge(t, rs, backend.Addr().String())
+
+	source, err := net.DialUDP("udp", nil, bridge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+	source.Write([]byte("ping"))
+
+	// The datagram arrives framed
+	tcp := acceptBackend(t, backend)
+	expect(t, tcp, tcp, "\x00\x04ping")
+
+	// And the backend's frame returns as a datagram
+	tcp.Write([]byte("\x00\x04pong"))
+	source.SetReadDeadline(time.Now().Add(2 * time.Second))
+	reply := make([]byte, 16)
+	n, err := source.Read(reply)
+	if err != nil || string(reply[:n]) != "pong" {
+		t.Fatalf("got %q, %v, want pong", reply[:n], err)
+	}
+}
+
+func TestBridgeStalledBackend(t *testing.T) {
+	rs, _ := newTestRelay(&RelayConfig{IdleTimeout: time.Minute, BridgeFraming: BRIDGE_FRAMING_LENGTH})
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	bridge := startUDPBridge(t, rs, backend.Addr().String())
+
+	// The connection for the first source is never read, so writes to it
+	// block once the socket buffers fill up
+	flooder, err := net.DialUDP("udp", nil, bridge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer flooder.Close()
+	flooder.Write([]byte("first"))
+	acceptBackend(t, backend)
+
+	datagram := bytes.Repeat([]byte("x"), 60000)
+	for start := time.Now(); time.Since(start) < 500*time.Millisecond; {
+		flooder.Write(datagram)
+	}
+
+	// Other sources are still bridged
+	source, err := net.DialUDP("udp", nil, bridge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+	source.Write([]byte("ping"))
+
+	tcp := acceptBackend(t, backend)
+	tcp.SetReadDeadline(time.Now().Add(2 * time.Second))
+	frame := make([]byte, 6)
+	if _, err := io.ReadFull(tcp, frame); err != nil || string(frame) != "\x00\x04ping" {
+		t.Fatalf("got %q, %v, want the framed ping", frame, err)
+	}
+}
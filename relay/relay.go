@@ -1,30 +1,82 @@
 package main
 
 import (
+	"crypto/rand"
+	"crypto/subtle"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// SESSION_ID_BYTES is the number of random bytes in a generated session ID
+const SESSION_ID_BYTES = 8
+
+// Relay buffering: each direction holds at most RELAY_BUFFER_CHUNKS reads of
+// RELAY_CHUNK_SIZE bytes before it stops reading from the sender
+const (
+	RELAY_CHUNK_SIZE    = 4096
+	RELAY_BUFFER_CHUNKS = 16
+)
+
+// Client roles, sent as an optional byte after ROLE_SEPARATOR in the
+// handshake. A session pairs at most one host with one guest; clients
+// without a role pair with anyone.
+const (
+	ROLE_SEPARATOR = 0x00
+	ROLE_NONE      = 0
+	ROLE_HOST      = 'H'
+	ROLE_GUEST     = 'G'
+)
+
+// DEFAULT_HANDSHAKE_TIMEOUT is the time a TCP client has to send its session ID
+const DEFAULT_HANDSHAKE_TIMEOUT = 10 * time.Second
+
+// NOTICE_TIMEOUT bounds how long a notice such as LIFETIME_EXCEEDED may
+// take to write to a client that stopped reading
+const NOTICE_TIMEOUT = time.Second
+
 // RelayConfig stores the configuration for the relay server
 type RelayConfig struct {
-	TCPPort        int
-	HTTPPort       int
-	HTTPSPort      int
-	TLSCertFile    string
-	TLSKeyFile     string
-	EnableHTTP     bool
-	EnableHTTPS    bool
-	EnableTCP      bool
-	DebugMode      bool
-	MaxConnections int
-	IdleTimeout    time.Duration
+	TCPPort          int
+	HTTPPort         int
+	HTTPSPort        int
+	TLSCertFile      string
+	TLSKeyFile       string
+	ClientCAFile     string
+	EnableHTTP       bool
+	EnableHTTPS      bool
+	EnableTCP        bool
+	DebugMode        bool
+	MaxConnections   int
+	IdleTimeout      time.Duration
+	PairTimeout      time.Duration
+	HandshakeTimeout time.Duration
+	MaxLifetime      time.Duration
+	StatusToken      string
+	FallbackProxy    string
+	MaxSessionsPerIP int
+	LogFile          string
+	LogJSON          bool
+	BufferPool       bool
+	Bridge           string
+	BridgeFraming    string
 }
 
 // RelayServer represents the relay server instance
@@ -32,7 +84,11 @@ type RelayServer struct {
 	config      *RelayConfig
 	sessions    map[string]*RelaySession
 	sessionsMu  sync.RWMutex
+	ipSessions  map[string]int // Sessions each client IP is in, guarded by sessionsMu
 	tcpListener net.Listener
+	fallback    *httputil.ReverseProxy // Serves unknown HTTP paths, nil for 404
+	accessLog   *AccessLogger          // Records each session as it closes
+	chunks      sync.Pool              // Relay buffers reused with -buffer-pool
 }
 
 // RelaySession represents a relay session between two clients
@@ -40,21 +96,87 @@ type RelaySession struct {
 	ID        string
 	CreatedAt time.Time
 	LastUsed  time.Time
-	Clients   [2]net.Conn
+	Clients   [2]*RelayClient
 	Active    bool
+	Reserver  string // IP that reserved the session via /new, until a client takes it over
 	mu        sync.RWMutex
+	paired    chan struct{} // Closed when the second client joins
+	closed    chan struct{} // Closed when the session is torn down
+	relayed   chan struct{} // Closed when relaying has stopped using both clients
+	closeOnce sync.Once
+	expiring  atomic.Bool // Set once the session exceeded its lifetime and is being closed
+
+	bytesRelayed atomic.Uint64 // Bytes written to either client
+}
+
+// RelayClient is a client connected to a session
+type RelayClient struct {
+	Conn        net.Conn
+	Role        byte       // Role declared by the client, ROLE_NONE if none
+	ConnectedAt time.Time  // When the client joined the session
+	writeMu     sync.Mutex // Keeps notices from interleaving with relayed data
+}
+
+// newRelayClient records a client joining a session now
+func newRelayClient(conn net.Conn, role byte) *RelayClient {
+	return &RelayClient{Conn: conn, Role: role, ConnectedAt: time.Now()}
+}
+
+// newRelaySession creates an empty session with the given ID
+func newRelaySession(id string) *RelaySession {
+	return &RelaySession{
+		ID:        id,
+		CreatedAt: time.Now(),
+		LastUsed:  time.Now(),
+		Active:    true,
+		paired:    make(chan struct{}),
+		closed:    make(chan struct{}),
+		relayed:   make(chan struct{}),
+	}
 }
 
 // NewRelayServer creates a new relay server with the given configuration
 func NewRelayServer(config *RelayConfig) *RelayServer {
 	return &RelayServer{
-		config:   config,
-		sessions: make(map[string]*RelaySession),
+		config:     config,
+		sessions:   make(map[string]*RelaySession),
+		ipSessions: make(map[string]int),
 	}
 }
 
 // Start starts the relay server
 func (rs *RelayServer) Start() error {
+	accessLog, err := NewAccessLogger(rs.config.LogFile, rs.config.LogJSON)
+	if err != nil {
+		return err
+	}
+	rs.accessLog = accessLog
+
+	// Proxy unknown HTTP paths to the fallback site, if configured
+	if rs.config.FallbackProxy != "" {
+		target, err := url.Parse(rs.config.FallbackProxy)
+		if err != nil || target.Scheme == "" || target.Host == "" {
+			return fmt.Errorf("invalid fallback proxy URL %q", rs.config.FallbackProxy)
+		}
+		rs.fallback = newFallbackProxy(target)
+	}
+
+	// Bridge TCP clients to UDP backends and back, if configured
+	if rs.config.Bridge != "" {
+		if !validFraming(rs.config.BridgeFraming) {
+			return fmt.Errorf("invalid bridge framing %q, expected %s or %s", rs.config.BridgeFraming, BRIDGE_FRAMING_LENGTH, BRIDGE_FRAMING_RAW)
+		}
+		specs, err := parseBridgeSpecs(rs.config.Bridge)
+		if err != nil {
+			return err
+		}
+		for _, spec := range specs {
+			if err := rs.startBridge(spec); err != nil {
+				return err
+			}
+		}
+	}
+
 	// Start TCP server if enabled
 	if rs.config.EnableTCP {
 		go rs.startTCPServer()
@@ -79,7 +201,7 @@ func (rs *RelayServer) Start() error {
 
 // startTCPServer starts the TCP server
 func (rs *RelayServer) startTCPServer() error {
-	addr := fmt.Sprintf(":%d", rs.config.TCPPort)
+	addr := net.JoinHostPort("", strconv.Itoa(rs.config.TCPPort))
 	listener, err := net.Listen("tcp", addr)
 	if err != nil {
 		return fmt.Errorf("failed to start TCP server: %v", err)
@@ -103,33 +225,106 @@ func (rs *RelayServer) startTCPServer() error {
 func (rs *RelayServer) handleTCPConnection(conn net.Conn) {
 	defer conn.Close()
 
-	// Read the session ID from the connection
+	// Read the session ID from the connection. Clients that connect and
+	// send nothing are dropped, since no session exists yet to clean them up.
+	if rs.config.HandshakeTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(rs.config.HandshakeTimeout))
+	}
 	buffer := make([]byte, 64)
 	n, err := conn.Read(buffer)
 	if err != nil {
-		log.Printf("Error reading session ID: %v", err)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			log.Printf("No session ID from %s within %v, closing connection", conn.RemoteAddr(), rs.config.HandshakeTimeout)
+		} else {
+			log.Printf("Error reading session ID: %v", err)
+		}
 		return
 	}
+	conn.SetReadDeadline(time.Time{})
 
-	sessionID := string(buffer[:n])
+	sessionID, role, err := parseHandshake(buffer[:n])
+	if err != nil {
+		log.Printf("Invalid handshake from %s: %v", conn.RemoteAddr(), err)
+		return
+	}
 
 	if rs.config.DebugMode {
 		log.Printf("New connection for session: %s from %s", sessionID, conn.RemoteAddr())
 	}
 
+	rs.joinSession(conn, sessionID, role)
+}
+
+// parseHandshake splits a TCP handshake into the session ID and the
+// optional role byte that follows ROLE_SEPARATOR
+func parseHandshake(data []byte) (string, byte, error) {
+	sessionID, role, found := strings.Cut(string(data), string(rune(ROLE_SEPARATOR)))
+	if !found {
+		return sessionID, ROLE_NONE, nil
+	}
+
+	if len(role) != 1 || !validRole(role[0]) {
+		return "", ROLE_NONE, fmt.Errorf("unknown role %q", role)
+	}
+	return sessionID, role[0], nil
+}
+
+// validRole reports whether role is one of the roles a client may declare
+func validRole(role byte) bool {
+	return role == ROLE_NONE || role == ROLE_HOST || role == ROLE_GUEST
+}
+
+// parseRole converts the role query parameter of HTTP clients, "host",
+// "guest" or empty, to a role byte
+func parseRole(name string) (byte, error) {
+	switch strings.ToLower(name) {
+	case "":
+		return ROLE_NONE, nil
+	case "host":
+		return ROLE_HOST, nil
+	case "guest":
+		return ROLE_GUEST, nil
+	}
+	return ROLE_NONE, fmt.Errorf("unknown role %q", name)
+}
+
+// joinSession adds a client with the given role to a session, creating the
+// session if needed. It blocks until the session ends so the caller's
+// connection stays open for the whole relay.
+func (rs *RelayServer) joinSession(conn net.Conn, sessionID string, role byte) {
 	rs.sessionsMu.Lock()
 	session, exists := rs.sessions[sessionID]
 
-	if !exists {
-		// Create a new session
-		session = &RelaySession{
-			ID:        sessionID,
-			CreatedAt: time.Now(),
-			LastUsed:  time.Now(),
-			Active:    true,
+	// Refuse clients already in as many sessions as allowed. Both peers
+	// of a session may share an IP, which counts as a single session, and
+	// a session reserved via /new already counts for the IP reserving it.
+	ip := clientIP(conn)
+	counted := ""
+	if exists && session.Clients[0] != nil {
+		counted = clientIP(session.Clients[0].Conn)
+	} else if exists {
+		counted = session.Reserver
+	}
+	newIP := counted != ip
+	if newIP && rs.config.MaxSessionsPerIP > 0 && rs.ipSessions[ip] >= rs.config.MaxSessionsPerIP {
+		rs.sessionsMu.Unlock()
+		conn.Write([]byte("SESSION_LIMIT"))
+		log.Printf("%s is already in %d sessions, rejecting connection for session %s", ip, rs.config.MaxSessionsPerIP, sessionID)
+		return
+	}
+
+	if !exists || session.Clients[0] == nil {
+		// Create a new session, or take over one reserved via /new
+		if !exists {
+			session = newRelaySession(sessionID)
+			rs.sessions[sessionID] = session
+		}
+		if newIP {
+			rs.releaseIP(session.Reserver)
+			rs.ipSessions[ip]++
 		}
-		session.Clients[0] = conn
-		rs.sessions[sessionID] = session
+		session.Clients[0] = newRelayClient(conn, role)
+		session.Reserver = ""
 		rs.sessionsMu.Unlock()
 
 		// Wait for the second client to connect
@@ -139,6 +334,7 @@ func (rs *RelayServer) handleTCPConnection(conn net.Conn) {
 
 		// Send acknowledgment to the first client
 		conn.Write([]byte("WAITING"))
+		rs.waitForPeer(session)
 		return
 	}
 
@@ -150,9 +346,21 @@ func (rs *RelayServer) handleTCPConnection(conn net.Conn) {
 		return
 	}
 
+	// Two hosts or two guests can't pair
+	if role != ROLE_NONE && role == session.Clients[0].Role {
+		rs.sessionsMu.Unlock()
+		conn.Write([]byte("ROLE_TAKEN"))
+		log.Printf("Session %s already has a %s, rejecting connection from %s", sessionID, roleName(role), conn.RemoteAddr())
+		return
+	}
+
 	// Add the second client to the session
-	session.Clients[1] = conn
+	session.Clients[1] = newRelayClient(conn, role)
+	if newIP {
+		rs.ipSessions[ip]++
+	}
 	session.LastUsed = time.Now()
+	close(session.paired)
 	rs.sessionsMu.Unlock()
 
 	if rs.config.DebugMode {
@@ -160,11 +368,120 @@ func (rs *RelayServer) handleTCPConnection(conn net.Conn) {
 	}
 
 	// Notify both clients that the session is ready
-	session.Clients[0].Write([]byte("CONNECTED"))
-	session.Clients[1].Write([]byte("CONNECTED"))
+	session.Clients[0].Conn.Write([]byte("CONNECTED"))
+	session.Clients[1].Conn.Write([]byte("CONNECTED"))
+
+	// Relay data between the clients until one side closes
+	rs.relayData(session)
+}
 
-	// Start relaying data between the clients
-	go rs.relayData(session)
+// clientIP returns the IP address a client connects from, used to count
+// its sessions for --max-sessions-per-ip
+func clientIP(conn net.Conn) string {
+	return addressIP(conn.RemoteAddr().String())
+}
+
+// addressIP returns the IP of a host:port address
+func addressIP(address string) string {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	}
+	return host
+}
+
+// releaseIP removes a session from the count of ip, if any; the caller
+// must hold sessionsMu
+func (rs *RelayServer) releaseIP(ip string) {
+	if ip == "" {
+		return
+	}
+	if rs.ipSessions[ip]--; rs.ipSessions[ip] <= 0 {
+		delete(rs.ipSessions, ip)
+	}
+}
+
+// roleName returns the name of a role for log messages and /sessions
+func roleName(role byte) string {
+	switch role {
+	case ROLE_HOST:
+		return "host"
+	case ROLE_GUEST:
+		return "guest"
+	}
+	return "client"
+}
+
+// errSessionLimit is returned by newSessionID for IPs already in
+// --max-sessions-per-ip sessions
+var errSessionLimit = errors.New("session limit reached")
+
+// newSessionID generates a random session ID that is not in use and
+// reserves it for ip, so concurrent callers never receive the same ID.
+// The reservation counts as one of ip's sessions.
+func (rs *RelayServer) newSessionID(ip string) (string, error) {
+	buffer := make([]byte, SESSION_ID_BYTES)
+
+	rs.sessionsMu.Lock()
+	defer rs.sessionsMu.Unlock()
+
+	if rs.config.MaxSessionsPerIP > 0 && rs.ipSessions[ip] >= rs.config.MaxSessionsPerIP {
+		return "", errSessionLimit
+	}
+
+	for {
+		if _, err := rand.Read(buffer); err != nil {
+			return "", fmt.Errorf("failed to generate session ID: %v", err)
+		}
+
+		sessionID := hex.EncodeToString(buffer)
+		if _, exists := rs.sessions[sessionID]; !exists {
+			session := newRelaySession(sessionID)
+			session.Reserver = ip
+			rs.sessions[sessionID] = session
+			rs.ipSessions[ip]++
+			return sessionID, nil
+		}
+	}
+}
+
+// waitForPeer blocks the first client of a session until the relay with its
+// peer finishes. If no peer joins within the pair timeout, the client is
+// sent TIMEOUT and the session is closed.
+func (rs *RelayServer) waitForPeer(session *RelaySession) {
+	var timeout <-chan time.Time
+	if rs.config.PairTimeout > 0 {
+		timer := time.NewTimer(rs.config.PairTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-session.paired:
+	case <-session.closed:
+		// Closed before a peer joined, e.g. by the idle cleanup
+		select {
+		case <-session.paired:
+		default:
+			return
+		}
+	case <-timeout:
+		rs.sessionsMu.Lock()
+		if session.Clients[1] == nil {
+			session.Clients[0].Conn.Write([]byte("TIMEOUT"))
+			rs.closeSessionLocked(session.ID, CLOSE_PAIR_TIMEOUT)
+			rs.sessionsMu.Unlock()
+
+			if rs.config.DebugMode {
+				log.Printf("Session %s timed out waiting for peer", session.ID)
+			}
+			return
+		}
+		rs.sessionsMu.Unlock()
+	}
+
+	// Keep this client's connection usable until the relay is done with it
+	<-session.relayed
 }
 
 // relayData relays data between the two clients in a session
@@ -175,90 +492,222 @@ func (rs *RelayServer) relayData(session *RelaySession) {
 	// Relay from client 0 to client 1
 	go func() {
 		defer wg.Done()
-		rs.copyData(session.Clients[0], session.Clients[1], session)
+		rs.copyData(session.Clients[0].Conn, session.Clients[1], session)
 	}()
 
 	// Relay from client 1 to client 0
 	go func() {
 		defer wg.Done()
-		rs.copyData(session.Clients[1], session.Clients[0], session)
+		rs.copyData(session.Clients[1].Conn, session.Clients[0], session)
 	}()
 
 	// Wait for both directions to complete
 	wg.Wait()
-
-	// Close the session
-	rs.closeSession(session.ID)
+	close(session.relayed)
 }
 
-// copyData copies data from src to dst and updates the session's LastUsed time
-func (rs *RelayServer) copyData(src, dst net.Conn, session *RelaySession) {
-	buffer := make([]byte, 4096)
+// copyData copies data from src to dst and updates the session's LastUsed time.
+// Reads go through a bounded buffer, so a sender that outpaces a slow reader
+// is blocked instead of growing memory. If dst accepts nothing for longer
+// than the idle timeout, the session is closed. When either direction ends,
+// the whole session is closed.
+func (rs *RelayServer) copyData(src net.Conn, dst *RelayClient, session *RelaySession) {
+	chunks := make(chan []byte, RELAY_BUFFER_CHUNKS)
 
-	for {
-		// Set read deadline if idle timeout is configured
-		if rs.config.IdleTimeout > 0 {
-			src.SetReadDeadline(time.Now().Add(rs.config.IdleTimeout))
-		}
+	// Why the reader stopped, safe to read once it closed chunks
+	readReason := CLOSE_PEER_CLOSED
 
-		n, err := src.Read(buffer)
-		if err != nil {
-			if err != io.EOF {
-				log.Printf("Read error: %v", err)
+	go func() {
+		defer close(chunks)
+
+		for {
+			// Set read deadline if idle timeout is configured
+			if rs.config.IdleTimeout > 0 {
+				src.SetReadDeadline(time.Now().Add(rs.config.IdleTimeout))
 			}
-			break
+
+			buffer := rs.getChunk()
+			n, err := src.Read(buffer)
+			if n == 0 {
+				rs.putChunk(buffer)
+			}
+			if n > 0 {
+				// Update last used time
+				session.mu.Lock()
+				session.LastUsed = time.Now()
+				session.mu.Unlock()
+
+				// Blocks while the buffer is full
+				select {
+				case chunks <- buffer[:n]:
+				case <-session.closed:
+					rs.putChunk(buffer)
+					return
+				}
+			}
+			if err != nil {
+				// The idle timeout applies to the session: keep waiting
+				// while the other direction is still active
+				if isTimeout(err) && !rs.sessionIdle(session) {
+					continue
+				}
+				if isTimeout(err) {
+					readReason = CLOSE_IDLE
+				} else if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+					log.Printf("Read error: %v", err)
+					readReason = CLOSE_READ_ERROR
+				}
+				return
+			}
+		}
+	}()
+
+	reason := ""
+	for chunk := range chunks {
+		// Relay nothing more once the clients are being told the session
+		// expired, so the notice is the last thing they receive
+		dst.writeMu.Lock()
+		if session.expiring.Load() {
+			dst.writeMu.Unlock()
+			rs.putChunk(chunk)
+			continue
 		}
 
-		// Update last used time
-		session.mu.Lock()
-		session.LastUsed = time.Now()
-		session.mu.Unlock()
+		// Bound how long a stalled reader can hold up the session
+		if rs.config.IdleTimeout > 0 {
+			dst.Conn.SetWriteDeadline(time.Now().Add(rs.config.IdleTimeout))
+		}
 
-		// Write data to destination
-		_, err = dst.Write(buffer[:n])
+		// Write data to destination. The chunk is no longer needed once
+		// written, whatever the result.
+		n, err := dst.Conn.Write(chunk)
+		dst.writeMu.Unlock()
+		rs.putChunk(chunk)
+		session.bytesRelayed.Add(uint64(n))
 		if err != nil {
-			log.Printf("Write error: %v", err)
+			if errors.Is(err, net.ErrClosed) {
+				reason = CLOSE_PEER_CLOSED
+				break
+			}
+			if isTimeout(err) && session.expiring.Load() {
+				reason = CLOSE_LIFETIME
+			} else if isTimeout(err) {
+				log.Printf("Session %s: %s stalled for more than %v, closing session", session.ID, dst.Conn.RemoteAddr(), rs.config.IdleTimeout)
+				reason = CLOSE_STALLED
+			} else {
+				log.Printf("Write error: %v", err)
+				reason = CLOSE_WRITE_ERROR
+			}
 			break
 		}
 
 		if rs.config.DebugMode {
-			log.Printf("Relayed %d bytes from %s to %s", n, src.RemoteAddr(), dst.RemoteAddr())
+			log.Printf("Relayed %d bytes from %s to %s", len(chunk), src.RemoteAddr(), dst.Conn.RemoteAddr())
 		}
 	}
+
+	// The reader is done only if every chunk was written
+	if reason == "" {
+		reason = readReason
+	}
+
+	// Closing the session stops the other direction and the reader above
+	rs.closeSession(session.ID, reason)
+	for chunk := range chunks {
+		rs.putChunk(chunk)
+	}
+}
+
+// getChunk returns a buffer for one read of relayed data, from the pool
+// with -buffer-pool
+func (rs *RelayServer) getChunk() []byte {
+	if !rs.config.BufferPool {
+		return make([]byte, RELAY_CHUNK_SIZE)
+	}
+	if chunk, ok := rs.chunks.Get().([]byte); ok {
+		return chunk
+	}
+	return make([]byte, RELAY_CHUNK_SIZE)
+}
+
+// putChunk gives a buffer from getChunk back to the pool once its data was
+// written, or will never be
+func (rs *RelayServer) putChunk(chunk []byte) {
+	if rs.config.BufferPool {
+		rs.chunks.Put(chunk[:RELAY_CHUNK_SIZE])
+	}
+}
+
+// sessionIdle reports whether no data has moved in either direction for
+// longer than the idle timeout
+func (rs *RelayServer) sessionIdle(session *RelaySession) bool {
+	session.mu.RLock()
+	defer session.mu.RUnlock()
+
+	return time.Since(session.LastUsed) >= rs.config.IdleTimeout
 }
 
-// closeSession closes a session and its connections
-func (rs *RelayServer) closeSession(sessionID string) {
+// isTimeout reports whether err was caused by an expired deadline
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, os.ErrDeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout())
+}
+
+// closeSession closes a session and its connections, logging the reason
+// to the access log
+func (rs *RelayServer) closeSession(sessionID, reason string) {
 	rs.sessionsMu.Lock()
 	defer rs.sessionsMu.Unlock()
 
+	rs.closeSessionLocked(sessionID, reason)
+}
+
+// closeSessionLocked closes a session; the caller must hold sessionsMu
+func (rs *RelayServer) closeSessionLocked(sessionID, reason string) {
 	session, exists := rs.sessions[sessionID]
 	if !exists {
 		return
 	}
 
-	// Close connections
-	if session.Clients[0] != nil {
-		session.Clients[0].Close()
+	// A relay interrupted by the lifetime notice fails, but that's why it ended
+	if session.expiring.Load() {
+		reason = CLOSE_LIFETIME
 	}
-	if session.Clients[1] != nil {
-		session.Clients[1].Close()
+
+	// Close connections and release the session for each client IP, or
+	// for the IP that reserved it if nobody joined
+	ips := make(map[string]bool)
+	if session.Reserver != "" {
+		ips[session.Reserver] = true
+	}
+	for _, client := range session.Clients {
+		if client != nil {
+			client.Conn.Close()
+			ips[clientIP(client.Conn)] = true
+		}
+	}
+	for ip := range ips {
+		rs.releaseIP(ip)
 	}
 
-	// Remove session
+	// Remove session and release any waiting client
+	rs.logSession(session, reason)
 	delete(rs.sessions, sessionID)
+	session.closeOnce.Do(func() { close(session.closed) })
 
 	if rs.config.DebugMode {
 		log.Printf("Closed session: %s", sessionID)
 	}
 }
 
-// cleanupSessions periodically removes idle sessions
+// cleanupSessions periodically removes idle sessions and sessions older
+// than the maximum lifetime
 func (rs *RelayServer) cleanupSessions() {
-	ticker := time.NewTicker(5 * time.Minute)
+	ticker := time.NewTicker(rs.cleanupInterval())
 	defer ticker.Stop()
 
 	for range ticker.C {
+		var expired []*RelaySession
 		rs.sessionsMu.Lock()
 		now := time.Now()
 
@@ -266,6 +715,18 @@ func (rs *RelayServer) cleanupSessions() {
 			session.mu.RLock()
 			idle := now.Sub(session.LastUsed)
 			session.mu.RUnlock()
+			age := now.Sub(session.CreatedAt)
+
+			// Close sessions older than the maximum lifetime, even if active
+			if rs.config.MaxLifetime > 0 && age > rs.config.MaxLifetime {
+				if session.expiring.CompareAndSwap(false, true) {
+					if rs.config.DebugMode {
+						log.Printf("Closing session %s: lifetime exceeded (open for %v)", id, age.Round(time.Second))
+					}
+					expired = append(expired, session)
+				}
+				continue
+			}
 
 			// Close sessions idle for more than the configured timeout
 			if idle > rs.config.IdleTimeout {
@@ -273,26 +734,69 @@ func (rs *RelayServer) cleanupSessions() {
 					log.Printf("Cleaning up idle session: %s (idle for %v)", id, idle)
 				}
 
-				// Close connections
-				if session.Clients[0] != nil {
-					session.Clients[0].Close()
-				}
-				if session.Clients[1] != nil {
-					session.Clients[1].Close()
-				}
-
-				// Remove session
-				delete(rs.sessions, id)
+				rs.closeSessionLocked(id, CLOSE_IDLE)
 			}
 		}
 
 		rs.sessionsMu.Unlock()
+
+		// Notify the clients without holding the lock, since writing to
+		// one that stopped reading can take a while
+		for _, session := range expired {
+			go rs.expireSession(session)
+		}
+	}
+}
+
+// expireSession tells the clients of a session that it exceeded its
+// lifetime, then closes it
+func (rs *RelayServer) expireSession(session *RelaySession) {
+	rs.sessionsMu.RLock()
+	clients := session.Clients
+	rs.sessionsMu.RUnlock()
+
+	for _, client := range clients {
+		if client != nil {
+			client.notify("LIFETIME_EXCEEDED")
+		}
+	}
+
+	// The session may have ended on its own in the meantime
+	rs.sessionsMu.Lock()
+	defer rs.sessionsMu.Unlock()
+	if rs.sessions[session.ID] == session {
+		rs.closeSessionLocked(session.ID, CLOSE_LIFETIME)
 	}
 }
 
+// notify writes a notice to the client between two writes of relayed data.
+// The deadline also interrupts a write of relayed data stalled on it.
+func (client *RelayClient) notify(message string) {
+	client.Conn.SetWriteDeadline(time.Now().Add(NOTICE_TIMEOUT))
+	client.writeMu.Lock()
+	defer client.writeMu.Unlock()
+
+	client.Conn.SetWriteDeadline(time.Now().Add(NOTICE_TIMEOUT))
+	client.Conn.Write([]byte(message))
+}
+
+// cleanupInterval is how often cleanupSessions runs. It runs more often
+// than every 5 minutes for short lifetimes, so sessions don't outlive
+// -max-session-lifetime by more than a tenth of it.
+func (rs *RelayServer) cleanupInterval() time.Duration {
+	interval := 5 * time.Minute
+	if lifetime := rs.config.MaxLifetime; lifetime > 0 && lifetime/10 < interval {
+		interval = lifetime / 10
+		if interval < time.Second {
+			interval = time.Second
+		}
+	}
+	return interval
+}
+
 // startHTTPServer starts the HTTP server
 func (rs *RelayServer) startHTTPServer() error {
-	addr := fmt.Sprintf(":%d", rs.config.HTTPPort)
+	addr := net.JoinHostPort("", strconv.Itoa(rs.config.HTTPPort))
 
 	// Create HTTP server
 	server := &http.Server{
@@ -312,7 +816,7 @@ func (rs *RelayServer) startHTTPServer() error {
 
 // startHTTPSServer starts the HTTPS server
 func (rs *RelayServer) startHTTPSServer() error {
-	addr := fmt.Sprintf(":%d", rs.config.HTTPSPort)
+	addr := net.JoinHostPort("", strconv.Itoa(rs.config.HTTPSPort))
 
 	// Check if TLS certificate and key files exist
 	if rs.config.TLSCertFile == "" || rs.config.TLSKeyFile == "" {
@@ -325,6 +829,24 @@ func (rs *RelayServer) startHTTPSServer() error {
 		MinVersion: tls.VersionTLS12,
 	}
 
+	// Require client certificates signed by the given CA, if configured.
+	// Unauthenticated clients fail the handshake before reaching any session.
+	if rs.config.ClientCAFile != "" {
+		caPEM, err := os.ReadFile(rs.config.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("failed to read client CA file: %v", err)
+		}
+
+		clientCAs := x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(caPEM) {
+			return fmt.Errorf("no valid certificates found in client CA file %s", rs.config.ClientCAFile)
+		}
+
+		tlsConfig.ClientCAs = clientCAs
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		log.Printf("HTTPS client certificate authentication enabled")
+	}
+
 	// Create HTTPS server
 	server := &http.Server{
 		Addr:      addr,
@@ -350,16 +872,76 @@ func (rs *RelayServer) handleHTTPRequest(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	// Mint a new session ID
+	if r.URL.Path == "/new" {
+		rs.handleNewSession(w, r)
+		return
+	}
+
+	// List sessions and their clients in JSON
+	if r.URL.Path == "/sessions" {
+		rs.handleSessions(w, r)
+		return
+	}
+
 	// Serve status page for root path
 	if r.URL.Path == "/" {
 		rs.serveStatusPage(w, r)
 		return
 	}
 
-	// 404 for other paths
+	// Other paths go to the fallback site, or get a 404 without one
+	if rs.fallback != nil {
+		rs.fallback.ServeHTTP(w, r)
+		return
+	}
 	http.NotFound(w, r)
 }
 
+// newFallbackProxy creates a reverse proxy to target that presents the
+// target's own host name, so virtual-hosted sites answer as usual
+func newFallbackProxy(target *url.URL) *httputil.ReverseProxy {
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	director := proxy.Director
+	proxy.Director = func(r *http.Request) {
+		director(r)
+		r.Host = target.Host
+	}
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		log.Printf("Fallback proxy error for %s: %v", r.URL.Path, err)
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	return proxy
+}
+
+// handleNewSession returns a freshly reserved random session ID
+func (rs *RelayServer) handleNewSession(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ip := addressIP(r.RemoteAddr)
+	sessionID, err := rs.newSessionID(ip)
+	if err == errSessionLimit {
+		log.Printf("%s is already in %d sessions, refusing to reserve another", ip, rs.config.MaxSessionsPerIP)
+		http.Error(w, "SESSION_LIMIT", http.StatusTooManyRequests)
+		return
+	}
+	if err != nil {
+		log.Printf("Error creating session ID: %v", err)
+		http.Error(w, "Failed to create session", http.StatusInternalServerError)
+		return
+	}
+
+	if rs.config.DebugMode {
+		log.Printf("Reserved session %s for %s", sessionID, r.RemoteAddr)
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprintf(w, "%s\n", sessionID)
+}
+
 // handleHTTPRelay handles relay requests over HTTP
 func (rs *RelayServer) handleHTTPRelay(w http.ResponseWriter, r *http.Request) {
 	// Get session ID from query parameter
@@ -372,66 +954,114 @@ func (rs *RelayServer) handleHTTPRelay(w http.ResponseWriter, r *http.Request) {
 	// Check if it's a WebSocket upgrade request
 	// For now, we'll just use a simple HTTP connection
 
+	role, err := parseRole(r.URL.Query().Get("role"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	// Create a connection wrapper for the HTTP connection
-	conn := newHTTPConnection(w, r)
+	conn, err := newHTTPConnection(w, r)
+	if err != nil {
+		log.Printf("Error taking over HTTP connection from %s: %v", r.RemoteAddr, err)
+		return
+	}
+	defer conn.Close()
 
 	// Handle the connection like a TCP connection
-	rs.handleHTTPConnection(conn, sessionID)
+	rs.handleHTTPConnection(conn, sessionID, role)
 }
 
 // handleHTTPConnection handles an HTTP connection for relaying
-func (rs *RelayServer) handleHTTPConnection(conn *httpConnection, sessionID string) {
+func (rs *RelayServer) handleHTTPConnection(conn *httpConnection, sessionID string, role byte) {
 	if rs.config.DebugMode {
 		log.Printf("New HTTP connection for session: %s from %s", sessionID, conn.RemoteAddr())
 	}
 
-	rs.sessionsMu.Lock()
-	session, exists := rs.sessions[sessionID]
+	rs.joinSession(conn, sessionID, role)
+}
 
-	if !exists {
-		// Create a new session
-		session = &RelaySession{
-			ID:        sessionID,
-			CreatedAt: time.Now(),
-			LastUsed:  time.Now(),
-			Active:    true,
-		}
-		session.Clients[0] = conn
-		rs.sessions[sessionID] = session
-		rs.sessionsMu.Unlock()
+// SessionInfo describes a session in the /sessions listing
+type SessionInfo struct {
+	ID        string       `json:"id"`
+	CreatedAt time.Time    `json:"createdAt"`
+	LastUsed  time.Time    `json:"lastUsed"`
+	Paired    bool         `json:"paired"`
+	Clients   []ClientInfo `json:"clients"`
+}
 
-		if rs.config.DebugMode {
-			log.Printf("Created new HTTP session: %s, waiting for peer", sessionID)
-		}
+// ClientInfo describes a client connected to a session
+type ClientInfo struct {
+	Role        string    `json:"role"`
+	RemoteAddr  string    `json:"remoteAddr"`
+	ConnectedAt time.Time `json:"connectedAt"`
+}
 
-		// Send acknowledgment to the first client
-		conn.Write([]byte("WAITING"))
-		return
+// REDACTED replaces session IDs and client addresses for requests without
+// the --status-token
+const REDACTED = "redacted"
+
+// statusAuthorized reports whether the request carries the configured
+// --status-token as a bearer token. Without a token, nobody is authorized.
+func (rs *RelayServer) statusAuthorized(r *http.Request) bool {
+	if rs.config.StatusToken == "" {
+		return false
 	}
 
-	// If the session exists but already has two clients, reject
-	if session.Clients[0] != nil && session.Clients[1] != nil {
-		rs.sessionsMu.Unlock()
-		conn.Write([]byte("SESSION_FULL"))
-		log.Printf("Session %s is full, rejecting HTTP connection", sessionID)
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(rs.config.StatusToken)) == 1
+}
+
+// handleSessions lists the sessions and their clients in JSON format.
+// Session IDs and client addresses are redacted unless the request is
+// authorized, since they let anyone join or identify the peers.
+func (rs *RelayServer) handleSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
+	authorized := rs.statusAuthorized(r)
 
-	// Add the second client to the session
-	session.Clients[1] = conn
-	session.LastUsed = time.Now()
-	rs.sessionsMu.Unlock()
+	rs.sessionsMu.RLock()
+	sessions := make([]SessionInfo, 0, len(rs.sessions))
+	for _, session := range rs.sessions {
+		session.mu.RLock()
+		info := SessionInfo{
+			ID:        session.ID,
+			CreatedAt: session.CreatedAt,
+			LastUsed:  session.LastUsed,
+			Paired:    session.Clients[1] != nil,
+			Clients:   make([]ClientInfo, 0, len(session.Clients)),
+		}
+		session.mu.RUnlock()
 
-	if rs.config.DebugMode {
-		log.Printf("Second client connected to HTTP session %s", sessionID)
+		for _, client := range session.Clients {
+			if client == nil {
+				continue
+			}
+			info.Clients = append(info.Clients, ClientInfo{
+				Role:        roleName(client.Role),
+				RemoteAddr:  client.Conn.RemoteAddr().String(),
+				ConnectedAt: client.ConnectedAt,
+			})
+		}
+
+		if !authorized {
+			info.ID = REDACTED
+			for i := range info.Clients {
+				info.Clients[i].RemoteAddr = REDACTED
+			}
+		}
+		sessions = append(sessions, info)
 	}
+	rs.sessionsMu.RUnlock()
 
-	// Notify both clients that the session is ready
-	session.Clients[0].Write([]byte("CONNECTED"))
-	session.Clients[1].Write([]byte("CONNECTED"))
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].CreatedAt.Before(sessions[j].CreatedAt)
+	})
 
-	// Start relaying data between the clients
-	go rs.relayData(session)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sessions)
 }
 
 // serveStatusPage serves a status page with information about the relay server
@@ -448,30 +1078,81 @@ func (rs *RelayServer) serveStatusPage(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "For more information, visit: https://github.com/lsferreira42/np\n")
 }
 
-// httpConnection implements the net.Conn interface for HTTP connections
+// HTTP_CLOSE_TIMEOUT bounds how long closing a hijacked HTTP connection
+// waits for a pending write before ending the response
+const HTTP_CLOSE_TIMEOUT = time.Second
+
+// httpConnection implements the net.Conn interface for HTTP connections.
+// HTTP/1 connections are hijacked: the HTTP/1 server stops reading the
+// request body once the response starts, but a relay client sends and
+// receives at the same time. HTTP/2 streams are full duplex already.
 type httpConnection struct {
 	w          http.ResponseWriter
 	r          *http.Request
+	rc         *http.ResponseController
+	conn       net.Conn       // Hijacked HTTP/1 connection, nil for HTTP/2
+	body       io.Reader      // Request body, read as the client's data
+	response   io.WriteCloser // Chunked response on the hijacked connection
 	remoteAddr string
 	localAddr  string
 	readBuf    []byte
-	closed     bool
+	closed     atomic.Bool
+	mu         sync.Mutex // Serializes response writes with Close
 }
 
-// newHTTPConnection creates a new HTTP connection
-func newHTTPConnection(w http.ResponseWriter, r *http.Request) *httpConnection {
-	return &httpConnection{
+// newHTTPConnection creates a new HTTP connection, taking over HTTP/1
+// connections from the server
+func newHTTPConnection(w http.ResponseWriter, r *http.Request) (*httpConnection, error) {
+	c := &httpConnection{
 		w:          w,
 		r:          r,
+		rc:         http.NewResponseController(w),
+		body:       r.Body,
 		remoteAddr: r.RemoteAddr,
 		localAddr:  r.Host,
 		readBuf:    make([]byte, 0),
 	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if r.ProtoMajor != 1 || !ok {
+		return c, nil
+	}
+
+	conn, buffered, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	c.conn = conn
+
+	// Read the body as the server would have, from what it buffered.
+	// Requests without one, such as a GET that only receives, stay open
+	// until the client disconnects and relay anything it sends after the
+	// headers.
+	switch {
+	case len(r.TransferEncoding) > 0 && r.TransferEncoding[0] == "chunked":
+		c.body = httputil.NewChunkedReader(buffered.Reader)
+	case r.ContentLength > 0:
+		c.body = io.LimitReader(buffered.Reader, r.ContentLength)
+	default:
+		c.body = buffered.Reader
+	}
+
+	header := "HTTP/1.1 200 OK\r\nContent-Type: application/octet-stream\r\nCache-Control: no-cache\r\nTransfer-Encoding: chunked\r\n\r\n"
+	if strings.EqualFold(r.Header.Get("Expect"), "100-continue") {
+		header = "HTTP/1.1 100 Continue\r\n\r\n" + header
+	}
+	if _, err := io.WriteString(conn, header); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c.response = httputil.NewChunkedWriter(conn)
+	return c, nil
 }
 
 // Read reads data from the HTTP connection
 func (c *httpConnection) Read(b []byte) (n int, err error) {
-	if c.closed {
+	if c.closed.Load() {
 		return 0, io.EOF
 	}
 
@@ -482,28 +1163,59 @@ func (c *httpConnection) Read(b []byte) (n int, err error) {
 		return n, nil
 	}
 
-	// Otherwise, read from the request body
-	return c.r.Body.Read(b)
+	// Otherwise, read from the request body. A client that disconnects
+	// without ending a chunked body has closed its side all the same.
+	n, err = c.body.Read(b)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
 }
 
 // Write writes data to the HTTP connection
 func (c *httpConnection) Write(b []byte) (n int, err error) {
-	if c.closed {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed.Load() {
 		return 0, io.ErrClosedPipe
 	}
 
+	// Send each write as its own chunk on a hijacked connection
+	if c.response != nil {
+		return c.response.Write(b)
+	}
+
 	// Write to the response
 	n, err = c.w.Write(b)
-	if f, ok := c.w.(http.Flusher); ok {
-		f.Flush()
+	if err != nil {
+		return n, err
 	}
-	return n, err
+	if err := c.rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return n, err
+	}
+	return n, nil
 }
 
-// Close closes the HTTP connection
+// Close closes the HTTP connection and interrupts a pending body read. A
+// hijacked connection ends the chunked response first, so clients see
+// the response complete rather than cut off.
 func (c *httpConnection) Close() error {
-	c.closed = true
-	return nil
+	if c.closed.Swap(true) {
+		return nil
+	}
+	if c.conn == nil {
+		c.rc.SetReadDeadline(time.Now())
+		return nil
+	}
+
+	// Don't let a pending write to a stalled client hold up the close
+	c.conn.SetWriteDeadline(time.Now().Add(HTTP_CLOSE_TIMEOUT))
+	c.mu.Lock()
+	c.response.Close()
+	io.WriteString(c.conn, "\r\n")
+	c.mu.Unlock()
+	return c.conn.Close()
 }
 
 // LocalAddr returns the local network address
@@ -518,17 +1230,26 @@ func (c *httpConnection) RemoteAddr() net.Addr {
 
 // SetDeadline sets the read and write deadlines
 func (c *httpConnection) SetDeadline(t time.Time) error {
-	return nil // Not implemented for HTTP
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
 }
 
-// SetReadDeadline sets the read deadline
+// SetReadDeadline sets the read deadline of the request body
 func (c *httpConnection) SetReadDeadline(t time.Time) error {
-	return nil // Not implemented for HTTP
+	if c.conn != nil {
+		return c.conn.SetReadDeadline(t)
+	}
+	return c.rc.SetReadDeadline(t)
 }
 
-// SetWriteDeadline sets the write deadline
+// SetWriteDeadline sets the write deadline of the response
 func (c *httpConnection) SetWriteDeadline(t time.Time) error {
-	return nil // Not implemented for HTTP
+	if c.conn != nil {
+		return c.conn.SetWriteDeadline(t)
+	}
+	return c.rc.SetWriteDeadline(t)
 }
 
 // addr implements the net.Addr interface
@@ -551,28 +1272,52 @@ func main() {
 	httpsPort := flag.Int("https-port", 443, "HTTPS port to listen on")
 	tlsCert := flag.String("tls-cert", "", "TLS certificate file")
 	tlsKey := flag.String("tls-key", "", "TLS key file")
+	clientCA := flag.String("client-ca", "", "CA certificate file used to verify HTTPS client certificates")
 	enableHTTP := flag.Bool("http", true, "Enable HTTP server")
 	enableHTTPS := flag.Bool("https", false, "Enable HTTPS server")
 	enableTCP := flag.Bool("tcp", true, "Enable TCP server")
 	debugMode := flag.Bool("debug", false, "Enable debug mode")
 	maxConn := flag.Int("max-connections", 1000, "Maximum number of concurrent connections")
 	idleTimeout := flag.Duration("idle-timeout", 30*time.Minute, "Idle timeout for connections")
+	pairTimeout := flag.Duration("pair-timeout", 0, "Time to wait for a session peer before sending TIMEOUT (0 waits indefinitely)")
+	handshakeTimeout := flag.Duration("handshake-timeout", DEFAULT_HANDSHAKE_TIMEOUT, "Time a TCP client has to send its session ID (0 waits indefinitely)")
+	maxLifetime := flag.Duration("max-session-lifetime", 0, "Close sessions older than this even if they are active, sending LIFETIME_EXCEEDED (0 for no limit)")
+	logFile := flag.String("log-file", "", "File the access log is appended to (default stderr)")
+	logJSON := flag.Bool("log-json", false, "Write the access log as JSON lines")
+	maxSessionsPerIP := flag.Int("max-sessions-per-ip", 0, "Maximum number of sessions a client IP can be in at once (0 for no limit)")
+	fallbackProxy := flag.String("fallback-proxy", "", "URL of a site that unknown HTTP paths are proxied to instead of returning 404")
+	statusToken := flag.String("status-token", "", "Bearer token that reveals session IDs and client addresses on /sessions")
+	bridge := flag.String("bridge", "", "Comma-separated protocol bridges such as tcp:4242->udp:host:4242 or udp:4242->tcp:host:4242")
+	bridgeFraming := flag.String("bridge-framing", BRIDGE_FRAMING_LENGTH, "How datagrams are carried on the TCP side of a bridge: length (2-byte length prefix) or raw (one datagram per TCP read)")
+	bufferPool := flag.Bool("buffer-pool", false, "Reuse relay buffers across reads to reduce garbage collection at high message rates")
 
 	flag.Parse()
 
 	// Create server configuration
 	config := &RelayConfig{
-		TCPPort:        *tcpPort,
-		HTTPPort:       *httpPort,
-		HTTPSPort:      *httpsPort,
-		TLSCertFile:    *tlsCert,
-		TLSKeyFile:     *tlsKey,
-		EnableHTTP:     *enableHTTP,
-		EnableHTTPS:    *enableHTTPS,
-		EnableTCP:      *enableTCP,
-		DebugMode:      *debugMode,
-		MaxConnections: *maxConn,
-		IdleTimeout:    *idleTimeout,
+		TCPPort:          *tcpPort,
+		HTTPPort:         *httpPort,
+		HTTPSPort:        *httpsPort,
+		TLSCertFile:      *tlsCert,
+		TLSKeyFile:       *tlsKey,
+		ClientCAFile:     *clientCA,
+		EnableHTTP:       *enableHTTP,
+		EnableHTTPS:      *enableHTTPS,
+		EnableTCP:        *enableTCP,
+		DebugMode:        *debugMode,
+		MaxConnections:   *maxConn,
+		IdleTimeout:      *idleTimeout,
+		PairTimeout:      *pairTimeout,
+		HandshakeTimeout: *handshakeTimeout,
+		MaxLifetime:      *maxLifetime,
+		StatusToken:      *statusToken,
+		FallbackProxy:    *fallbackProxy,
+		MaxSessionsPerIP: *maxSessionsPerIP,
+		LogFile:          *logFile,
+		LogJSON:          *logJSON,
+		BufferPool:       *bufferPool,
+		Bridge:           *bridge,
+		BridgeFraming:    *bridgeFraming,
 	}
 
 	// Create and start the relay server
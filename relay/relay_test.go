@@ -0,0 +1,438 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// accessRecords collects the access log of a test relay
+type accessRecords struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (ar *accessRecords) Write(p []byte) (int, error) {
+	ar.mu.Lock()
+	defer ar.mu.Unlock()
+	return ar.buf.Write(p)
+}
+
+// reasons returns the close reason of each session logged so far
+func (ar *accessRecords) reasons() []string {
+	ar.mu.Lock()
+	defer ar.mu.Unlock()
+
+	var reasons []string
+	for _, line := range strings.Split(strings.TrimSpace(ar.buf.String()), "\n") {
+		var record AccessRecord
+		if json.Unmarshal([]byte(line), &record) == nil {
+			reasons = append(reasons, record.Reason)
+		}
+	}
+	return reasons
+}
+
+// waitForReason waits until a session closes with reason
+func (ar *accessRecords) waitForReason(t *testing.T, reason string, timeout time.Duration) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		for _, logged := range ar.reasons() {
+			if logged == reason {
+				return
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("no session closed with %q within %v, got %q", reason, timeout, ar.reasons())
+}
+
+// newTestRelay creates a relay with config that logs to the returned records
+func newTestRelay(config *RelayConfig) (*RelayServer, *accessRecords) {
+	records := &accessRecords{}
+	rs := NewRelayServer(config)
+	rs.accessLog = &AccessLogger{logger: log.New(records, "", 0), json: true}
+	return rs, records
+}
+
+// listenTCP serves TCP relay clients on a local port until the test ends
+func listenTCP(t *testing.T, rs *RelayServer) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go rs.handleTCPConnection(conn)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// dialSession connects a TCP client to session from the given local IP,
+// or any if empty
+func dialSession(t *testing.T, addr, session, localIP string) net.Conn {
+	t.Helper()
+	dialer := net.Dialer{Timeout: time.Second}
+	if localIP != "" {
+		dialer.LocalAddr = &net.TCPAddr{IP: net.ParseIP(localIP)}
+	}
+	conn, err := dialer.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	if _, err := conn.Write([]byte(session)); err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// expect reads len(want) bytes from r and fails unless they match
+func expect(t *testing.T, conn net.Conn, r io.Reader, want string) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+
+	got := make([]byte, len(want))
+	if n, err := io.ReadFull(r, got); err != nil {
+		t.Fatalf("read %q, want %q: %v", got[:n], want, err)
+	}
+	if string(got) != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+// httpRelayClient starts a chunked POST to /relay on server and returns
+// the connection and the response body
+func httpRelayClient(t *testing.T, server *httptest.Server, query string) (net.Conn, io.Reader) {
+	t.Helper()
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	fmt.Fprintf(conn, "POST /relay?%s HTTP/1.1\r\nHost: relay\r\nTransfer-Encoding: chunked\r\n\r\n", query)
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	response, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Time{})
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d", response.StatusCode)
+	}
+	return conn, response.Body
+}
+
+func TestRelayTCPAndHTTPClients(t *testing.T) {
+	rs, _ := newTestRelay(&RelayConfig{IdleTimeout: time.Minute})
+	addr := listenTCP(t, rs)
+	server := httptest.NewServer(http.HandlerFunc(rs.handleHTTPRequest))
+	defer server.Close()
+
+	tcp := dialSession(t, addr, "mixed", "")
+	expect(t, tcp, tcp, "WAITING")
+
+	httpConn, body := httpRelayClient(t, server, "session=mixed")
+	expect(t, httpConn, body, "CONNECTED")
+	expect(t, tcp, tcp, "CONNECTED")
+
+	// Chunked request body to the TCP client
+	fmt.Fprintf(httpConn, "5\r\nhello\r\n")
+	expect(t, tcp, tcp, "hello")
+
+	// TCP data to the chunked response
+	tcp.Write([]byte("world"))
+	expect(t, httpConn, body, "world")
+
+	// Ending the request body closes the session and the response
+	fmt.Fprintf(httpConn, "0\r\n\r\n")
+	httpConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadAll(body); err != nil {
+		t.Fatalf("response didn't end cleanly: %v", err)
+	}
+}
+
+func TestRelayHTTPClientRejected(t *testing.T) {
+	rs, _ := newTestRelay(&RelayConfig{IdleTimeout: time.Minute})
+	addr := listenTCP(t, rs)
+	server := httptest.NewServer(http.HandlerFunc(rs.handleHTTPRequest))
+	defer server.Close()
+
+	host := dialSession(t, addr, "full\x00H", "")
+	expect(t, host, host, "WAITING")
+
+	// A second host is rejected, and its connection closed
+	httpConn, body := httpRelayClient(t, server, "session=full&role=host")
+	httpConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	got, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatalf("rejected connection wasn't closed: %v", err)
+	}
+	if string(got) != "ROLE_TAKEN" {
+		t.Fatalf("got %q, want ROLE_TAKEN", got)
+	}
+
+	guest := dialSession(t, addr, "full\x00G", "")
+	expect(t, guest, guest, "CONNECTED")
+
+	// So is a client of a full session
+	httpConn, body = httpRelayClient(t, server, "session=full")
+	httpConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	got, err = io.ReadAll(body)
+	if err != nil {
+		t.Fatalf("rejected connection wasn't closed: %v", err)
+	}
+	if string(got) != "SESSION_FULL" {
+		t.Fatalf("got %q, want SESSION_FULL", got)
+	}
+}
+
+// testIPSessions returns the sessions counted for ip
+func (rs *RelayServer) testIPSessions(ip string) int {
+	rs.sessionsMu.RLock()
+	defer rs.sessionsMu.RUnlock()
+	return rs.ipSessions[ip]
+}
+
+func TestRelayMaxSessionsPerIP(t *testing.T) {
+	rs, _ := newTestRelay(&RelayConfig{IdleTimeout: time.Minute, MaxSessionsPerIP: 2})
+	addr := listenTCP(t, rs)
+
+	first := dialSession(t, addr, "a", "127.0.0.1")
+	expect(t, first, first, "WAITING")
+	second := dialSession(t, addr, "b", "127.0.0.1")
+	expect(t, second, second, "WAITING")
+
+	// The limit+1th session from the same IP is refused
+	third := dialSession(t, addr, "c", "127.0.0.1")
+	expect(t, third, third, "SESSION_LIMIT")
+
+	// A peer from the same IP joins its session, which still counts once
+	peer := dialSession(t, addr, "a", "127.0.0.1")
+	expect(t, peer, peer, "CONNECTED")
+	expect(t, first, first, "CONNECTED")
+	if n := rs.testIPSessions("127.0.0.1"); n != 2 {
+		t.Fatalf("127.0.0.1 counted in %d sessions, want 2", n)
+	}
+	third = dialSession(t, addr, "c", "127.0.0.1")
+	expect(t, third, third, "SESSION_LIMIT")
+
+	// Other IPs aren't affected
+	other := dialSession(t, addr, "b", "127.0.0.2")
+	expect(t, other, other, "CONNECTED")
+
+	// Ending a session frees a slot
+	first.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for rs.testIPSessions("127.0.0.1") != 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	third = dialSession(t, addr, "c", "127.0.0.1")
+	expect(t, third, third, "WAITING")
+}
+
+// newSession reserves a session ID on server, returning it and the status
+func newSession(t *testing.T, server *httptest.Server) (string, int) {
+	t.Helper()
+	response, err := http.Get(server.URL + "/new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	body, _ := io.ReadAll(response.Body)
+	return strings.TrimSpace(string(body)), response.StatusCode
+}
+
+func TestRelayMaxSessionsPerIPReservations(t *testing.T) {
+	rs, _ := newTestRelay(&RelayConfig{IdleTimeout: time.Minute, MaxSessionsPerIP: 2})
+	addr := listenTCP(t, rs)
+	server := httptest.NewServer(http.HandlerFunc(rs.handleHTTPRequest))
+	defer server.Close()
+
+	first, status := newSession(t, server)
+	if status != http.StatusOK {
+		t.Fatalf("got status %d reserving the first session", status)
+	}
+	second, status := newSession(t, server)
+	if status != http.StatusOK {
+		t.Fatalf("got status %d reserving the second session", status)
+	}
+
+	// The limit+1th reservation from the same IP is refused
+	if body, status := newSession(t, server); status != http.StatusTooManyRequests || body != "SESSION_LIMIT" {
+		t.Fatalf("got status %d and %q, want %d and SESSION_LIMIT", status, body, http.StatusTooManyRequests)
+	}
+
+	// Joining a reservation from the IP that made it still counts once
+	client := dialSession(t, addr, first, "127.0.0.1")
+	expect(t, client, client, "WAITING")
+	if n := rs.testIPSessions("127.0.0.1"); n != 2 {
+		t.Fatalf("127.0.0.1 counted in %d sessions, want 2", n)
+	}
+	third := dialSession(t, addr, "c", "127.0.0.1")
+	expect(t, third, third, "SESSION_LIMIT")
+
+	// A reservation that expires frees its slot
+	rs.closeSession(second, CLOSE_IDLE)
+	if n := rs.testIPSessions("127.0.0.1"); n != 1 {
+		t.Fatalf("127.0.0.1 counted in %d sessions, want 1", n)
+	}
+	if _, status := newSession(t, server); status != http.StatusOK {
+		t.Fatalf("got status %d once a reservation expired", status)
+	}
+}
+
+func TestRelayStalledReader(t *testing.T) {
+	rs, records := newTestRelay(&RelayConfig{IdleTimeout: 200 * time.Millisecond})
+
+	// The sender writes to src; nobody ever reads what reaches dst
+	sender, src := net.Pipe()
+	dst, stalled := net.Pipe()
+	defer sender.Close()
+	defer stalled.Close()
+
+	session := newRelaySession("stalled")
+	session.Clients[0] = newRelayClient(src, ROLE_NONE)
+	session.Clients[1] = newRelayClient(dst, ROLE_NONE)
+	rs.sessions[session.ID] = session
+
+	done := make(chan struct{})
+	go func() {
+		rs.copyData(src, session.Clients[1], session)
+		close(done)
+	}()
+
+	// The relay takes data only while its buffer has room
+	written := 0
+	chunk := make([]byte, RELAY_CHUNK_SIZE)
+	for {
+		sender.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+		n, err := sender.Write(chunk)
+		written += n
+		if err != nil {
+			break
+		}
+	}
+	if limit := (RELAY_BUFFER_CHUNKS + 2) * RELAY_CHUNK_SIZE; written > limit {
+		t.Fatalf("relay took %d bytes from the sender, want at most %d", written, limit)
+	}
+
+	records.waitForReason(t, CLOSE_STALLED, 2*time.Second)
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("copyData didn't return after the session closed")
+	}
+}
+
+func TestRelayHandshakeTimeout(t *testing.T) {
+	rs, _ := newTestRelay(&RelayConfig{IdleTimeout: time.Minute, HandshakeTimeout: 100 * time.Millisecond})
+	addr := listenTCP(t, rs)
+
+	// A client that connects and sends nothing is dropped
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("got %v, want the relay to close the connection", err)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Fatalf("closed after %v, before the handshake timeout", elapsed)
+	}
+
+	// One that sends its session ID in time is kept
+	client := dialSession(t, addr, "in-time", "")
+	expect(t, client, client, "WAITING")
+}
+
+// benchmarkChunks takes and returns a relay buffer per read, as copyData does
+func benchmarkChunks(b *testing.B, pool bool) {
+	rs := NewRelayServer(&RelayConfig{BufferPool: pool})
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			chunk := rs.getChunk()
+			chunk[0] = 1
+			rs.putChunk(chunk[:1])
+		}
+	})
+}
+
+func BenchmarkRelayChunks(b *testing.B)     { benchmarkChunks(b, false) }
+func BenchmarkRelayChunksPool(b *testing.B) { benchmarkChunks(b, true) }
+
+func TestRelayLifetimeExceeded(t *testing.T) {
+	rs, records := newTestRelay(&RelayConfig{IdleTimeout: time.Minute, MaxLifetime: 300 * time.Millisecond})
+	addr := listenTCP(t, rs)
+	go rs.cleanupSessions()
+
+	host := dialSession(t, addr, "life\x00H", "")
+	expect(t, host, host, "WAITING")
+	guest := dialSession(t, addr, "life\x00G", "")
+	expect(t, guest, guest, "CONNECTED")
+	expect(t, host, host, "CONNECTED")
+
+	// The guest stops reading while the host keeps sending, so the relay
+	// is stuck writing to the guest when the session expires
+	go func() {
+		chunk := make([]byte, RELAY_CHUNK_SIZE)
+		for {
+			if _, err := host.Write(chunk); err != nil {
+				return
+			}
+		}
+	}()
+
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		rs.sessionsMu.RLock()
+		session := rs.sessions["life"]
+		rs.sessionsMu.RUnlock()
+		if session == nil || session.expiring.Load() {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("session didn't expire")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Notifying the stalled guest doesn't hold up other clients
+	start := time.Now()
+	other := dialSession(t, addr, "other", "")
+	expect(t, other, other, "WAITING")
+	if elapsed := time.Since(start); elapsed > NOTICE_TIMEOUT/2 {
+		t.Fatalf("new session took %v while the expired one was notified", elapsed)
+	}
+
+	expect(t, host, host, "LIFETIME_EXCEEDED")
+	records.waitForReason(t, CLOSE_LIFETIME, 3*time.Second)
+}
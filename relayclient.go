@@ -0,0 +1,275 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Relay client defaults
+const (
+	DEFAULT_RELAY         = "relay.apisbr.dev" // Public relay server
+	DEFAULT_RELAY_PORT    = "42421"            // TCP port of the relay server
+	DEFAULT_RELAY_RETRIES = 5                  // Attempts to rejoin a dropped session
+)
+
+// Relay handshake replies
+const (
+	RELAY_WAITING       = "WAITING"
+	RELAY_CONNECTED     = "CONNECTED"
+	RELAY_SESSION_FULL  = "SESSION_FULL"
+	RELAY_TIMEOUT       = "TIMEOUT"
+	RELAY_ROLE_TAKEN    = "ROLE_TAKEN"
+	RELAY_SESSION_LIMIT = "SESSION_LIMIT"
+)
+
+// Relay client roles, sent after a NUL byte in the handshake
+var relayRoles = map[string]byte{
+	"host":  'H',
+	"guest": 'G',
+}
+
+// RelayClient is a connection to a peer through the relay server. It
+// implements net.Conn so it can stand in for a direct TCP connection, and
+// transparently rejoins the same session when the relayed connection drops.
+type RelayClient struct {
+	config  *Config    // Application configuration
+	addr    string     // Relay server address (host:port)
+	session string     // Session ID shared with the peer
+	conn    net.Conn   // Current connection to the relay
+	closed  bool       // Whether Close was called
+	mutex   sync.Mutex // Protects conn and closed
+	rejoin  sync.Mutex // Serializes reconnects
+}
+
+// NewRelayClient joins the configured relay session and waits for the peer
+func NewRelayClient(config *Config) (*RelayClient, error) {
+	rc := &RelayClient{
+		config:  config,
+		addr:    relayAddress(config.relayAddr),
+		session: config.session,
+	}
+
+	err := retryConnect(config, config.connectRetries, "Joining relay session "+redactSession(rc.session), func() error {
+		conn, err := rc.join()
+		if err != nil {
+			return err
+		}
+		rc.conn = conn
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to join relay session: %v", err)
+	}
+
+	return rc, nil
+}
+
+// join connects to the relay and performs the session handshake, returning
+// once the peer is connected
+func (rc *RelayClient) join() (net.Conn, error) {
+	conn, err := newDialer(rc.config).Dial("tcp", rc.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	handshake := []byte(rc.session)
+	if role, ok := relayRoles[rc.config.relayRole]; ok {
+		handshake = append(handshake, 0, role)
+	}
+
+	if _, err := conn.Write(handshake); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	for {
+		reply, err := readRelayReply(conn)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		switch reply {
+		case RELAY_WAITING:
+			fmt.Fprintf(os.Stderr, "Relay: Waiting for peer in session %s\n", redactSession(rc.session))
+		case RELAY_CONNECTED:
+			fmt.Fprintf(os.Stderr, "Relay: Connected to peer in session %s via %s\n", redactSession(rc.session), rc.addr)
+			return conn, nil
+		case RELAY_SESSION_FULL:
+			conn.Close()
+			return nil, fmt.Errorf("session %s is full", redactSession(rc.session))
+		case RELAY_TIMEOUT:
+			conn.Close()
+			return nil, fmt.Errorf("timed out waiting for a peer in session %s", redactSession(rc.session))
+		case RELAY_ROLE_TAKEN:
+			conn.Close()
+			return nil, fmt.Errorf("session %s already has a %s", redactSession(rc.session), rc.config.relayRole)
+		case RELAY_SESSION_LIMIT:
+			conn.Close()
+			return nil, fmt.Errorf("relay refused session %s: too many sessions from this address", redactSession(rc.session))
+		}
+	}
+}
+
+// redactSession hides most of a session ID in log output, since knowing it
+// is enough to join the session. The first characters are kept so sessions
+// can still be told apart.
+func redactSession(session string) string {
+	if session == "" {
+		return ""
+	}
+	if len(session) <= 8 {
+		return "****"
+	}
+	return session[:4] + "****"
+}
+
+// readRelayReply reads one handshake reply. Replies aren't delimited, so
+// they are read a byte at a time to avoid consuming the peer's data.
+func readRelayReply(conn net.Conn) (string, error) {
+	replies := []string{RELAY_WAITING, RELAY_CONNECTED, RELAY_SESSION_FULL, RELAY_TIMEOUT, RELAY_ROLE_TAKEN, RELAY_SESSION_LIMIT}
+
+	var reply []byte
+	buffer := make([]byte, 1)
+	for {
+		if _, err := conn.Read(buffer); err != nil {
+			return "", fmt.Errorf("relay handshake failed: %v", err)
+		}
+		reply = append(reply, buffer[0])
+
+		prefix := false
+		for _, candidate := range replies {
+			if string(reply) == candidate {
+				return candidate, nil
+			}
+			if strings.HasPrefix(candidate, string(reply)) {
+				prefix = true
+			}
+		}
+		if !prefix {
+			return "", fmt.Errorf("unexpected reply from relay: %q", reply)
+		}
+	}
+}
+
+// current returns the active relay connection
+func (rc *RelayClient) current() net.Conn {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+
+	return rc.conn
+}
+
+// reconnect rejoins the session after the failed connection broke, with
+// backoff. If another goroutine already replaced it, it returns right away.
+func (rc *RelayClient) reconnect(failed net.Conn) error {
+	rc.rejoin.Lock()
+	defer rc.rejoin.Unlock()
+
+	rc.mutex.Lock()
+	closed, replaced := rc.closed, rc.conn != failed
+	rc.mutex.Unlock()
+
+	if closed {
+		return net.ErrClosed
+	}
+	if replaced {
+		return nil
+	}
+
+	failed.Close()
+	fmt.Fprintf(os.Stderr, "Relay: Session %s dropped, rejoining\n", redactSession(rc.session))
+
+	return retryConnect(rc.config, rc.config.relayRetries, "Rejoining relay session "+redactSession(rc.session), func() error {
+		conn, err := rc.join()
+		if err != nil {
+			return err
+		}
+
+		rc.mutex.Lock()
+		defer rc.mutex.Unlock()
+
+		// Close was called while the session was being rejoined
+		if rc.closed {
+			conn.Close()
+			return nil
+		}
+		rc.conn = conn
+		return nil
+	})
+}
+
+// Read reads from the peer, rejoining the session if the connection drops
+func (rc *RelayClient) Read(b []byte) (int, error) {
+	for {
+		conn := rc.current()
+		n, err := conn.Read(b)
+		if err == nil || n > 0 {
+			return n, nil
+		}
+
+		if rerr := rc.reconnect(conn); rerr != nil {
+			return 0, err
+		}
+	}
+}
+
+// Write sends to the peer, rejoining the session if the connection drops.
+// After rejoining, only the bytes that weren't written yet are sent.
+func (rc *RelayClient) Write(b []byte) (int, error) {
+	written := 0
+	for {
+		conn := rc.current()
+		n, err := conn.Write(b[written:])
+		written += n
+		if err == nil {
+			return written, nil
+		}
+
+		if rerr := rc.reconnect(conn); rerr != nil {
+			return written, err
+		}
+	}
+}
+
+// Close closes the relay connection and stops reconnecting. It is safe to
+// call more than once.
+func (rc *RelayClient) Close() error {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+
+	if rc.closed {
+		return nil
+	}
+	rc.closed = true
+	return rc.conn.Close()
+}
+
+// LocalAddr returns the local address of the relay connection
+func (rc *RelayClient) LocalAddr() net.Addr {
+	return rc.current().LocalAddr()
+}
+
+// RemoteAddr returns the address of the relay server
+func (rc *RelayClient) RemoteAddr() net.Addr {
+	return rc.current().RemoteAddr()
+}
+
+// SetDeadline sets the deadlines of the current relay connection
+func (rc *RelayClient) SetDeadline(t time.Time) error {
+	return rc.current().SetDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline of the current relay connection
+func (rc *RelayClient) SetReadDeadline(t time.Time) error {
+	return rc.current().SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the write deadline of the current relay connection
+func (rc *RelayClient) SetWriteDeadline(t time.Time) error {
+	return rc.current().SetWriteDeadline(t)
+}
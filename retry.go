@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// Connection retry defaults
+const (
+	DEFAULT_CONNECT_BACKOFF = 500 * time.Millisecond // Delay before the first retry
+	MAX_CONNECT_BACKOFF     = 30 * time.Second       // Upper bound for the delay between retries
+)
+
+// debugf prints a message to stderr when --debug is enabled
+func (config *Config) debugf(format string, args ...interface{}) {
+	if config.debug {
+		fmt.Fprintf(os.Stderr, "Debug: "+format+"\n", args...)
+	}
+}
+
+// retryConnect calls connect until it succeeds or the given number of retries
+// have failed, doubling the delay between attempts starting at
+// --connect-backoff. It returns the last error.
+func retryConnect(config *Config, retries int, what string, connect func() error) error {
+	backoff := config.connectBackoff
+	attempts := retries + 1
+
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		config.debugf("%s: attempt %d of %d", what, attempt, attempts)
+
+		if err = connect(); err == nil {
+			return nil
+		}
+
+		if attempt < attempts {
+			config.debugf("%s failed: %v, retrying in %v", what, err, backoff)
+			time.Sleep(backoff)
+
+			backoff *= 2
+			if backoff > MAX_CONNECT_BACKOFF {
+				backoff = MAX_CONNECT_BACKOFF
+			}
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// hostPort builds the address of host and port. IPv6 literals may be
+// given with or without brackets, e.g. ::1 or [::1].
+func hostPort(host string, port int) string {
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		host = host[1 : len(host)-1]
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// relayAddress returns the address of the --relay server, adding the
+// default port when addr has none
+func relayAddress(addr string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+	port, _ := strconv.Atoi(DEFAULT_RELAY_PORT)
+	return hostPort(addr, port)
+}
+
+// socketControl returns the function that applies --reuseport and
+// --bind-device to sockets before they are bound, or nil when neither is set
+func socketControl(config *Config) func(network, address string, c syscall.RawConn) error {
+	if !config.reusePort && config.bindDevice == "" {
+		return nil
+	}
+
+	return func(network, address string, c syscall.RawConn) error {
+		if config.reusePort {
+			if err := reusePortControl(network, address, c); err != nil {
+				return err
+			}
+		}
+		if config.bindDevice != "" {
+			return bindToDevice(c, config.bindDevice)
+		}
+		return nil
+	}
+}
+
+// listenConfig returns the ListenConfig used for listening sockets
+func listenConfig(config *Config) *net.ListenConfig {
+	return &net.ListenConfig{Control: socketControl(config)}
+}
+
+// newDialer returns the Dialer used for outgoing TCP connections
+func newDialer(config *Config) *net.Dialer {
+	return &net.Dialer{Control: fastOpenControl(config, socketControl(config), fastOpenDialControl)}
+}
+
+// fastOpenControl adds the --tfo socket option to control. Where TCP Fast
+// Open can't be enabled, the socket keeps the normal handshake.
+func fastOpenControl(config *Config, control func(string, string, syscall.RawConn) error, fastOpen func(syscall.RawConn) error) func(string, string, syscall.RawConn) error {
+	if !config.tfo {
+		return control
+	}
+
+	return func(network, address string, c syscall.RawConn) error {
+		if control != nil {
+			if err := control(network, address, c); err != nil {
+				return err
+			}
+		}
+		if err := fastOpen(c); err != nil {
+			config.debugf("TCP Fast Open not enabled, using the normal handshake: %v", err)
+		}
+		return nil
+	}
+}
+
+// listenTCP opens the receiver's TCP listener on addr, with the --backlog
+// length of pending connections and --tfo if set
+func listenTCP(config *Config, addr string) (net.Listener, error) {
+	lc := listenConfig(config)
+	lc.Control = fastOpenControl(config, lc.Control, fastOpenListenControl)
+
+	listener, err := lc.Listen(context.Background(), "tcp", addr)
+	if err != nil || config.backlog <= 0 {
+		return listener, err
+	}
+
+	// Keep the system default where the backlog can't be changed
+	if err := setListenBacklog(listener, config.backlog); err != nil {
+		config.debugf("Failed to set the listen backlog to %d: %v", config.backlog, err)
+	}
+	return listener, nil
+}
+
+// listenUDP opens a UDP socket on addr
+func listenUDP(config *Config, addr *net.UDPAddr) (*net.UDPConn, error) {
+	if socketControl(config) == nil {
+		return net.ListenUDP("udp", addr)
+	}
+
+	conn, err := listenConfig(config).ListenPacket(context.Background(), "udp", addr.String())
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
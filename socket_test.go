@@ -0,0 +1,150 @@
+package main
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// skipWithoutIPv6 skips tests that need an IPv6 loopback address
+func skipWithoutIPv6(t *testing.T) {
+	t.Helper()
+	listener, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 loopback unavailable: %v", err)
+	}
+	listener.Close()
+}
+
+func TestHostPort(t *testing.T) {
+	tests := []struct {
+		host string
+		port int
+		want string
+	}{
+		{"127.0.0.1", 9000, "127.0.0.1:9000"},
+		{"localhost", 9000, "localhost:9000"},
+		{"", 9000, ":9000"},
+		{"0.0.0.0", 80, "0.0.0.0:80"},
+		{"::", 9000, "[::]:9000"},
+		{"::1", 9000, "[::1]:9000"},
+		{"[::1]", 9000, "[::1]:9000"},
+		{"fe80::1%eth0", 9000, "[fe80::1%eth0]:9000"},
+		{"[fe80::1%eth0]", 9000, "[fe80::1%eth0]:9000"},
+	}
+
+	for _, test := range tests {
+		got := hostPort(test.host, test.port)
+		if got != test.want {
+			t.Errorf("hostPort(%q, %d) = %q, want %q", test.host, test.port, got, test.want)
+			continue
+		}
+		if _, _, err := net.SplitHostPort(got); err != nil {
+			t.Errorf("hostPort(%q, %d) = %q, which doesn't parse: %v", test.host, test.port, got, err)
+		}
+	}
+}
+
+func TestRelayAddress(t *testing.T) {
+	tests := []struct {
+		addr string
+		want string
+	}{
+		{"relay.example.com", "relay.example.com:" + DEFAULT_RELAY_PORT},
+		{"relay.example.com:9000", "relay.example.com:9000"},
+		{"10.0.0.1", "10.0.0.1:" + DEFAULT_RELAY_PORT},
+		{"::1", "[::1]:" + DEFAULT_RELAY_PORT},
+		{"[::1]", "[::1]:" + DEFAULT_RELAY_PORT},
+		{"[::1]:9000", "[::1]:9000"},
+	}
+
+	for _, test := range tests {
+		if got := relayAddress(test.addr); got != test.want {
+			t.Errorf("relayAddress(%q) = %q, want %q", test.addr, got, test.want)
+		}
+	}
+}
+
+func TestIPv6TCPRoundTrip(t *testing.T) {
+	skipWithoutIPv6(t)
+	config := &Config{}
+
+	listener, err := listenTCP(config, hostPort("::1", 0))
+	if err != nil {
+		t.Fatalf("listening on %s: %v", hostPort("::1", 0), err)
+	}
+	defer listener.Close()
+
+	port := listener.Addr().(*net.TCPAddr).Port
+	addr := hostPort("[::1]", port)
+	if want := net.JoinHostPort("::1", strconv.Itoa(port)); addr != want {
+		t.Fatalf("hostPort gave %q, want %q", addr, want)
+	}
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- conn
+	}()
+
+	conn, err := newDialer(config).Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dialing %s: %v", addr, err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	server, ok := <-accepted
+	if !ok {
+		t.Fatal("listener didn't accept the connection")
+	}
+	defer server.Close()
+	server.SetReadDeadline(time.Now().Add(2 * time.Second))
+	got := make([]byte, 5)
+	if _, err := io.ReadFull(server, got); err != nil || string(got) != "hello" {
+		t.Fatalf("got %q, %v, want \"hello\"", got, err)
+	}
+}
+
+func TestIPv6UDPRoundTrip(t *testing.T) {
+	skipWithoutIPv6(t)
+	config := &Config{}
+
+	local, err := net.ResolveUDPAddr("udp", hostPort("::1", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver, err := listenUDP(config, local)
+	if err != nil {
+		t.Fatalf("listening on %s: %v", local, err)
+	}
+	defer receiver.Close()
+
+	addr := hostPort("::1", receiver.LocalAddr().(*net.UDPAddr).Port)
+	sender, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("dialing %s: %v", addr, err)
+	}
+	defer sender.Close()
+	if _, err := sender.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	receiver.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buffer := make([]byte, 16)
+	n, from, err := receiver.ReadFromUDP(buffer)
+	if err != nil || string(buffer[:n]) != "hello" {
+		t.Fatalf("got %q, %v, want \"hello\"", buffer[:n], err)
+	}
+	if !from.IP.Equal(net.IPv6loopback) {
+		t.Errorf("datagram came from %s, want ::1", from)
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// STATS_TOP_TALKERS is the number of connections listed in each summary
+const STATS_TOP_TALKERS = 5
+
+// startMonitoring starts the web interface and the periodic stats summary
+// as configured. It runs before the pipe is created so the interface is
+// reachable even if the pipe fails to start. It returns the server recording
+// the traffic, which is always created so the exit summary has statistics.
+// If the web interface can't start, np continues without it unless
+// --web-required is set.
+func startMonitoring(config *Config) (*WebUIServer, error) {
+	var web *WebUIServer
+
+	if config.webUI {
+		webConfig := &WebUIConfig{
+			Address: config.webUIBind,
+			Port:    config.webUIPort,
+			Enabled: true,
+		}
+
+		var err error
+		web, err = StartWebUI(webConfig, config)
+		if err != nil {
+			if config.webRequired {
+				return nil, err
+			}
+			fmt.Fprintf(os.Stderr, "Warning: %v, continuing without it\n", err)
+			config.webUI = false
+		}
+	}
+
+	if web == nil {
+		// Record statistics without serving them over HTTP
+		web = NewWebUIServer(config)
+	}
+
+	if config.statsInterval > 0 {
+		go web.reportStats(config.statsInterval)
+	}
+
+	// UDP sources are tracked as connections that never close
+	udpReceiver := config.mode == "receiver" && !config.useTCP && config.session == ""
+	if udpReceiver && config.udpIdleTimeout > 0 {
+		go web.reapIdleConnections(config.udpIdleTimeout)
+	}
+
+	return web, nil
+}
+
+// reapIdleConnections removes the connections that were idle for longer
+// than timeout, checking a few times per timeout, so a UDP receiver seeing
+// many short-lived sources doesn't keep them all
+func (ws *WebUIServer) reapIdleConnections(timeout time.Duration) {
+	interval := timeout / 4
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		ws.stats.mu.Lock()
+		kept := ws.stats.Connections[:0]
+		for _, conn := range ws.stats.Connections {
+			if now.Sub(conn.LastActive) < timeout {
+				kept = append(kept, conn)
+				continue
+			}
+			delete(ws.stats.byAddr, conn.RemoteAddr)
+			ws.config.debugf("Removed %s from the connections after %v idle", conn.RemoteAddr, timeout)
+		}
+		removed := len(ws.stats.Connections) - len(kept)
+		for i := len(kept); i < len(ws.stats.Connections); i++ {
+			ws.stats.Connections[i] = nil
+		}
+		ws.stats.Connections = kept
+		if removed > 0 {
+			ws.publishStatsLocked()
+		}
+		ws.stats.mu.Unlock()
+	}
+}
+
+// reportStats prints a summary of the recorded statistics to stderr every interval
+func (ws *WebUIServer) reportStats(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var lastTotal uint64
+	lastTime := time.Now()
+
+	for now := range ticker.C {
+		total := ws.stats.BytesSent.Load() + ws.stats.BytesReceived.Load()
+
+		ws.stats.mu.RLock()
+		uptime := now.Sub(ws.stats.StartTime).Round(time.Second)
+		connections := ws.stats.snapshotLocked()
+		ws.stats.mu.RUnlock()
+
+		throughput := float64(total-lastTotal) / now.Sub(lastTime).Seconds()
+		lastTotal, lastTime = total, now
+
+		// Busiest connections first
+		sort.Slice(connections, func(i, j int) bool {
+			return connections[i].BytesIn+connections[i].BytesOut > connections[j].BytesIn+connections[j].BytesOut
+		})
+		if len(connections) > STATS_TOP_TALKERS {
+			connections = connections[:STATS_TOP_TALKERS]
+		}
+
+		fmt.Fprintf(os.Stderr, "Stats: uptime %v, %s total, %s/s", uptime, formatBytes(total), formatBytes(uint64(throughput)))
+		if duplicates := ws.stats.Duplicates.Load(); duplicates > 0 {
+			fmt.Fprintf(os.Stderr, ", %d duplicates dropped", duplicates)
+		}
+		if corrupt := ws.stats.Corrupt.Load(); corrupt > 0 {
+			fmt.Fprintf(os.Stderr, ", %d corrupt datagrams dropped", corrupt)
+		}
+		if incomplete := ws.stats.Incomplete.Load(); incomplete > 0 {
+			fmt.Fprintf(os.Stderr, ", %d incomplete messages dropped", incomplete)
+		}
+		if unacked := ws.stats.Unacked.Load(); unacked > 0 {
+			fmt.Fprintf(os.Stderr, ", %d datagrams unacknowledged", unacked)
+		}
+		fmt.Fprintf(os.Stderr, "\n")
+		for _, conn := range connections {
+			fmt.Fprintf(os.Stderr, "  %-40s in %-10s out %s\n", conn.RemoteAddr, formatBytes(conn.BytesIn), formatBytes(conn.BytesOut))
+		}
+	}
+}
+
+// printSummary prints the totals of the transfer to stderr when np exits
+func (ws *WebUIServer) printSummary() {
+	sent, received := ws.stats.BytesSent.Load(), ws.stats.BytesReceived.Load()
+	duration := time.Since(ws.stats.StartTime)
+
+	throughput := float64(sent+received) / duration.Seconds()
+	fmt.Fprintf(os.Stderr, "Summary: sent %s, received %s in %v (%s/s)\n",
+		formatBytes(sent), formatBytes(received), duration.Round(time.Millisecond), formatBytes(uint64(throughput)))
+
+	if duplicates := ws.stats.Duplicates.Load(); duplicates > 0 {
+		fmt.Fprintf(os.Stderr, "Dropped %d duplicate datagrams\n", duplicates)
+	}
+	if corrupt := ws.stats.Corrupt.Load(); corrupt > 0 {
+		fmt.Fprintf(os.Stderr, "Dropped %d datagrams that failed the checksum\n", corrupt)
+	}
+	if incomplete := ws.stats.Incomplete.Load(); incomplete > 0 {
+		fmt.Fprintf(os.Stderr, "Dropped %d chunked messages missing chunks\n", incomplete)
+	}
+	if unacked := ws.stats.Unacked.Load(); unacked > 0 {
+		fmt.Fprintf(os.Stderr, "Gave up on %d datagrams never acknowledged\n", unacked)
+	}
+}
+
+// RecordDuplicate counts a datagram dropped by --dedup. It is always
+// counted, like the byte totals, so the summary can report it.
+func (ws *WebUIServer) RecordDuplicate() {
+	ws.stats.Duplicates.Add(1)
+}
+
+// RecordChecksumError counts a datagram dropped by --checksum. Like
+// duplicates, it is always counted.
+func (ws *WebUIServer) RecordChecksumError() {
+	ws.stats.Corrupt.Add(1)
+}
+
+// RecordIncomplete counts a chunked message dropped because some of its
+// chunks never arrived. Like duplicates, it is always counted.
+func (ws *WebUIServer) RecordIncomplete() {
+	ws.stats.Incomplete.Add(1)
+}
+
+// RecordUnacked counts a datagram the receiver never acknowledged within
+// --ack-retries. Like duplicates, it is always counted.
+func (ws *WebUIServer) RecordUnacked() {
+	ws.stats.Unacked.Add(1)
+}
+
+// formatBytes renders a byte count with a binary unit suffix
+func formatBytes(bytes uint64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+
+	div, exp := uint64(unit), 0
+	for n := bytes / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(bytes)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Event stream defaults
+const (
+	STREAM_BUFFER_SIZE    = 64               // Pending events per subscriber before events are dropped
+	STREAM_KEEPALIVE_TIME = 15 * time.Second // Interval between keep-alive comments
+)
+
+// StreamEvent is a single Server-Sent Event published to subscribers
+type StreamEvent struct {
+	Type string      // Event name: "message", "connection" or "stats"
+	Data interface{} // Payload, encoded as JSON
+}
+
+// EventBroker fans out events to the connected /api/stream clients
+type EventBroker struct {
+	subscribers map[chan StreamEvent]struct{} // Channels of the connected clients
+	mutex       sync.Mutex                    // Mutex for thread-safe subscriber access
+}
+
+// NewEventBroker creates an event broker without subscribers
+func NewEventBroker() *EventBroker {
+	return &EventBroker{
+		subscribers: make(map[chan StreamEvent]struct{}),
+	}
+}
+
+// Subscribe registers a new client and returns the channel its events arrive on
+func (eb *EventBroker) Subscribe() chan StreamEvent {
+	ch := make(chan StreamEvent, STREAM_BUFFER_SIZE)
+
+	eb.mutex.Lock()
+	eb.subscribers[ch] = struct{}{}
+	eb.mutex.Unlock()
+
+	return ch
+}
+
+// Unsubscribe removes a client so its channel can be garbage collected
+func (eb *EventBroker) Unsubscribe(ch chan StreamEvent) {
+	eb.mutex.Lock()
+	delete(eb.subscribers, ch)
+	eb.mutex.Unlock()
+}
+
+// Len returns the number of subscribers
+func (eb *EventBroker) Len() int {
+	eb.mutex.Lock()
+	defer eb.mutex.Unlock()
+
+	return len(eb.subscribers)
+}
+
+// Publish sends an event to every subscriber. Slow clients miss events
+// instead of blocking the data path.
+func (eb *EventBroker) Publish(eventType string, data interface{}) {
+	eb.mutex.Lock()
+	defer eb.mutex.Unlock()
+
+	event := StreamEvent{Type: eventType, Data: data}
+	for ch := range eb.subscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// handleStream serves recorded events as Server-Sent Events until the client disconnects
+func (ws *WebUIServer) handleStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	events := ws.events.Subscribe()
+	defer ws.events.Unsubscribe(events)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(STREAM_KEEPALIVE_TIME)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case event := <-events:
+			data, err := json.Marshal(event.Data)
+			if err != nil {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// streamCompressions lists the algorithms accepted by --stream-compress
+var streamCompressions = []string{"gzip", "zstd"}
+
+// validStreamCompression reports whether algorithm can be given to
+// --stream-compress, where empty disables it
+func validStreamCompression(algorithm string) bool {
+	if algorithm == "" {
+		return true
+	}
+	for _, name := range streamCompressions {
+		if algorithm == name {
+			return true
+		}
+	}
+	return false
+}
+
+// streamCompressor compresses everything a sender writes on a connection
+// as a single stream, so repeated data across chunks compresses well
+type streamCompressor interface {
+	io.Writer
+	Flush() error
+	Close() error
+}
+
+// newStreamCompressor starts a compressed stream of the given algorithm
+// on w, which must be gzip or zstd
+func newStreamCompressor(algorithm string, w io.Writer) (streamCompressor, error) {
+	switch algorithm {
+	case "gzip":
+		return gzip.NewWriter(w), nil
+	case "zstd":
+		return zstd.NewWriter(w)
+	default:
+		return nil, fmt.Errorf("unsupported stream compression: %s", algorithm)
+	}
+}
+
+// newStreamDecompressor reads the compressed stream of the given algorithm
+// from r. It returns a function that releases the decompressor.
+func newStreamDecompressor(algorithm string, r io.Reader) (io.Reader, func(), error) {
+	switch algorithm {
+	case "gzip":
+		reader, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		return reader, func() { reader.Close() }, nil
+	case "zstd":
+		decoder, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		return decoder, decoder.Close, nil
+	default:
+		return nil, nil, fmt.Errorf("unsupported stream compression: %s", algorithm)
+	}
+}
+
+// openClientStream reads the --label handshake, which is sent before the
+// compressed stream starts, and returns the decompressed stream from a
+// --stream-compress client
+func (pipe *TCPPipe) openClientStream(conn net.Conn, clientID string) (io.Reader, func(), error) {
+	reader := bufio.NewReader(conn)
+
+	prefix, _ := reader.Peek(len(LABEL_COMMAND))
+	if bytes.Equal(prefix, []byte(LABEL_COMMAND)) {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			return nil, nil, err
+		}
+		pipe.labelClient(clientID, line)
+	}
+
+	return newStreamDecompressor(pipe.config.streamCompress, reader)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Reasons reported as exitReason by --summary-json
+const (
+	EXIT_COMPLETED = "completed" // Input ended or --count was reached
+	EXIT_SIGNAL    = "signal"    // Interrupted by SIGINT or SIGTERM
+	EXIT_SHUTDOWN  = "shutdown"  // Shut down through the web interface
+	EXIT_ERROR     = "error"     // Failed to connect or transfer
+)
+
+// SummaryJSON is the machine-readable summary written by --summary-json.
+// Like /api/config, fields are only ever added.
+type SummaryJSON struct {
+	BytesSent       uint64  `json:"bytesSent"`
+	BytesReceived   uint64  `json:"bytesReceived"`
+	Connections     int     `json:"connections"`
+	DurationSeconds float64 `json:"durationSeconds"`
+	ExitReason      string  `json:"exitReason"`
+	Error           string  `json:"error,omitempty"`
+}
+
+// writeSummaryJSON writes the totals of the transfer to path when np exits.
+// err is the error that stopped np, if any.
+func (ws *WebUIServer) writeSummaryJSON(path, reason string, err error) {
+	if path == "" {
+		return
+	}
+
+	ws.stats.mu.RLock()
+	connections := len(ws.stats.Connections)
+	ws.stats.mu.RUnlock()
+
+	summary := SummaryJSON{
+		BytesSent:       ws.stats.BytesSent.Load(),
+		BytesReceived:   ws.stats.BytesReceived.Load(),
+		Connections:     connections,
+		DurationSeconds: time.Since(ws.stats.StartTime).Seconds(),
+		ExitReason:      reason,
+	}
+	if err != nil {
+		summary.Error = err.Error()
+	}
+
+	data, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to encode summary: %v\n", err)
+		return
+	}
+
+	// Replace the file atomically so whoever waits for it never reads half of it
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to write summary: %v\n", err)
+		return
+	}
+	_, err = tmp.Write(append(data, '\n'))
+	if syncErr := tmp.Sync(); err == nil {
+		err = syncErr
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		fmt.Fprintf(os.Stderr, "Warning: failed to write summary: %v\n", err)
+	}
+}
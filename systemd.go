@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+// SD_LISTEN_FDS_START is the first file descriptor passed by systemd socket activation
+const SD_LISTEN_FDS_START = 3
+
+// systemdSocket returns the first socket passed by systemd through
+// LISTEN_FDS and LISTEN_PID. The variables are unset so child processes
+// don't inherit them.
+func systemdSocket() (*os.File, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	if pid := os.Getenv("LISTEN_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return nil, fmt.Errorf("LISTEN_PID %s does not match this process", pid)
+	}
+
+	fds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || fds < 1 {
+		return nil, fmt.Errorf("no socket passed by systemd (LISTEN_FDS not set)")
+	}
+	if fds > 1 {
+		fmt.Fprintf(os.Stderr, "Warning: systemd passed %d sockets, using the first one\n", fds)
+	}
+
+	return os.NewFile(SD_LISTEN_FDS_START, "LISTEN_FD_"+strconv.Itoa(SD_LISTEN_FDS_START)), nil
+}
+
+// systemdListener returns the TCP listener inherited from systemd
+func systemdListener() (net.Listener, error) {
+	file, err := systemdSocket()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	listener, err := net.FileListener(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to use the systemd socket as a TCP listener: %v", err)
+	}
+	return listener, nil
+}
+
+// systemdPacketConn returns the UDP socket inherited from systemd
+func systemdPacketConn() (*net.UDPConn, error) {
+	file, err := systemdSocket()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	conn, err := net.FilePacketConn(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to use the systemd socket as a UDP socket: %v", err)
+	}
+
+	udpConn, ok := conn.(*net.UDPConn)
+	if !ok {
+		conn.Close()
+		return nil, fmt.Errorf("the systemd socket is not a UDP socket")
+	}
+	return udpConn, nil
+}
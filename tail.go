@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Live tail defaults
+const (
+	TAIL_MAX_CHUNK     = 64 * 1024       // Largest chunk sent to tail clients, longer ones are truncated
+	TAIL_WRITE_TIMEOUT = 5 * time.Second // Time a tail client has to accept a frame before it is disconnected
+)
+
+// WebSocket protocol constants (RFC 6455)
+const (
+	WEBSOCKET_GUID         = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	WEBSOCKET_OPCODE_BIN   = 0x2
+	WEBSOCKET_OPCODE_CLOSE = 0x8
+)
+
+// PublishTail sends a copy of received data to the /api/tail clients.
+// Nothing is copied when no client is connected.
+func (ws *WebUIServer) PublishTail(data []byte) {
+	if ws.config.webNoContent || ws.tail.Len() == 0 {
+		return
+	}
+
+	if len(data) > TAIL_MAX_CHUNK {
+		data = data[:TAIL_MAX_CHUNK]
+	}
+	chunk := make([]byte, len(data))
+	copy(chunk, data)
+
+	ws.tail.Publish("data", chunk)
+}
+
+// handleTail streams received data as binary WebSocket messages until the
+// client disconnects. Chunks are dropped when the client falls behind, and
+// a client that stops reading is disconnected, so it can't stall the pipe.
+func (ws *WebUIServer) handleTail(w http.ResponseWriter, r *http.Request) {
+	if ws.config.webNoContent {
+		http.Error(w, "Live data is disabled by --web-no-content", http.StatusForbidden)
+		return
+	}
+
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") || key == "" {
+		http.Error(w, "WebSocket upgrade required", http.StatusBadRequest)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "WebSocket not supported", http.StatusInternalServerError)
+		return
+	}
+
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		http.Error(w, "WebSocket upgrade failed", http.StatusInternalServerError)
+		return
+	}
+	defer conn.Close()
+
+	hash := sha1.Sum([]byte(key + WEBSOCKET_GUID))
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n",
+		base64.StdEncoding.EncodeToString(hash[:]))
+	if err := rw.Flush(); err != nil {
+		return
+	}
+
+	events := ws.tail.Subscribe()
+	defer ws.tail.Unsubscribe(events)
+
+	// Watch for the client closing the connection
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		readWebSocketUntilClose(rw.Reader)
+	}()
+
+	for {
+		select {
+		case <-closed:
+			return
+		case event := <-events:
+			conn.SetWriteDeadline(time.Now().Add(TAIL_WRITE_TIMEOUT))
+			if err := writeWebSocketFrame(conn, WEBSOCKET_OPCODE_BIN, event.Data.([]byte)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// writeWebSocketFrame writes a single unmasked frame, as sent by servers
+func writeWebSocketFrame(w io.Writer, opcode byte, payload []byte) error {
+	header := []byte{0x80 | opcode}
+
+	switch length := len(payload); {
+	case length < 126:
+		header = append(header, byte(length))
+	case length <= 0xFFFF:
+		header = append(header, 126)
+		header = binary.BigEndian.AppendUint16(header, uint16(length))
+	default:
+		header = append(header, 127)
+		header = binary.BigEndian.AppendUint64(header, uint64(length))
+	}
+
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+// readWebSocketUntilClose discards the frames sent by the client and
+// returns when it sends a close frame or the connection fails
+func readWebSocketUntilClose(r *bufio.Reader) {
+	header := make([]byte, 2)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return
+		}
+		if header[0]&0x0F == WEBSOCKET_OPCODE_CLOSE {
+			return
+		}
+
+		length := uint64(header[1] & 0x7F)
+		switch length {
+		case 126:
+			var extended [2]byte
+			if _, err := io.ReadFull(r, extended[:]); err != nil {
+				return
+			}
+			length = uint64(binary.BigEndian.Uint16(extended[:]))
+		case 127:
+			var extended [8]byte
+			if _, err := io.ReadFull(r, extended[:]); err != nil {
+				return
+			}
+			length = binary.BigEndian.Uint64(extended[:])
+		}
+
+		// Client frames carry a 4-byte masking key before the payload
+		if header[1]&0x80 != 0 {
+			length += 4
+		}
+		if _, err := io.CopyN(io.Discard, r, int64(length)); err != nil {
+			return
+		}
+	}
+}
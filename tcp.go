@@ -1,11 +1,14 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -20,32 +23,125 @@ type TCPPipe struct {
 	clientsMutex sync.RWMutex        // Mutex for thread-safe client map access
 	multiplexer  *MultiplexManager   // Optional multiplexing manager
 	discovery    *DiscoveryService   // Optional service discovery
+	input        io.Reader           // Source of data to send (stdin by default)
+	simulator    *NetworkSimulator   // Optional --drop-rate/--delay simulation of sent data
+	output       io.Writer           // Destination for received data (stdout by default)
+	chat         *ChatUI             // Optional interactive chat interface
+	web          *WebUIServer        // Optional web interface recording traffic
+	messages     *MessageAssembler   // Reassembles --transform messages, nil unless receivers undo the chain
+	received     atomic.Int64        // Messages written to the output, for --count
+	counted      chan struct{}       // Closed once --count messages were written
+	handlers     sync.WaitGroup      // Running client handlers (for receiver mode)
+	workers      chan struct{}       // Free slots for client handlers with --max-workers
+	drained      atomic.Bool         // Whether drain already ran
+	closeOnce    sync.Once           // Ensures the connections are only closed once
+	closeErr     error               // Result of the first Close
 }
 
 // NewTCPPipe creates a new TCP pipe instance based on configuration
 func NewTCPPipe(config *Config) (*TCPPipe, error) {
+	input, err := openInput(config)
+	if err != nil {
+		return nil, err
+	}
+
 	pipe := &TCPPipe{
 		config:     config,
 		bufferSize: BUFFER_SIZE,
 		clients:    make(map[string]net.Conn),
+		input:      input,
+		simulator:  NewNetworkSimulator(config),
+		counted:    make(chan struct{}),
 	}
 
-	// For receiver mode, create a TCP listener
-	if config.mode == "receiver" {
-		var err error
-		addr := fmt.Sprintf("%s:%d", config.bindAddr, config.port)
-		pipe.listener, err = net.Listen("tcp", addr)
+	// Messages sent with a chain receivers undo are framed, since TCP
+	// doesn't keep their boundaries
+	if config.transforms.Reversible() {
+		pipe.messages = NewMessageAssembler(config.maxFrame)
+	}
+
+	if config.maxWorkers > 0 {
+		pipe.workers = make(chan struct{}, config.maxWorkers)
+	}
+
+	// Replace stdin/stdout with the chat interface when running on a terminal
+	if config.chat {
+		if isTerminal(os.Stdin) && isTerminal(os.Stdout) {
+			pipe.chat = NewChatUI(os.Stdin, os.Stdout, config.color)
+			pipe.input = pipe.chat
+			pipe.output = pipe.chat
+		} else {
+			fmt.Fprintf(os.Stderr, "Warning: Chat mode requires a terminal, using plain mode\n")
+		}
+	}
+
+	// Otherwise received data goes to stdout, buffered unless disabled
+	if pipe.chat == nil {
+		pipe.output, err = newStdoutWriter(config)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Through a relay session both sides connect out to the relay server
+	if config.session != "" {
+		pipe.conn, err = NewRelayClient(config)
+		if err != nil {
+			return nil, err
+		}
+	} else if config.mode == "receiver" && config.systemd {
+		// Use the listening socket passed by systemd
+		pipe.listener, err = systemdListener()
+		if err != nil {
+			return nil, err
+		}
+	} else if config.mode == "receiver" {
+		// For receiver mode, create a TCP listener
+		addr := hostPort(config.bindAddr, config.port)
+		pipe.listener, err = listenTCP(config, addr)
 		if err != nil {
 			return nil, fmt.Errorf("failed to start TCP listener: %v", err)
 		}
 	} else {
 		// For sender mode, establish a connection to the server
-		var err error
-		addr := fmt.Sprintf("%s:%d", config.host, config.port)
-		pipe.conn, err = net.Dial("tcp", addr)
+		addr := hostPort(config.host, config.port)
+		err = retryConnect(config, config.connectRetries, "Connecting to "+addr, func() error {
+			var err error
+			pipe.conn, err = newDialer(config).Dial("tcp", addr)
+			return err
+		})
 		if err != nil {
 			return nil, fmt.Errorf("failed to connect to TCP server: %v", err)
 		}
+		if err := setNoDelay(pipe.conn, !config.nagle); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: failed to configure TCP_NODELAY: %v\n", err)
+		}
+
+		// Make sure an NP receiver answered before sending anything. With
+		// --tfo the SYN waits for the first write, so an empty one starts
+		// the connection.
+		authenticate := config.authSecret != "" || config.authCmd != ""
+		if config.tfo && (!config.noHandshake || authenticate) {
+			pipe.conn.Write(nil)
+		}
+		if !config.noHandshake {
+			version, err := readHandshake(pipe.conn)
+			if err != nil {
+				pipe.conn.Close()
+				return nil, err
+			}
+			config.debugf("Receiver runs NP %s (protocol %d)", version, HANDSHAKE_PROTOCOL)
+		}
+		if err := authenticateToReceiver(config, pipe.conn); err != nil {
+			pipe.conn.Close()
+			return nil, fmt.Errorf("authentication failed: %v", err)
+		}
+
+		if config.label != "" {
+			if err := sendLabel(pipe.conn, config.label); err != nil {
+				return nil, fmt.Errorf("failed to send label: %v", err)
+			}
+		}
 	}
 
 	return pipe, nil
@@ -56,6 +152,12 @@ func (pipe *TCPPipe) SetMultiplexManager(manager *MultiplexManager) {
 	pipe.multiplexer = manager
 }
 
+// SetWebUI assigns the web interface that records this pipe's traffic
+func (pipe *TCPPipe) SetWebUI(web *WebUIServer) {
+	pipe.web = web
+	web.SetPipe(pipe)
+}
+
 // SetDiscoveryService assigns a discovery service to this TCP pipe
 func (pipe *TCPPipe) SetDiscoveryService(discovery *DiscoveryService) {
 	pipe.discovery = discovery
@@ -63,18 +165,18 @@ func (pipe *TCPPipe) SetDiscoveryService(discovery *DiscoveryService) {
 
 // Start initializes the TCP pipe operation based on configured mode
 func (pipe *TCPPipe) Start() error {
-	// Initialize web interface if enabled
-	if pipe.config.webUI {
-		webConfig := &WebUIConfig{
-			Address: pipe.config.webUIBind,
-			Port:    pipe.config.webUIPort,
-			Enabled: true,
-		}
-		StartWebUI(webConfig, pipe.config)
+	// Let the multiplexer record its traffic for the web interface
+	if pipe.web != nil && pipe.multiplexer != nil {
+		pipe.multiplexer.SetWebUI(pipe.web)
 	}
 
-	// Execute mode-specific startup
-	if pipe.config.mode == "receiver" {
+	// Execute mode-specific startup. A receiver joined to a relay session
+	// has a single connection and runs like a sender.
+	if pipe.listener != nil {
+		// In chat mode the receiver can reply to its clients
+		if pipe.chat != nil {
+			go pipe.handleBroadcast()
+		}
 		return pipe.acceptConnections()
 	}
 
@@ -87,41 +189,165 @@ func (pipe *TCPPipe) Start() error {
 func (pipe *TCPPipe) acceptConnections() error {
 	fmt.Fprintf(os.Stderr, "TCP: Accepting connections on %s\n", pipe.listener.Addr())
 
-	var wg sync.WaitGroup
+	if pipe.chat != nil {
+		pipe.chat.Start()
+	}
 
 	for {
+		// With --max-workers, wait for a free handler before accepting so
+		// new connections queue in the listen backlog
+		queued := pipe.workers != nil && !pipe.config.rejectExcess
+		if queued {
+			pipe.workers <- struct{}{}
+		}
+
 		// Accept a new connection
 		conn, err := pipe.listener.Accept()
 		if err != nil {
+			if queued {
+				<-pipe.workers
+			}
+
+			// The listener was closed by Close or Shutdown: let the
+			// connected clients finish before returning
+			if errors.Is(err, net.ErrClosed) {
+				pipe.handlers.Wait()
+				return nil
+			}
 			fmt.Fprintf(os.Stderr, "Error accepting connection: %v\n", err)
 			continue
 		}
 
-		// Register the client
-		clientID := conn.RemoteAddr().String()
-		pipe.clientsMutex.Lock()
-		pipe.clients[clientID] = conn
-		pipe.clientsMutex.Unlock()
+		// With --reject-excess, close connections over the limit instead
+		if pipe.workers != nil && !queued {
+			select {
+			case pipe.workers <- struct{}{}:
+			default:
+				fmt.Fprintf(os.Stderr, "Rejecting connection from %s: %d workers busy\n", conn.RemoteAddr(), pipe.config.maxWorkers)
+				conn.Close()
+				continue
+			}
+		}
 
-		fmt.Fprintf(os.Stderr, "New connection from %s\n", clientID)
+		if err := setNoDelay(conn, !pipe.config.nagle); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: failed to configure TCP_NODELAY: %v\n", err)
+		}
 
-		// If using multiplex, add to the manager
-		if pipe.multiplexer != nil {
-			pipe.multiplexer.AddConnection(clientID, conn)
+		// With --proxy-protocol, read the client address sent by the load
+		// balancer off the accept loop, so a slow client can't hold it up
+		if pipe.config.proxyProtocol {
+			pipe.handlers.Add(1)
+			go func(c net.Conn) {
+				defer pipe.handlers.Done()
+				pipe.startProxiedClient(c)
+			}(conn)
+			continue
 		}
 
-		// Record for the web interface, if enabled
-		if pipe.config.webUI {
-			RecordMessage("New TCP connection", "system", 0, conn.RemoteAddr().String(), conn.LocalAddr().String())
+		pipe.startClient(conn)
+	}
+}
+
+// startClient greets a new client and starts its handler, which
+// authenticates and registers it
+func (pipe *TCPPipe) startClient(conn net.Conn) {
+	clientID := conn.RemoteAddr().String()
+
+	// Greet the client before anything else can be written to it
+	if !pipe.config.noHandshake {
+		if err := sendHandshake(conn); err != nil {
+			fmt.Fprintf(os.Stderr, "Error sending handshake to %s: %v\n", clientID, err)
+			conn.Close()
+			if pipe.workers != nil {
+				<-pipe.workers
+			}
+			return
+		}
+	}
+
+	// Start goroutine to handle the client. It authenticates off the
+	// accept loop, so a slow client can't hold it up.
+	pipe.handlers.Add(1)
+	go func(c net.Conn, id string) {
+		defer pipe.handlers.Done()
+		if pipe.workers != nil {
+			defer func() { <-pipe.workers }()
 		}
 
-		// Start goroutine to handle the client
-		wg.Add(1)
-		go func(c net.Conn, id string) {
-			defer wg.Done()
-			pipe.handleClient(c, id)
-		}(conn, clientID)
+		if err := authenticateClient(pipe.config, c); err != nil {
+			fmt.Fprintf(os.Stderr, "Rejecting connection from %s: authentication failed: %v\n", id, err)
+			c.Close()
+			return
+		}
+
+		pipe.registerClient(c, id)
+		pipe.handleClient(c, id)
+	}(conn, clientID)
+}
+
+// registerClient adds a client that passed authentication to the pipe, the
+// multiplexer and the web interface
+func (pipe *TCPPipe) registerClient(conn net.Conn, clientID string) {
+	pipe.clientsMutex.Lock()
+	pipe.clients[clientID] = conn
+	pipe.clientsMutex.Unlock()
+
+	fmt.Fprintf(os.Stderr, "New connection from %s\n", clientID)
+	fireWebhook(pipe.config.onConnect, WEBHOOK_CONNECT, clientID)
+
+	// If using multiplex, add to the manager
+	if pipe.multiplexer != nil {
+		pipe.multiplexer.AddConnection(clientID, conn)
+	}
+
+	// Record for the web interface, if enabled
+	if pipe.web != nil {
+		pipe.web.RecordMessage("New TCP connection", "system", 0, conn.RemoteAddr().String(), conn.LocalAddr().String())
+	}
+}
+
+// startProxiedClient reads the PROXY protocol header of a connection from a
+// load balancer and starts the client under its real address. Connections
+// without a valid header are rejected.
+func (pipe *TCPPipe) startProxiedClient(conn net.Conn) {
+	proxied, err := readProxyHeader(conn)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Rejecting connection from %s: %v\n", conn.RemoteAddr(), err)
+		conn.Close()
+		if pipe.workers != nil {
+			<-pipe.workers
+		}
+		return
+	}
+
+	pipe.config.debugf("Connection from %s is proxied for %s", conn.RemoteAddr(), proxied.RemoteAddr())
+	pipe.startClient(proxied)
+}
+
+// setNoDelay turns Nagle's algorithm off (noDelay) or on for a TCP
+// connection. Other connections, such as the relay client, are left as is.
+func setNoDelay(conn net.Conn, noDelay bool) error {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	return tcpConn.SetNoDelay(noDelay)
+}
+
+// CloseClient disconnects the client with the given remote address.
+// It returns false if no such client is connected.
+func (pipe *TCPPipe) CloseClient(addr string) bool {
+	pipe.clientsMutex.Lock()
+	defer pipe.clientsMutex.Unlock()
+
+	conn, exists := pipe.clients[addr]
+	if !exists {
+		return false
 	}
+
+	// handleClient removes the client from the map once its read fails
+	conn.Close()
+	return true
 }
 
 // handleClient manages communication with an individual client
@@ -136,45 +362,154 @@ func (pipe *TCPPipe) handleClient(conn net.Conn, clientID string) {
 		if pipe.multiplexer != nil {
 			pipe.multiplexer.RemoveConnection(clientID)
 		}
+		if pipe.messages != nil {
+			pipe.messages.Remove(conn.RemoteAddr().String())
+		}
 
 		// Record for the web interface, if enabled
-		if pipe.config.webUI {
-			RecordMessage("TCP connection closed", "system", 0, conn.RemoteAddr().String(), conn.LocalAddr().String())
+		if pipe.web != nil {
+			pipe.web.RecordMessage("TCP connection closed", "system", 0, conn.RemoteAddr().String(), conn.LocalAddr().String())
 		}
 
 		fmt.Fprintf(os.Stderr, "Connection from %s closed\n", clientID)
+		fireWebhook(pipe.config.onDisconnect, WEBHOOK_DISCONNECT, clientID)
+
+		if pipe.config.notifyPeers {
+			pipe.notifyPeers(fmt.Sprintf("[peer %s left]\n", clientID))
+		}
 	}()
 
-	buffer := make([]byte, pipe.bufferSize)
+	buffer := getBuffer(pipe.config, pipe.bufferSize)
+	defer putBuffer(pipe.config, buffer)
+	first := true
 
-	for {
-		// If using multiplex, the manager handles reception
-		if pipe.multiplexer != nil {
-			time.Sleep(100 * time.Millisecond) // Avoid excessive CPU usage
-			continue
+	// With --stream-compress the whole connection is one compressed
+	// stream, read past the multiplexer
+	var stream io.Reader
+	if pipe.config.streamCompress != "" {
+		reader, release, err := pipe.openClientStream(conn, clientID)
+		if err != nil {
+			if err != io.EOF {
+				fmt.Fprintf(os.Stderr, "Error opening %s stream from client %s: %v\n", pipe.config.streamCompress, clientID, err)
+			}
+			return
 		}
+		defer release()
+		stream = reader
+		first = false
+	}
 
-		// Read data from client
-		n, err := conn.Read(buffer)
+	for {
+		// Read data from client. The multiplexer decompresses it and
+		// records it for the web interface.
+		var n int
+		var err error
+		if stream != nil {
+			n, err = stream.Read(buffer)
+		} else if pipe.multiplexer != nil {
+			n, err = pipe.multiplexer.ReceiveFrom(clientID, buffer)
+		} else {
+			n, err = conn.Read(buffer)
+		}
 		if err != nil {
-			if err != io.EOF {
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
 				fmt.Fprintf(os.Stderr, "Error reading from client %s: %v\n", clientID, err)
 			}
 			break
 		}
 
+		data := buffer[:n]
+
+		// The first data may start with the client's --label
+		if first && n > 0 {
+			first = false
+			data = pipe.labelClient(clientID, data)
+			n = len(data)
+		}
+
 		if n > 0 {
-			data := buffer[:n]
+			// Stop once --count messages have been written
+			if pipe.config.count > 0 && pipe.received.Load() >= int64(pipe.config.count) {
+				break
+			}
 
 			// Record for the web interface, if enabled
-			if pipe.config.webUI {
+			if pipe.web != nil && (pipe.multiplexer == nil || stream != nil) {
 				content := string(data)
-				RecordReceivedData(uint64(n), conn.RemoteAddr().String())
-				RecordMessage(content, "in", n, conn.RemoteAddr().String(), conn.LocalAddr().String())
+				pipe.web.RecordReceivedData(uint64(n), conn.RemoteAddr().String())
+				pipe.web.RecordMessage(content, "in", n, conn.RemoteAddr().String(), conn.LocalAddr().String())
+			}
+
+			// Write data to the output
+			if err := pipe.writeOutput(data, conn.RemoteAddr().String()); err != nil {
+				if err != errCountReached {
+					fmt.Fprintf(os.Stderr, "Error reading from client %s: %v\n", clientID, err)
+				}
+				break
+			}
+		}
+	}
+}
+
+// handleBroadcast reads from the input and sends it to every connected
+// client, letting the receiver reply in chat mode
+func (pipe *TCPPipe) handleBroadcast() {
+	buffer := make([]byte, pipe.bufferSize)
+
+	for {
+		n, err := pipe.input.Read(buffer)
+		if err != nil {
+			if err != io.EOF {
+				fmt.Fprintf(os.Stderr, "Error reading input: %v\n", err)
+			}
+			return
+		}
+
+		data, err := pipe.transform(buffer[:n])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v, skipping %d bytes\n", err, n)
+			continue
+		}
+
+		pipe.clientsMutex.RLock()
+		for id, conn := range pipe.clients {
+			written, err := writeFull(conn, data)
+
+			// Record for the web interface, if enabled
+			if written > 0 && pipe.web != nil {
+				pipe.web.RecordSentData(uint64(written), conn.RemoteAddr().String())
+				pipe.web.RecordMessage(string(data[:written]), "out", written, conn.LocalAddr().String(), conn.RemoteAddr().String())
 			}
 
-			// Write data to standard output
-			os.Stdout.Write(data)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error sending data to client %s: %v\n", id, err)
+			}
+		}
+		pipe.clientsMutex.RUnlock()
+	}
+}
+
+// notifyPeers sends a notice line to every connected client, e.g. when
+// another client leaves with --notify-peers
+func (pipe *TCPPipe) notifyPeers(notice string) {
+	data, err := pipe.transform([]byte(notice))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v, not notifying clients\n", err)
+		return
+	}
+
+	pipe.clientsMutex.RLock()
+	defer pipe.clientsMutex.RUnlock()
+
+	for id, conn := range pipe.clients {
+		if _, err := writeFull(conn, data); err != nil {
+			fmt.Fprintf(os.Stderr, "Error notifying client %s: %v\n", id, err)
+			continue
+		}
+
+		// Record for the web interface, if enabled
+		if pipe.web != nil {
+			pipe.web.RecordMessage(strings.TrimSpace(notice), "system", len(notice), conn.LocalAddr().String(), conn.RemoteAddr().String())
 		}
 	}
 }
@@ -188,34 +523,107 @@ func (pipe *TCPPipe) handleSend() error {
 	defer pipe.conn.Close()
 	fmt.Fprintf(os.Stderr, "TCP: Connected to %s\n", pipe.conn.RemoteAddr())
 
+	received := make(chan struct{})
+
+	if pipe.chat != nil {
+		pipe.chat.Start()
+	}
+
 	// If using multiplex, add the connection to the manager
 	if pipe.multiplexer != nil {
 		clientID := pipe.conn.RemoteAddr().String()
 		pipe.multiplexer.AddConnection(clientID, pipe.conn)
 
 		// Start listening in goroutine
-		go pipe.multiplexer.StartListening(func(id string, data []byte) {
-			// Process data received via multiplex
-			os.Stdout.Write(data)
-		})
+		go func() {
+			pipe.multiplexer.listenConnection(clientID, func(id string, data []byte) {
+				// Process data received via multiplex
+				if err := pipe.writeOutput(data, id); err != nil {
+					if err != errCountReached {
+						fmt.Fprintf(os.Stderr, "Error receiving data: %v\n", err)
+					}
+					pipe.multiplexer.RemoveConnection(id)
+				}
+			})
+			close(received)
+		}()
 	} else {
 		// Start goroutine to receive data from the server
-		go pipe.handleReceive()
+		go func() {
+			pipe.handleReceive()
+			close(received)
+		}()
+	}
+
+	// With --stream-compress everything sent is one compressed stream
+	var writer io.Writer = pipe.conn
+	var compressor streamCompressor
+	if pipe.config.mode == "sender" && pipe.config.streamCompress != "" {
+		var err error
+		if compressor, err = newStreamCompressor(pipe.config.streamCompress, pipe.conn); err != nil {
+			return err
+		}
+		writer = compressor
+	}
+
+	// Read from the input and send to the server. A receiver joined to a
+	// relay session stops once --count messages arrived, without waiting
+	// for its input to end.
+	sent := make(chan struct{})
+	go func() {
+		pipe.sendInput(writer, compressor)
+		close(sent)
+	}()
+	select {
+	case <-sent:
+	case <-pipe.counted:
+		return nil
+	}
+
+	if compressor != nil {
+		if err := compressor.Close(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error finishing %s stream: %v\n", pipe.config.streamCompress, err)
+		}
+	}
+
+	// A receiver joined to a relay session keeps receiving after its
+	// input ends, like a listening receiver would, and so does a sender
+	// with --keep-open, until the peer closes the connection
+	if pipe.config.mode == "receiver" && pipe.multiplexer == nil || pipe.config.keepOpen {
+		if pipe.config.keepOpen {
+			fmt.Fprintf(os.Stderr, "TCP: Input ended, receiving until %s closes the connection\n", pipe.conn.RemoteAddr())
+		}
+		<-received
 	}
 
-	// Read from standard input and send to the server
+	return nil
+}
+
+// sendInput reads the input until it ends and sends it to the server
+// through writer, or the multiplexer if there is one
+func (pipe *TCPPipe) sendInput(writer io.Writer, compressor streamCompressor) {
 	buffer := make([]byte, pipe.bufferSize)
 	for {
-		n, err := os.Stdin.Read(buffer)
+		n, err := pipe.input.Read(buffer)
 		if err != nil {
 			if err != io.EOF {
-				fmt.Fprintf(os.Stderr, "Error reading from standard input: %v\n", err)
+				fmt.Fprintf(os.Stderr, "Error reading input: %v\n", err)
 			}
-			break
+			return
 		}
 
 		if n > 0 {
-			data := buffer[:n]
+			data, err := pipe.transform(buffer[:n])
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v, skipping %d bytes\n", err, n)
+				continue
+			}
+
+			// Drop or delay the chunk when simulating a bad network
+			if !pipe.simulator.Deliver() {
+				pipe.config.debugf("Simulated drop of %d bytes", len(data))
+				continue
+			}
 
 			// If using multiplex, send via manager
 			if pipe.multiplexer != nil {
@@ -223,32 +631,54 @@ func (pipe *TCPPipe) handleSend() error {
 				err = pipe.multiplexer.SendTo(clientID, data)
 			} else {
 				// Send directly
-				_, err = pipe.conn.Write(data)
+				var written int
+				written, err = writeFull(writer, data)
+
+				// Flush the compressed stream when the input has no
+				// more data ready, so interactive use isn't held back
+				if err == nil && compressor != nil && n < len(buffer) {
+					err = compressor.Flush()
+				}
 
 				// Record for the web interface, if enabled
-				if err == nil && pipe.config.webUI {
-					content := string(data)
-					RecordSentData(uint64(n), pipe.conn.RemoteAddr().String())
-					RecordMessage(content, "out", n, pipe.conn.LocalAddr().String(), pipe.conn.RemoteAddr().String())
+				if written > 0 && pipe.web != nil {
+					content := string(data[:written])
+					pipe.web.RecordSentData(uint64(written), pipe.conn.RemoteAddr().String())
+					pipe.web.RecordMessage(content, "out", written, pipe.conn.LocalAddr().String(), pipe.conn.RemoteAddr().String())
 				}
 			}
 
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "Error sending data: %v\n", err)
-				break
+				return
 			}
 		}
 	}
 
-	return nil
 }
 
 // handleReceive manages receiving data from the server
 func (pipe *TCPPipe) handleReceive() {
-	buffer := make([]byte, pipe.bufferSize)
+	buffer := getBuffer(pipe.config, pipe.bufferSize)
+	defer putBuffer(pipe.config, buffer)
+
+	// A receiver joined to a relay session reads the --stream-compress
+	// stream of the sender
+	var reader io.Reader = pipe.conn
+	if pipe.config.mode == "receiver" && pipe.config.streamCompress != "" {
+		stream, release, err := pipe.openClientStream(pipe.conn, pipe.conn.RemoteAddr().String())
+		if err != nil {
+			if err != io.EOF {
+				fmt.Fprintf(os.Stderr, "Error opening %s stream: %v\n", pipe.config.streamCompress, err)
+			}
+			return
+		}
+		defer release()
+		reader = stream
+	}
 
 	for {
-		n, err := pipe.conn.Read(buffer)
+		n, err := reader.Read(buffer)
 		if err != nil {
 			if err != io.EOF {
 				fmt.Fprintf(os.Stderr, "Error receiving data: %v\n", err)
@@ -260,25 +690,167 @@ func (pipe *TCPPipe) handleReceive() {
 			data := buffer[:n]
 
 			// Record for the web interface, if enabled
-			if pipe.config.webUI {
+			if pipe.web != nil {
 				content := string(data)
-				RecordReceivedData(uint64(n), pipe.conn.RemoteAddr().String())
-				RecordMessage(content, "in", n, pipe.conn.RemoteAddr().String(), pipe.conn.LocalAddr().String())
+				pipe.web.RecordReceivedData(uint64(n), pipe.conn.RemoteAddr().String())
+				pipe.web.RecordMessage(content, "in", n, pipe.conn.RemoteAddr().String(), pipe.conn.LocalAddr().String())
 			}
 
-			// Write data to standard output
-			os.Stdout.Write(data)
+			// Write data to the output
+			if err := pipe.writeOutput(data, pipe.conn.RemoteAddr().String()); err != nil {
+				if err != errCountReached {
+					fmt.Fprintf(os.Stderr, "Error receiving data: %v\n", err)
+				}
+				break
+			}
+		}
+	}
+}
+
+// transform applies the --transform chain to data to be sent, framing the
+// result when receivers undo it
+func (pipe *TCPPipe) transform(data []byte) ([]byte, error) {
+	data, err := pipe.config.transforms.Apply(data)
+	if err != nil || pipe.messages == nil {
+		return data, err
+	}
+	return frameMessage(data), nil
+}
+
+// errCountReached is returned by writeOutput once --count messages have
+// been written, after which the connection isn't read any further
+var errCountReached = errors.New("--count messages received")
+
+// writeOutput writes received data to the output, or a summary of it in
+// --peek mode, and streams it to the web interface's live tail. With a
+// --transform chain to undo, data is put back together into whole messages
+// first; data that can't be undone is an error. Each read, or each whole
+// message with a --transform chain, counts towards --count.
+func (pipe *TCPPipe) writeOutput(data []byte, source string) error {
+	messages := [][]byte{data}
+	if pipe.messages != nil {
+		var err error
+		if messages, err = pipe.messages.Add(source, data); err != nil {
+			return err
+		}
+	}
+
+	for _, message := range messages {
+		message, err := pipe.config.transforms.Reverse(message)
+		if err != nil {
+			return err
+		}
+
+		// Stop once --count messages have been written
+		received := pipe.received.Add(1)
+		if pipe.config.count > 0 && received > int64(pipe.config.count) {
+			return errCountReached
+		}
+
+		if pipe.web != nil {
+			pipe.web.PublishTail(message)
+		}
+
+		writeFormatted(pipe.output, pipe.config.outputFormat, pipe.config.color, source, message)
+
+		// Close from another goroutine, since --drain waits for the
+		// client handlers to return
+		if received == int64(pipe.config.count) {
+			close(pipe.counted)
+			go pipe.Close()
+			return errCountReached
 		}
 	}
+	return nil
 }
 
-// Close closes all connections
+// Shutdown stops accepting new connections, waits for the connected
+// clients to finish, for at most --drain if set, and then closes the pipe
+func (pipe *TCPPipe) Shutdown() error {
+	pipe.drain(pipe.config.drain)
+	return pipe.Close()
+}
+
+// Close closes all connections. It first stops the mDNS announcement, so
+// no new clients discover the receiver, and waits up to --drain for the
+// connected clients to finish. It is safe to call more than once.
 func (pipe *TCPPipe) Close() error {
+	pipe.closeOnce.Do(func() {
+		pipe.stopAnnouncing()
+		if pipe.config.drain > 0 {
+			pipe.drain(pipe.config.drain)
+		}
+		pipe.closeErr = pipe.closeAll()
+	})
+	return pipe.closeErr
+}
+
+// drain stops accepting new connections and waits for the client handlers
+// to return, giving up after timeout unless it is 0. Only the first call
+// waits.
+func (pipe *TCPPipe) drain(timeout time.Duration) {
+	if pipe.listener == nil || pipe.drained.Swap(true) {
+		return
+	}
+
+	pipe.stopAnnouncing()
+	fmt.Fprintf(os.Stderr, "TCP: No longer accepting connections, waiting for clients to finish\n")
+	pipe.listener.Close()
+
+	done := make(chan struct{})
+	go func() {
+		pipe.handlers.Wait()
+		close(done)
+	}()
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	select {
+	case <-done:
+	case <-expired:
+		pipe.clientsMutex.RLock()
+		remaining := len(pipe.clients)
+		pipe.clientsMutex.RUnlock()
+		fmt.Fprintf(os.Stderr, "TCP: Drain timeout after %v, closing %d remaining connections\n", timeout, remaining)
+	}
+}
+
+// stopAnnouncing withdraws the mDNS announcement, so no new clients find
+// the receiver while it shuts down, then gives the clients that already
+// found it DISCOVERY_GRACE to connect before the listener is closed
+func (pipe *TCPPipe) stopAnnouncing() {
+	if pipe.discovery != nil && pipe.discovery.StopAnnounce() {
+		time.Sleep(DISCOVERY_GRACE)
+	}
+}
+
+// closeAll releases the terminal, output, listener and connections
+func (pipe *TCPPipe) closeAll() error {
 	var lastErr error
 
+	// Restore the terminal before anything else is printed
+	if pipe.chat != nil {
+		pipe.chat.Close()
+	}
+
+	// Write out any buffered data
+	if out, ok := pipe.output.(*OutputWriter); ok {
+		out.Close()
+	}
+
+	// Close the --stdin-file or --file inputs, if they were opened
+	if closer, ok := pipe.input.(io.Closer); ok && pipe.input != io.Reader(os.Stdin) {
+		closer.Close()
+	}
+
 	// Close the listener, if it exists
 	if pipe.listener != nil {
-		if err := pipe.listener.Close(); err != nil {
+		if err := pipe.listener.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
 			lastErr = err
 			fmt.Fprintf(os.Stderr, "Error closing listener: %v\n", err)
 		}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTCPReceiveCount(t *testing.T) {
+	messages := []string{"one\n", "two\n", "three\n"}
+
+	// Without a chain each read counts, with one each framed message
+	for _, spec := range []string{"", "base64"} {
+		chain, err := parseTransforms(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config := &Config{mode: "receiver", count: 2, transforms: chain, maxFrame: 1 << 20, outputFormat: OUTPUT_RAW}
+
+		var out bytes.Buffer
+		local, remote := net.Pipe()
+		defer remote.Close()
+		pipe := &TCPPipe{config: config, conn: local, bufferSize: BUFFER_SIZE, output: &out, counted: make(chan struct{})}
+		if chain.Reversible() {
+			pipe.messages = NewMessageAssembler(config.maxFrame)
+		}
+
+		done := make(chan struct{})
+		go func() {
+			pipe.handleReceive()
+			close(done)
+		}()
+
+		// Framed messages all go in a single write, read at once
+		go func() {
+			var framed []byte
+			for _, message := range messages {
+				data, _ := pipe.transform([]byte(message))
+				if pipe.messages == nil {
+					if _, err := remote.Write(data); err != nil {
+						return
+					}
+					continue
+				}
+				framed = append(framed, data...)
+			}
+			remote.Write(framed)
+		}()
+
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%q: still receiving after --count messages", spec)
+		}
+		select {
+		case <-pipe.counted:
+		default:
+			t.Fatalf("%q: --count wasn't reported as reached", spec)
+		}
+		if out.String() != "one\ntwo\n" {
+			t.Errorf("%q: got %q, want %q", spec, out.String(), "one\ntwo\n")
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// TeeWriter writes received data to stdout and keeps a copy in the --tee
+// file. Unlike io.MultiWriter, a failing file doesn't stop the output: the
+// error is reported once and the copy stops, while stdout carries on.
+type TeeWriter struct {
+	writer io.Writer  // Main destination, usually stdout
+	file   *os.File   // File the copy is written to, nil once it failed
+	path   string     // Path of the file, for error messages
+	mutex  sync.Mutex // Serializes writes from concurrent connections
+}
+
+// NewTeeWriter creates the --tee file at path, truncating it like tee(1),
+// and copies everything written to w into it
+func NewTeeWriter(w io.Writer, path string) (*TeeWriter, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create --tee file: %v", err)
+	}
+
+	return &TeeWriter{writer: w, file: file, path: path}, nil
+}
+
+// Write writes p to the main destination and to the file
+func (tw *TeeWriter) Write(p []byte) (int, error) {
+	tw.mutex.Lock()
+	defer tw.mutex.Unlock()
+
+	if tw.file != nil {
+		if _, err := tw.file.Write(p); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing to %s: %v, no longer copying received data to it\n", tw.path, err)
+			tw.file.Close()
+			tw.file = nil
+		}
+	}
+
+	return tw.writer.Write(p)
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// TFO_QUEUE_LENGTH is the number of pending Fast Open requests a --tfo
+// listener accepts data from before falling back to the normal handshake
+const TFO_QUEUE_LENGTH = 256
+
+// fastOpenDialControl sets TCP_FASTOPEN_CONNECT before connecting, so the
+// first write is sent in the SYN when the kernel has a cookie for the peer
+func fastOpenDialControl(c syscall.RawConn) error {
+	return setsockoptTCP(c, unix.TCP_FASTOPEN_CONNECT, 1)
+}
+
+// fastOpenListenControl sets TCP_FASTOPEN on a listener, so it accepts
+// data carried in the SYN of --tfo senders
+func fastOpenListenControl(c syscall.RawConn) error {
+	return setsockoptTCP(c, unix.TCP_FASTOPEN, TFO_QUEUE_LENGTH)
+}
+
+// setsockoptTCP sets an IPPROTO_TCP option on the socket
+func setsockoptTCP(c syscall.RawConn, option, value int) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, option, value)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
@@ -0,0 +1,20 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// fastOpenDialControl is only supported on Linux; --tfo senders use the
+// normal handshake elsewhere
+func fastOpenDialControl(c syscall.RawConn) error {
+	return fmt.Errorf("TCP Fast Open is only supported on Linux")
+}
+
+// fastOpenListenControl is only supported on Linux; --tfo receivers use
+// the normal handshake elsewhere
+func fastOpenListenControl(c syscall.RawConn) error {
+	return fmt.Errorf("TCP Fast Open is only supported on Linux")
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// TCP message framing for --transform: TCP doesn't keep message
+// boundaries, so with a chain receivers can undo, each message sent over
+// TCP is prefixed with its length and undone whole
+const (
+	TRANSFORM_FRAME_MAGIC  = "NPT"                          // Start of every transformed message
+	TRANSFORM_FRAME_HEADER = len(TRANSFORM_FRAME_MAGIC) + 4 // Magic and 4-byte big-endian payload length
+)
+
+// Transform changes data as it flows through the pipe. Senders apply the
+// configured transforms to every message before it is written.
+type Transform interface {
+	Apply(data []byte) ([]byte, error)
+}
+
+// ReversibleTransform is a transform that receivers can undo, such as an
+// encoding. Transforms that can't be undone, like upper, are skipped on
+// receive.
+type ReversibleTransform interface {
+	Transform
+	Reverse(data []byte) ([]byte, error)
+}
+
+// transforms lists the built-in transforms by the name used in --transform
+var transforms = map[string]Transform{
+	"upper":  upperTransform{},
+	"base64": base64Transform{},
+	"gzip":   gzipTransform{},
+}
+
+// TransformChain is the ordered list of transforms given with --transform
+type TransformChain struct {
+	names      []string
+	transforms []Transform
+}
+
+// parseTransforms builds the chain for a comma-separated list of transform
+// names such as "upper,base64"
+func parseTransforms(spec string) (*TransformChain, error) {
+	chain := &TransformChain{}
+	if spec == "" {
+		return chain, nil
+	}
+
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		transform, ok := transforms[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown transform %q, available: %s", name, strings.Join(transformNames(), ", "))
+		}
+		chain.names = append(chain.names, name)
+		chain.transforms = append(chain.transforms, transform)
+	}
+	return chain, nil
+}
+
+// transformNames returns the names of the built-in transforms, sorted
+func transformNames() []string {
+	names := make([]string, 0, len(transforms))
+	for name := range transforms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Reversible reports whether receivers undo any transform of the chain
+func (tc *TransformChain) Reversible() bool {
+	if tc == nil {
+		return false
+	}
+
+	for _, transform := range tc.transforms {
+		if _, ok := transform.(ReversibleTransform); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// String returns the chain as given to --transform
+func (tc *TransformChain) String() string {
+	if tc == nil {
+		return ""
+	}
+	return strings.Join(tc.names, ",")
+}
+
+// Apply runs the transforms in order on data to be sent
+func (tc *TransformChain) Apply(data []byte) ([]byte, error) {
+	if tc == nil {
+		return data, nil
+	}
+
+	for i, transform := range tc.transforms {
+		var err error
+		if data, err = transform.Apply(data); err != nil {
+			return nil, fmt.Errorf("transform %s failed: %v", tc.names[i], err)
+		}
+	}
+	return data, nil
+}
+
+// Reverse undoes the reversible transforms, last one first, on received data
+func (tc *TransformChain) Reverse(data []byte) ([]byte, error) {
+	if tc == nil {
+		return data, nil
+	}
+
+	for i := len(tc.transforms) - 1; i >= 0; i-- {
+		reversible, ok := tc.transforms[i].(ReversibleTransform)
+		if !ok {
+			continue
+		}
+
+		var err error
+		if data, err = reversible.Reverse(data); err != nil {
+			return nil, fmt.Errorf("reversing transform %s failed: %v", tc.names[i], err)
+		}
+	}
+	return data, nil
+}
+
+// upperTransform converts text to upper case, mostly to try out the chain
+type upperTransform struct{}
+
+// Apply returns data in upper case
+func (upperTransform) Apply(data []byte) ([]byte, error) {
+	return bytes.ToUpper(data), nil
+}
+
+// base64Transform encodes data with standard base64, so binary data can
+// cross text-only channels
+type base64Transform struct{}
+
+// Apply encodes data
+func (base64Transform) Apply(data []byte) ([]byte, error) {
+	encoded := make([]byte, base64.StdEncoding.EncodedLen(len(data)))
+	base64.StdEncoding.Encode(encoded, data)
+	return encoded, nil
+}
+
+// Reverse decodes data, ignoring surrounding whitespace such as the
+// newline added to UDP messages
+func (base64Transform) Reverse(data []byte) ([]byte, error) {
+	data = bytes.TrimSpace(data)
+	decoded := make([]byte, base64.StdEncoding.DecodedLen(len(data)))
+	n, err := base64.StdEncoding.Decode(decoded, data)
+	return decoded[:n], err
+}
+
+// gzipTransform compresses each message with gzip
+type gzipTransform struct{}
+
+// Apply compresses data
+func (gzipTransform) Apply(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Reverse decompresses data
+func (gzipTransform) Reverse(data []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
+
+// frameMessage prefixes a transformed message with its length for TCP
+func frameMessage(data []byte) []byte {
+	frame := make([]byte, TRANSFORM_FRAME_HEADER, TRANSFORM_FRAME_HEADER+len(data))
+	copy(frame, TRANSFORM_FRAME_MAGIC)
+	binary.BigEndian.PutUint32(frame[len(TRANSFORM_FRAME_MAGIC):], uint32(len(data)))
+	return append(frame, data...)
+}
+
+// MessageAssembler puts framed messages read from TCP back together,
+// keeping a separate buffer for each source, however the reads split them
+type MessageAssembler struct {
+	pending  map[string][]byte // Data read that doesn't make a complete message yet, by source
+	maxFrame int64             // Largest message accepted, see --max-frame
+	mutex    sync.Mutex        // Guards pending
+}
+
+// NewMessageAssembler creates an assembler for messages of at most
+// maxFrame bytes
+func NewMessageAssembler(maxFrame int64) *MessageAssembler {
+	return &MessageAssembler{
+		pending:  make(map[string][]byte),
+		maxFrame: maxFrame,
+	}
+}
+
+// Add appends data read from source and returns the messages it completes.
+// Data that isn't a frame, or a frame larger than --max-frame, is an error,
+// after which the source's connection can't be read any further.
+func (ma *MessageAssembler) Add(source string, data []byte) ([][]byte, error) {
+	ma.mutex.Lock()
+	defer ma.mutex.Unlock()
+
+	buffered := append(ma.pending[source], data...)
+	var messages [][]byte
+	for len(buffered) >= TRANSFORM_FRAME_HEADER {
+		if string(buffered[:len(TRANSFORM_FRAME_MAGIC)]) != TRANSFORM_FRAME_MAGIC {
+			delete(ma.pending, source)
+			return messages, errors.New("data isn't a --transform message, does the sender use the same --transform?")
+		}
+
+		length := binary.BigEndian.Uint32(buffered[len(TRANSFORM_FRAME_MAGIC):])
+		if int64(length) > ma.maxFrame {
+			delete(ma.pending, source)
+			return messages, fmt.Errorf("message of %d bytes is larger than --max-frame", length)
+		}
+		end := TRANSFORM_FRAME_HEADER + int(length)
+		if len(buffered) < end {
+			break
+		}
+
+		messages = append(messages, buffered[TRANSFORM_FRAME_HEADER:end])
+		buffered = buffered[end:]
+	}
+
+	// Keep a copy of what's left, since data may be a reused buffer
+	if len(buffered) > 0 {
+		ma.pending[source] = append([]byte(nil), buffered...)
+	} else {
+		delete(ma.pending, source)
+	}
+	return messages, nil
+}
+
+// Remove forgets the partial message of a source whose connection closed
+func (ma *MessageAssembler) Remove(source string) {
+	ma.mutex.Lock()
+	defer ma.mutex.Unlock()
+	delete(ma.pending, source)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// newTransformPipe returns a TCP pipe using the --transform chain spec that
+// writes what it receives to out
+func newTransformPipe(t *testing.T, spec string, out *bytes.Buffer) *TCPPipe {
+	t.Helper()
+	chain, err := parseTransforms(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &Config{transforms: chain, maxFrame: 1 << 20, outputFormat: OUTPUT_RAW}
+	return &TCPPipe{config: config, output: out, messages: NewMessageAssembler(config.maxFrame)}
+}
+
+func TestTransformTCPRoundTrip(t *testing.T) {
+	messages := testMessages()
+	want := bytes.Join(messages, nil)
+
+	for _, spec := range []string{"base64", "gzip", "gzip,base64"} {
+		var out bytes.Buffer
+		pipe := newTransformPipe(t, spec, &out)
+
+		var wire []byte
+		for _, message := range messages {
+			data, err := pipe.transform(message)
+			if err != nil {
+				t.Fatalf("%s: %v", spec, err)
+			}
+			wire = append(wire, data...)
+		}
+
+		// 1 and 7 split messages across reads, the last merges them all
+		for _, chunk := range []int{1, 7, len(wire)} {
+			out.Reset()
+			for start := 0; start < len(wire); start += chunk {
+				end := start + chunk
+				if end > len(wire) {
+					end = len(wire)
+				}
+				if err := pipe.writeOutput(wire[start:end], "peer"); err != nil {
+					t.Fatalf("%s, %d-byte reads: %v", spec, chunk, err)
+				}
+			}
+			if !bytes.Equal(out.Bytes(), want) {
+				t.Errorf("%s, %d-byte reads: got %d bytes, want %d", spec, chunk, out.Len(), len(want))
+			}
+		}
+	}
+}
+
+func TestTransformTCPReportsUnframedData(t *testing.T) {
+	var out bytes.Buffer
+	pipe := newTransformPipe(t, "base64", &out)
+
+	err := pipe.writeOutput([]byte("aGVsbG8=\n"), "peer")
+	if err == nil || !strings.Contains(err.Error(), "--transform") {
+		t.Fatalf("got %v, want an error about --transform", err)
+	}
+	if out.Len() != 0 {
+		t.Errorf("wrote %q, want nothing", out.String())
+	}
+}
+
+func TestTransformTCPReportsUndecodableMessage(t *testing.T) {
+	var out bytes.Buffer
+	pipe := newTransformPipe(t, "gzip", &out)
+
+	if err := pipe.writeOutput(frameMessage([]byte("not gzip")), "peer"); err == nil {
+		t.Fatal("message that isn't gzip was accepted")
+	}
+	if out.Len() != 0 {
+		t.Errorf("wrote %q, want nothing", out.String())
+	}
+}
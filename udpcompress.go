@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// DatagramCodec applies --compression to UDP datagrams. Each datagram is
+// compressed on its own, as a complete stream with its format's header, so
+// the receiver can decode it without any earlier datagram. It is used by a
+// single goroutine in each direction.
+type DatagramCodec struct {
+	compType CompressionType                   // Algorithm for sent datagrams, NoCompression to send as is
+	level    int                               // Compression level for sent datagrams
+	minSize  int                               // Smaller datagrams are sent uncompressed
+	maxSize  int64                             // Largest datagram accepted once decompressed
+	encoder  io.WriteCloser                    // Compressor, created on first use
+	decoders map[CompressionType]io.ReadCloser // Decompressors by algorithm, created on first use
+}
+
+// NewDatagramCodec creates the codec for a UDP pipe from --compression,
+// --compress-level, --compress-min and --max-decompressed
+func NewDatagramCodec(config *Config) *DatagramCodec {
+	return &DatagramCodec{
+		compType: getCompressType(config.compression),
+		level:    config.compressLevel,
+		minSize:  config.compressMin,
+		maxSize:  config.maxDecompress,
+		decoders: make(map[CompressionType]io.ReadCloser),
+	}
+}
+
+// Compress returns data compressed as a standalone stream, or data itself
+// when compression is off, data is short or compressing doesn't shrink it
+func (dc *DatagramCodec) Compress(data []byte) ([]byte, error) {
+	if dc.compType == NoCompression || len(data) < dc.minSize {
+		return data, nil
+	}
+
+	var buf bytes.Buffer
+	if dc.encoder == nil {
+		encoder, err := newEncoder(dc.compType, dc.level, &buf)
+		if err != nil {
+			return nil, fmt.Errorf("error creating compressor: %v", err)
+		}
+		dc.encoder = encoder
+	} else if err := resetEncoder(dc.encoder, &buf); err != nil {
+		return nil, fmt.Errorf("error resetting compressor: %v", err)
+	}
+
+	if _, err := dc.encoder.Write(data); err != nil {
+		return nil, fmt.Errorf("error compressing data: %v", err)
+	}
+	if err := dc.encoder.Close(); err != nil {
+		return nil, fmt.Errorf("error flushing compressor: %v", err)
+	}
+
+	if buf.Len() >= len(data) {
+		return data, nil
+	}
+	return buf.Bytes(), nil
+}
+
+// Decompress decodes a datagram that starts with a known compression
+// header, whatever the local --compression is. Other datagrams, and those
+// that fail to decode, are returned unchanged with NoCompression.
+func (dc *DatagramCodec) Decompress(datagram []byte) ([]byte, CompressionType, error) {
+	compType := NoCompression
+	for t, header := range CompressionHeader {
+		if bytes.HasPrefix(datagram, header) {
+			compType = t
+			break
+		}
+	}
+	if compType == NoCompression {
+		return datagram, NoCompression, nil
+	}
+
+	src := bytes.NewReader(datagram)
+	decoder, ok := dc.decoders[compType]
+	if ok {
+		if err := resetDecoder(decoder, src); err != nil {
+			return datagram, NoCompression, nil
+		}
+	} else {
+		var err error
+		decoder, err = newDecoder(compType, src)
+		if err != nil {
+			return datagram, NoCompression, nil
+		}
+		dc.decoders[compType] = decoder
+	}
+
+	var buf bytes.Buffer
+	_, err := io.Copy(&buf, io.LimitReader(decoder, dc.maxSize+1))
+	if err != nil {
+		return datagram, NoCompression, nil
+	}
+	if int64(buf.Len()) > dc.maxSize {
+		return nil, compType, fmt.Errorf("%s datagram decompresses to more than %d bytes, see --max-decompressed", GetCompressionName(compType), dc.maxSize)
+	}
+	return buf.Bytes(), compType, nil
+}
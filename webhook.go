@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// WEBHOOK_TIMEOUT bounds each webhook request, which runs in the background
+const WEBHOOK_TIMEOUT = 5 * time.Second
+
+// Webhook events
+const (
+	WEBHOOK_CONNECT    = "connect"
+	WEBHOOK_DISCONNECT = "disconnect"
+)
+
+// webhookClient sends the --on-connect-url and --on-disconnect-url requests
+var webhookClient = &http.Client{Timeout: WEBHOOK_TIMEOUT}
+
+// webhookPayload is the JSON body posted to a webhook
+type webhookPayload struct {
+	Event      string    `json:"event"`      // WEBHOOK_CONNECT or WEBHOOK_DISCONNECT
+	RemoteAddr string    `json:"remoteAddr"` // Address of the TCP client
+	Timestamp  time.Time `json:"timestamp"`  // When the event happened
+}
+
+// validWebhookURL reports whether value is an absolute http or https URL
+func validWebhookURL(value string) bool {
+	parsed, err := url.Parse(value)
+	return err == nil && (parsed.Scheme == "http" || parsed.Scheme == "https") && parsed.Host != ""
+}
+
+// fireWebhook posts the event to target in the background, so a slow or
+// failing endpoint never holds up the connection. Failures are only
+// reported on stderr.
+func fireWebhook(target, event, remoteAddr string) {
+	if target == "" {
+		return
+	}
+
+	payload := webhookPayload{Event: event, RemoteAddr: remoteAddr, Timestamp: time.Now()}
+	go func() {
+		body, err := json.Marshal(payload)
+		if err != nil {
+			return
+		}
+
+		resp, err := webhookClient.Post(target, "application/json", bytes.NewReader(body))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %s webhook failed: %v\n", event, err)
+			return
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode >= 300 {
+			fmt.Fprintf(os.Stderr, "Warning: %s webhook returned %s\n", event, resp.Status)
+		}
+	}()
+}
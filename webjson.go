@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// WEB_COMPRESS_MIN is the smallest JSON response compressed for clients
+// that accept it. Smaller bodies are sent as is.
+const WEB_COMPRESS_MIN = 1024
+
+// webZstdEncoder compresses whole responses with EncodeAll, which is safe
+// for concurrent use
+var webZstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest))
+
+// writeJSON encodes v as the JSON response body, compressed with zstd or
+// gzip when the client's Accept-Encoding allows it and the body is large
+// enough to benefit
+func writeJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	var body bytes.Buffer
+	if err := json.NewEncoder(&body).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Add("Vary", "Accept-Encoding")
+
+	if body.Len() < WEB_COMPRESS_MIN {
+		w.Write(body.Bytes())
+		return
+	}
+
+	switch encoding := acceptedEncoding(r); encoding {
+	case "zstd":
+		w.Header().Set("Content-Encoding", encoding)
+		w.Write(webZstdEncoder.EncodeAll(body.Bytes(), nil))
+	case "gzip":
+		w.Header().Set("Content-Encoding", encoding)
+		gz := gzip.NewWriter(w)
+		gz.Write(body.Bytes())
+		gz.Close()
+	default:
+		w.Write(body.Bytes())
+	}
+}
+
+// acceptedEncoding returns the preferred response encoding supported by
+// both sides: zstd, then gzip, or "" for an uncompressed response
+func acceptedEncoding(r *http.Request) string {
+	accepted := make(map[string]bool)
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+
+		// "q=0" means the client refuses the encoding
+		params = strings.ReplaceAll(params, " ", "")
+		if params == "q=0" || strings.HasPrefix(params, "q=0.") && strings.Trim(params[4:], "0") == "" {
+			continue
+		}
+		accepted[name] = true
+	}
+
+	for _, encoding := range []string{"zstd", "gzip"} {
+		if accepted[encoding] {
+			return encoding
+		}
+	}
+	return ""
+}
@@ -1,15 +1,26 @@
 package main
 
 import (
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
 	"html/template"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// WEB_PENDING_MESSAGES is the number of recorded messages waiting to be
+// added to the history before the oldest ones are dropped
+const WEB_PENDING_MESSAGES = 4096
+
 // WebUIConfig stores the web interface configuration
 type WebUIConfig struct {
 	Address string // IP address to bind the web UI to
@@ -19,16 +30,23 @@ type WebUIConfig struct {
 
 // Statistics maintains connection statistics and metrics for the application
 type Statistics struct {
-	BytesSent     uint64           // Total bytes sent across all connections
-	BytesReceived uint64           // Total bytes received across all connections
-	StartTime     time.Time        // Time when the application started
-	Connections   []ConnectionInfo // Information about active connections
-	mu            sync.RWMutex     // Mutex for thread-safe access
+	BytesSent     atomic.Uint64              // Total bytes sent across all connections, always counted
+	BytesReceived atomic.Uint64              // Total bytes received across all connections, always counted
+	Duplicates    atomic.Uint64              // Duplicate datagrams dropped by --dedup
+	Corrupt       atomic.Uint64              // Datagrams dropped by --checksum
+	Incomplete    atomic.Uint64              // Chunked messages dropped with chunks missing
+	Unacked       atomic.Uint64              // Datagrams given up on by --ack
+	Rates         RateHistory                // Recent send and receive rates for /api/stats/history
+	StartTime     time.Time                  // Time when the application started
+	Connections   []*ConnectionInfo          // Information about active connections, in arrival order
+	byAddr        map[string]*ConnectionInfo // Connections indexed by remote address
+	mu            sync.RWMutex               // Mutex for thread-safe access
 }
 
 // ConnectionInfo stores detailed information about a single connection
 type ConnectionInfo struct {
 	RemoteAddr  string    `json:"remoteAddr"`  // Remote address (IP:port)
+	Label       string    `json:"label"`       // Label sent by the client with --label, or the remote address
 	LocalAddr   string    `json:"localAddr"`   // Local address (IP:port)
 	ConnectedAt time.Time `json:"connectedAt"` // When the connection was established
 	BytesIn     uint64    `json:"bytesIn"`     // Bytes received from this connection
@@ -37,63 +55,169 @@ type ConnectionInfo struct {
 	IsActive    bool      `json:"isActive"`    // Whether the connection is currently active
 }
 
+// ConfigResponse is the configuration returned by /api/config. Fields are
+// only ever added, so API clients can rely on their names and types.
+// Secrets such as tokens aren't included.
+type ConfigResponse struct {
+	Mode          string `json:"mode"`          // "sender", "receiver" or "ping"
+	Port          int    `json:"port"`          // Port listened on or connected to
+	Host          string `json:"host"`          // Host connected to (for sender mode)
+	BindAddr      string `json:"bindAddr"`      // Address listened on (for receiver mode)
+	Protocol      string `json:"protocol"`      // "tcp" or "udp"
+	MultiConn     bool   `json:"multiConn"`     // Whether multiple connections (--multi) are enabled
+	Compression   string `json:"compression"`   // Per-message compression algorithm, or "none"
+	CompressLevel int    `json:"compressLevel"` // Compression level
+	Chat          bool   `json:"chat"`          // Whether the chat interface is enabled
+	MDNS          bool   `json:"mdns"`          // Whether mDNS announcement or discovery is enabled
+	MDNSService   string `json:"mdnsService"`   // mDNS service type announced or browsed
+	OutputFormat  string `json:"outputFormat"`  // How received data is written to stdout
+	Session       string `json:"session"`       // Relay session, redacted, or empty
+	CanDisconnect bool   `json:"canDisconnect"` // Whether TCP clients can be closed through /api/connections with --web-token
+}
+
 // MessageBuffer stores recent messages for display in the web UI
 type MessageBuffer struct {
 	Messages []Message    // Circular buffer of messages
 	Size     int          // Maximum number of messages to store
+	lastSeq  uint64       // Sequence number of the newest message
 	mu       sync.RWMutex // Mutex for thread-safe access
 }
 
 // Message represents a single sent or received message
 type Message struct {
-	Content   string    `json:"content"`   // Content of the message (may be truncated)
-	Direction string    `json:"direction"` // "in", "out", or "system"
-	Timestamp time.Time `json:"timestamp"` // When the message was sent/received
-	Size      int       `json:"size"`      // Original size in bytes
-	From      string    `json:"from"`      // Source address
-	To        string    `json:"to"`        // Destination address
+	Seq        uint64    `json:"seq"`        // Position in the history, increasing in the order messages were added
+	Content    string    `json:"content"`    // Content of the message (may be truncated)
+	Direction  string    `json:"direction"`  // "in", "out", or "system"
+	Timestamp  time.Time `json:"timestamp"`  // When the message was sent/received
+	Size       int       `json:"size"`       // Original size in bytes
+	From       string    `json:"from"`       // Source address
+	To         string    `json:"to"`         // Destination address
+	Compressed bool      `json:"compressed"` // Whether the data was compressed on the wire
 }
 
-var (
-	stats         Statistics
-	messageBuffer MessageBuffer
-)
+// WebUIServer holds the recorded statistics and message history of a pipe
+// and serves them over HTTP
+type WebUIServer struct {
+	config      *Config           // Application configuration
+	pipe        *TCPPipe          // TCP pipe whose clients can be closed (nil for UDP)
+	multiplexer *MultiplexManager // Multiplexer shown by /api/multiplex (nil without one)
+	stats       Statistics        // Connection statistics
+	messages    MessageBuffer     // Recent message history
+	latency     LatencyHistory    // Round-trip times measured in ping mode
+	events      *EventBroker      // Live event stream subscribers
+	tail        *EventBroker      // Raw received data for /api/tail clients
+	details     bool              // Record per-connection statistics and message history, not just totals
+	pending     chan Message      // Recorded messages waiting to be added to the history
+	shutdown    func()            // Gracefully stops the process, if set
+	target      Target            // Host, port and protocol shown by /api/config
+	targetMu    sync.RWMutex      // Guards target, which discovery may change
+	mux         *http.ServeMux    // HTTP routes of this server
+}
 
-// StartWebUI initializes and starts the web user interface
-// This runs in a separate goroutine so it doesn't block the main application
-func StartWebUI(config *WebUIConfig, parentConfig *Config) {
-	if !config.Enabled {
-		return
+// NewWebUIServer creates the web interface state without starting the HTTP server
+func NewWebUIServer(parentConfig *Config) *WebUIServer {
+	ws := &WebUIServer{
+		config: parentConfig,
+		stats: Statistics{
+			StartTime:   time.Now(),
+			Connections: make([]*ConnectionInfo, 0),
+			byAddr:      make(map[string]*ConnectionInfo),
+		},
+		messages: MessageBuffer{
+			Messages: make([]Message, 0),
+			Size:     100, // Store the last 100 messages
+		},
+		events: NewEventBroker(),
+		tail:   NewEventBroker(),
+		mux:    http.NewServeMux(),
+		// Only the web interface and the periodic and JSON summaries use the details
+		details: parentConfig.webUI || parentConfig.statsInterval > 0 || parentConfig.summaryJSON != "",
+		pending: make(chan Message, WEB_PENDING_MESSAGES),
+		target:  Target{Host: parentConfig.host, Port: parentConfig.port, UseTCP: parentConfig.useTCP},
 	}
 
-	// Initialize statistics tracking
-	stats = Statistics{
-		StartTime:   time.Now(),
-		Connections: make([]ConnectionInfo, 0),
+	if ws.details {
+		go ws.flushMessages(parentConfig.webFlush)
 	}
 
-	// Initialize message history buffer
-	messageBuffer = MessageBuffer{
-		Messages: make([]Message, 0),
-		Size:     100, // Store the last 100 messages
+	// Setup HTTP routes
+	ws.mux.HandleFunc("/", handleRoot)
+	ws.mux.HandleFunc("/api/stats", ws.handleStats)
+	ws.mux.HandleFunc("/api/stats/history", ws.handleRateHistory)
+	ws.mux.HandleFunc("/api/connections", ws.handleConnections)
+	ws.mux.HandleFunc("/api/connections/", ws.handleConnectionAction)
+	ws.mux.HandleFunc("/api/messages", ws.handleMessages)
+	ws.mux.HandleFunc("/api/config", ws.handleConfig)
+	ws.mux.HandleFunc("/api/stream", ws.handleStream)
+	ws.mux.HandleFunc("/api/latency", ws.handleLatency)
+	ws.mux.HandleFunc("/api/tail", ws.handleTail)
+	ws.mux.HandleFunc("/api/multiplex", ws.handleMultiplex)
+	ws.mux.HandleFunc("/api/shutdown", ws.handleShutdown)
+
+	return ws
+}
+
+// StartWebUI initializes and starts the web user interface. The port is
+// bound before returning, so an address in use is reported as an error;
+// requests are then served in a separate goroutine.
+func StartWebUI(config *WebUIConfig, parentConfig *Config) (*WebUIServer, error) {
+	if !config.Enabled {
+		return nil, nil
 	}
 
-	// Setup HTTP routes
-	http.HandleFunc("/", handleRoot)
-	http.HandleFunc("/api/stats", handleStats)
-	http.HandleFunc("/api/messages", handleMessages)
-	http.HandleFunc("/api/config", func(w http.ResponseWriter, r *http.Request) {
-		handleConfig(w, r, parentConfig)
-	})
+	addr := hostPort(config.Address, config.Port)
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start web interface: %v", err)
+	}
+
+	ws := NewWebUIServer(parentConfig)
+	go ws.sampleRates(RATE_SAMPLE_INTERVAL)
 
-	// Start the HTTP server in a separate goroutine
-	addr := fmt.Sprintf("%s:%d", config.Address, config.Port)
+	fmt.Printf("Web interface started at http://%s\n", addr)
 	go func() {
-		fmt.Printf("Web interface started at http://%s\n", addr)
-		if err := http.ListenAndServe(addr, nil); err != nil {
-			log.Fatalf("Error starting web server: %v", err)
+		if err := http.Serve(listener, ws.mux); err != nil {
+			log.Printf("Web interface stopped: %v", err)
 		}
 	}()
+
+	return ws, nil
+}
+
+// SetPipe assigns the TCP pipe whose clients can be closed from the interface
+func (ws *WebUIServer) SetPipe(pipe *TCPPipe) {
+	ws.pipe = pipe
+}
+
+// Target is where a sender connects, or the port a receiver listens on
+type Target struct {
+	Host   string
+	Port   int
+	UseTCP bool
+}
+
+// SetTarget updates the host, port and protocol shown by /api/config. mDNS
+// discovery resolves them after the web interface has started.
+func (ws *WebUIServer) SetTarget(host string, port int, useTCP bool) {
+	ws.targetMu.Lock()
+	defer ws.targetMu.Unlock()
+	ws.target = Target{Host: host, Port: port, UseTCP: useTCP}
+}
+
+// SetShutdownHandler assigns the function called by POST /api/shutdown
+func (ws *WebUIServer) SetShutdownHandler(shutdown func()) {
+	ws.shutdown = shutdown
+}
+
+// authorized reports whether the request carries the configured --web-token
+// as a bearer token. Without a token, control endpoints are disabled.
+func (ws *WebUIServer) authorized(r *http.Request) bool {
+	if ws.config.webToken == "" {
+		return false
+	}
+
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(ws.config.webToken)) == 1
 }
 
 // handleRoot serves the main HTML page of the web interface
@@ -108,111 +232,491 @@ func handleRoot(w http.ResponseWriter, r *http.Request) {
 }
 
 // handleStats returns current statistics in JSON format
-func handleStats(w http.ResponseWriter, r *http.Request) {
-	stats.mu.RLock()
-	defer stats.mu.RUnlock()
+func (ws *WebUIServer) handleStats(w http.ResponseWriter, r *http.Request) {
+	ws.stats.mu.RLock()
+	defer ws.stats.mu.RUnlock()
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"bytesSent":     stats.BytesSent,
-		"bytesReceived": stats.BytesReceived,
-		"uptime":        time.Since(stats.StartTime).String(),
-		"connections":   stats.Connections,
+	// Ages are computed here so clients with a skewed clock show them right
+	type connectionStats struct {
+		*ConnectionInfo
+		AgeSeconds  float64 `json:"ageSeconds"`  // Time since the connection was established
+		IdleSeconds float64 `json:"idleSeconds"` // Time since the connection was last active
+	}
+	now := time.Now()
+	connections := make([]connectionStats, len(ws.stats.Connections))
+	for i, conn := range ws.stats.Connections {
+		connections[i] = connectionStats{
+			ConnectionInfo: conn,
+			AgeSeconds:     now.Sub(conn.ConnectedAt).Seconds(),
+			IdleSeconds:    now.Sub(conn.LastActive).Seconds(),
+		}
+	}
+
+	writeJSON(w, r, map[string]interface{}{
+		"bytesSent":      ws.stats.BytesSent.Load(),
+		"bytesReceived":  ws.stats.BytesReceived.Load(),
+		"duplicates":     ws.stats.Duplicates.Load(),
+		"checksumErrors": ws.stats.Corrupt.Load(),
+		"incomplete":     ws.stats.Incomplete.Load(),
+		"unacked":        ws.stats.Unacked.Load(),
+		"uptime":         time.Since(ws.stats.StartTime).String(),
+		"connections":    connections,
 	})
 }
 
-// handleMessages returns the message history buffer in JSON format
-func handleMessages(w http.ResponseWriter, r *http.Request) {
-	messageBuffer.mu.RLock()
-	defer messageBuffer.mu.RUnlock()
+// handleConnections returns the tracked connections in JSON format.
+// Optional query parameters: sort (bytesIn, bytesOut or lastActive), order
+// (asc or desc, default desc), offset and limit. The total number of
+// connections before paging is sent in the X-Total-Count header.
+func (ws *WebUIServer) handleConnections(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	sortKey := query.Get("sort")
+	if sortKey != "" && sortKey != "bytesIn" && sortKey != "bytesOut" && sortKey != "lastActive" {
+		http.Error(w, "Invalid sort, expected bytesIn, bytesOut or lastActive", http.StatusBadRequest)
+		return
+	}
+
+	order := query.Get("order")
+	if order != "" && order != "asc" && order != "desc" {
+		http.Error(w, "Invalid order, expected asc or desc", http.StatusBadRequest)
+		return
+	}
+	descending := order != "asc"
+
+	offset := 0
+	if value := query.Get("offset"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			http.Error(w, "Invalid offset", http.StatusBadRequest)
+			return
+		}
+		offset = n
+	}
+
+	limit := 0
+	if value := query.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	ws.stats.mu.RLock()
+	defer ws.stats.mu.RUnlock()
+
+	// Sort a copy so the recorded order is left untouched
+	connections := ws.stats.snapshotLocked()
+
+	if sortKey != "" {
+		sort.SliceStable(connections, func(i, j int) bool {
+			a, b := connections[i], connections[j]
+			if descending {
+				a, b = b, a
+			}
+			switch sortKey {
+			case "bytesIn":
+				return a.BytesIn < b.BytesIn
+			case "bytesOut":
+				return a.BytesOut < b.BytesOut
+			default:
+				return a.LastActive.Before(b.LastActive)
+			}
+		})
+	}
+
+	total := len(connections)
+	if offset > total {
+		offset = total
+	}
+	connections = connections[offset:]
+	if limit > 0 && limit < len(connections) {
+		connections = connections[:limit]
+	}
+
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	writeJSON(w, r, connections)
+}
+
+// handleConnectionAction handles POST /api/connections/{addr}/close, which
+// disconnects the TCP client with the given remote address. Like
+// /api/shutdown, it requires --web-token.
+func (ws *WebUIServer) handleConnectionAction(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/api/connections/")
+	addr := strings.TrimSuffix(path, "/close")
+	if addr == path || addr == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !ws.authorized(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		http.Error(w, "Invalid address, expected host:port", http.StatusBadRequest)
+		return
+	}
+
+	if ws.pipe == nil || !ws.pipe.CloseClient(addr) {
+		http.Error(w, "Connection not found", http.StatusNotFound)
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(messageBuffer.Messages)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"closed": addr,
+	})
 }
 
-// handleConfig returns the current application configuration in JSON format
-func handleConfig(w http.ResponseWriter, r *http.Request, config *Config) {
+// handleShutdown handles POST /api/shutdown: it answers right away and then
+// stops accepting connections, drains the active ones and exits with status 0
+func (ws *WebUIServer) handleShutdown(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !ws.authorized(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if ws.shutdown == nil {
+		http.Error(w, "Shutdown not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	ws.RecordMessage("Shutdown requested", "system", 0, r.RemoteAddr, "")
+	fmt.Fprintf(os.Stderr, "Shutdown requested from %s\n", r.RemoteAddr)
+
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"mode":     config.mode,
-		"port":     config.port,
-		"host":     config.host,
-		"bindAddr": config.bindAddr,
+		"status": "shutting down",
 	})
+
+	go ws.shutdown()
 }
 
-// RecordSentData updates statistics when data is sent
-func RecordSentData(bytes uint64, to string) {
-	stats.mu.Lock()
-	defer stats.mu.Unlock()
-	stats.BytesSent += bytes
-
-	// Update the corresponding connection
-	for i := range stats.Connections {
-		if stats.Connections[i].RemoteAddr == to {
-			stats.Connections[i].BytesOut += bytes
-			stats.Connections[i].LastActive = time.Now()
-			stats.Connections[i].IsActive = true
+// handleMessages returns the message history buffer in JSON format.
+// Optional query parameters: direction (in, out or system), q (case-insensitive
+// substring of the content), after (sequence number, only messages added
+// later are returned), since (RFC 3339 timestamp, only newer messages are
+// returned) and limit.
+func (ws *WebUIServer) handleMessages(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	direction := query.Get("direction")
+	if direction != "" && direction != "in" && direction != "out" && direction != "system" {
+		http.Error(w, "Invalid direction, expected in, out or system", http.StatusBadRequest)
+		return
+	}
+
+	search := strings.ToLower(query.Get("q"))
+
+	limit := 0
+	if value := query.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	var after uint64
+	if value := query.Get("after"); value != "" {
+		n, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid after, expected a message sequence number", http.StatusBadRequest)
+			return
+		}
+		after = n
+	}
+
+	var since time.Time
+	if value := query.Get("since"); value != "" {
+		t, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			http.Error(w, "Invalid since, expected an RFC 3339 timestamp", http.StatusBadRequest)
+			return
+		}
+		since = t
+	}
+
+	ws.messages.mu.RLock()
+	defer ws.messages.mu.RUnlock()
+
+	// Filter under the lock so only the requested messages are sent
+	messages := make([]Message, 0, len(ws.messages.Messages))
+	for _, msg := range ws.messages.Messages {
+		// Newest first, so the rest were all added before
+		if msg.Seq <= after {
 			break
 		}
+		if !since.IsZero() && !msg.Timestamp.After(since) {
+			continue
+		}
+		if direction != "" && msg.Direction != direction {
+			continue
+		}
+		if search != "" && !strings.Contains(strings.ToLower(msg.Content), search) {
+			continue
+		}
+		messages = append(messages, msg)
+		if limit > 0 && len(messages) >= limit {
+			break
+		}
+	}
+
+	writeJSON(w, r, messages)
+}
+
+// handleConfig returns the current application configuration in JSON format
+func (ws *WebUIServer) handleConfig(w http.ResponseWriter, r *http.Request) {
+	ws.targetMu.RLock()
+	target := ws.target
+	ws.targetMu.RUnlock()
+
+	protocol := "udp"
+	if target.UseTCP || ws.config.session != "" {
+		protocol = "tcp"
+	}
+
+	writeJSON(w, r, ConfigResponse{
+		Mode:          ws.config.mode,
+		Port:          target.Port,
+		Host:          target.Host,
+		BindAddr:      ws.config.bindAddr,
+		Protocol:      protocol,
+		MultiConn:     ws.config.multiConn,
+		Compression:   ws.config.compression,
+		CompressLevel: ws.config.compressLevel,
+		Chat:          ws.config.chat,
+		MDNS:          ws.config.enableMDNS,
+		MDNSService:   ws.config.mdnsService,
+		OutputFormat:  ws.config.outputFormat,
+		Session:       redactSession(ws.config.session),
+		CanDisconnect: ws.pipe != nil && ws.config.mode == "receiver" && ws.config.webToken != "",
+	})
+}
+
+// snapshotLocked returns a copy of the connections that can be used after
+// the lock is released. The caller must hold s.mu.
+func (s *Statistics) snapshotLocked() []ConnectionInfo {
+	connections := make([]ConnectionInfo, len(s.Connections))
+	for i, conn := range s.Connections {
+		connections[i] = *conn
 	}
+	return connections
 }
 
-// RecordReceivedData updates statistics when data is received
-func RecordReceivedData(bytes uint64, from string) {
-	stats.mu.Lock()
-	defer stats.mu.Unlock()
-	stats.BytesReceived += bytes
-
-	// Check if the connection already exists
-	var found bool
-	for i := range stats.Connections {
-		if stats.Connections[i].RemoteAddr == from {
-			stats.Connections[i].BytesIn += bytes
-			stats.Connections[i].LastActive = time.Now()
-			stats.Connections[i].IsActive = true
-			found = true
-			break
+// RecordSentData updates statistics when data is sent. Only the totals are
+// counted unless details are recorded.
+func (ws *WebUIServer) RecordSentData(bytes uint64, to string) {
+	ws.stats.BytesSent.Add(bytes)
+	if !ws.details {
+		return
+	}
+
+	ws.stats.mu.Lock()
+	defer ws.stats.mu.Unlock()
+
+	// Update the connection if it already exists, otherwise add it
+	if conn, ok := ws.stats.byAddr[to]; ok {
+		conn.BytesOut += bytes
+		conn.LastActive = time.Now()
+		conn.IsActive = true
+	} else {
+		conn := &ConnectionInfo{
+			RemoteAddr:  to,
+			Label:       to,
+			ConnectedAt: time.Now(),
+			BytesOut:    bytes,
+			LastActive:  time.Now(),
+			IsActive:    true,
 		}
+		ws.stats.Connections = append(ws.stats.Connections, conn)
+		ws.stats.byAddr[to] = conn
+		ws.events.Publish("connection", *conn)
 	}
 
-	// If not found, add a new connection
-	if !found {
-		stats.Connections = append(stats.Connections, ConnectionInfo{
+	ws.publishStatsLocked()
+}
+
+// RecordReceivedData updates statistics when data is received. Only the
+// totals are counted unless details are recorded.
+func (ws *WebUIServer) RecordReceivedData(bytes uint64, from string) {
+	ws.stats.BytesReceived.Add(bytes)
+	if !ws.details {
+		return
+	}
+
+	ws.stats.mu.Lock()
+	defer ws.stats.mu.Unlock()
+
+	// Update the connection if it already exists, otherwise add it
+	if conn, ok := ws.stats.byAddr[from]; ok {
+		conn.BytesIn += bytes
+		conn.LastActive = time.Now()
+		conn.IsActive = true
+	} else {
+		conn := &ConnectionInfo{
 			RemoteAddr:  from,
+			Label:       from,
 			ConnectedAt: time.Now(),
 			BytesIn:     bytes,
 			LastActive:  time.Now(),
 			IsActive:    true,
-		})
+		}
+		ws.stats.Connections = append(ws.stats.Connections, conn)
+		ws.stats.byAddr[from] = conn
+		ws.events.Publish("connection", *conn)
 	}
+
+	ws.publishStatsLocked()
+}
+
+// publishStatsLocked sends the current totals to the event stream.
+// The caller must hold ws.stats.mu.
+func (ws *WebUIServer) publishStatsLocked() {
+	ws.events.Publish("stats", map[string]interface{}{
+		"bytesSent":     ws.stats.BytesSent.Load(),
+		"bytesReceived": ws.stats.BytesReceived.Load(),
+		"uptime":        time.Since(ws.stats.StartTime).String(),
+	})
 }
 
 // RecordMessage adds a message to the history buffer
-func RecordMessage(content string, direction string, size int, from, to string) {
+func (ws *WebUIServer) RecordMessage(content string, direction string, size int, from, to string) {
+	ws.recordMessage(content, direction, size, from, to, false)
+}
+
+// RecordCompressedMessage adds a message that was compressed on the wire
+func (ws *WebUIServer) RecordCompressedMessage(content string, direction string, size int, from, to string) {
+	ws.recordMessage(content, direction, size, from, to, true)
+}
+
+// recordMessage stores a message and publishes it to the event stream
+func (ws *WebUIServer) recordMessage(content string, direction string, size int, from, to string, compressed bool) {
+	if !ws.details {
+		return
+	}
+
+	// With --web-no-content, traffic is recorded without its contents
+	if ws.config.webNoContent && direction != "system" {
+		ws.queueMessage("", direction, size, from, to, compressed)
+		return
+	}
+
+	// With --web-split-lines, received data gets one entry per line. Each
+	// entry's size is the length of its line.
+	if ws.config.webSplitLines && direction == "in" && strings.Contains(content, "\n") {
+		lines := strings.Split(strings.TrimSuffix(content, "\n"), "\n")
+		for _, line := range lines {
+			line = strings.TrimSuffix(line, "\r")
+			ws.queueMessage(line, direction, len(line), from, to, compressed)
+		}
+		return
+	}
+
+	ws.queueMessage(content, direction, size, from, to, compressed)
+}
+
+// queueMessage hands a message over to flushMessages without waiting for
+// the history lock
+func (ws *WebUIServer) queueMessage(content string, direction string, size int, from, to string, compressed bool) {
 	if len(content) > 100 {
 		// Truncate very long messages for display
 		content = content[:100] + "..."
 	}
 
 	msg := Message{
-		Content:   content,
-		Direction: direction,
-		Timestamp: time.Now(),
-		Size:      size,
-		From:      from,
-		To:        to,
+		Content:    content,
+		Direction:  direction,
+		Timestamp:  time.Now(),
+		Size:       size,
+		From:       from,
+		To:         to,
+		Compressed: compressed,
+	}
+
+	// When the queue is full, the oldest pending message is dropped
+	for {
+		select {
+		case ws.pending <- msg:
+			return
+		default:
+		}
+
+		select {
+		case <-ws.pending:
+		default:
+		}
+	}
+}
+
+// flushMessages adds the pending messages to the history and the event
+// stream every interval, taking the history lock once per batch
+func (ws *WebUIServer) flushMessages(interval time.Duration) {
+	if interval <= 0 {
+		interval = DEFAULT_WEB_FLUSH
 	}
 
-	messageBuffer.mu.Lock()
-	defer messageBuffer.mu.Unlock()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
 
-	// Adds at the beginning so the most recent appear first
-	messageBuffer.Messages = append([]Message{msg}, messageBuffer.Messages...)
+	for range ticker.C {
+		var batch []Message
+	drain:
+		for {
+			select {
+			case msg := <-ws.pending:
+				batch = append(batch, msg)
+			default:
+				break drain
+			}
+		}
+
+		if len(batch) == 0 {
+			continue
+		}
+
+		// Sequence numbers are given here, under the lock, so they follow
+		// the order of the history even when timestamps don't
+		ws.messages.mu.Lock()
+		for i := range batch {
+			ws.messages.lastSeq++
+			batch[i].Seq = ws.messages.lastSeq
+		}
+
+		// Most recent first, like the rest of the history
+		newest := make([]Message, len(batch))
+		for i, msg := range batch {
+			newest[len(batch)-1-i] = msg
+		}
+		ws.messages.Messages = append(newest, ws.messages.Messages...)
 
-	// Limits the buffer size
-	if len(messageBuffer.Messages) > messageBuffer.Size {
-		messageBuffer.Messages = messageBuffer.Messages[:messageBuffer.Size]
+		// Limits the buffer size
+		if len(ws.messages.Messages) > ws.messages.Size {
+			ws.messages.Messages = ws.messages.Messages[:ws.messages.Size]
+		}
+		ws.messages.mu.Unlock()
+
+		for _, msg := range batch {
+			ws.events.Publish("message", msg)
+		}
 	}
 }
 
@@ -274,6 +778,17 @@ const indexHTML = `<!DOCTYPE html>
             color: #7f8c8d;
             font-size: 0.9em;
         }
+        .sparkline {
+            width: 100%;
+            height: 30px;
+            margin-top: 8px;
+        }
+        .sparkline polyline {
+            fill: none;
+            stroke: #2980b9;
+            stroke-width: 1.5;
+            vector-effect: non-scaling-stroke;
+        }
         table {
             width: 100%;
             border-collapse: collapse;
@@ -348,6 +863,17 @@ const indexHTML = `<!DOCTYPE html>
         .status-inactive {
             background-color: #e74c3c;
         }
+        .filter-control {
+            display: flex;
+            gap: 10px;
+            align-items: center;
+            margin-bottom: 15px;
+        }
+        .filter-control select, .filter-control input {
+            padding: 5px;
+            border: 1px solid #ddd;
+            border-radius: 3px;
+        }
         .refresh-control {
             margin-bottom: 20px;
             display: flex;
@@ -365,6 +891,17 @@ const indexHTML = `<!DOCTYPE html>
         .refresh-button:hover {
             background-color: #2980b9;
         }
+        .close-button {
+            background-color: #e74c3c;
+            color: white;
+            border: none;
+            padding: 4px 10px;
+            border-radius: 5px;
+            cursor: pointer;
+        }
+        .close-button:hover {
+            background-color: #c0392b;
+        }
         .footer {
             text-align: center;
             margin-top: 30px;
@@ -407,10 +944,12 @@ const indexHTML = `<!DOCTYPE html>
             <div class="stat-card">
                 <div class="stat-value" id="bytes-sent">0</div>
                 <div class="stat-label">Bytes Sent</div>
+                <svg class="sparkline" viewBox="0 0 100 30" preserveAspectRatio="none"><polyline id="sent-sparkline" points=""></polyline></svg>
             </div>
             <div class="stat-card">
                 <div class="stat-value" id="bytes-received">0</div>
                 <div class="stat-label">Bytes Received</div>
+                <svg class="sparkline" viewBox="0 0 100 30" preserveAspectRatio="none"><polyline id="received-sparkline" points=""></polyline></svg>
             </div>
             <div class="stat-card">
                 <div class="stat-value" id="active-connections">0</div>
@@ -435,11 +974,13 @@ const indexHTML = `<!DOCTYPE html>
                 <thead>
                     <tr>
                         <th>Status</th>
-                        <th>Remote Address</th>
+                        <th>Connection</th>
                         <th>Connected At</th>
+                        <th>Age</th>
                         <th>Last Active</th>
                         <th>Bytes In</th>
                         <th>Bytes Out</th>
+                        <th></th>
                     </tr>
                 </thead>
                 <tbody id="connections-body">
@@ -452,6 +993,19 @@ const indexHTML = `<!DOCTYPE html>
     <div class="tab-content" id="messages-tab">
         <div class="card">
             <h2>Message Log</h2>
+            <div class="filter-control">
+                <label for="message-direction">Direction:</label>
+                <select id="message-direction">
+                    <option value="">All</option>
+                    <option value="in">Incoming</option>
+                    <option value="out">Outgoing</option>
+                    <option value="system">System</option>
+                </select>
+                <label for="message-search">Search:</label>
+                <input type="search" id="message-search" placeholder="Text in message">
+                <label for="message-limit">Limit:</label>
+                <input type="number" id="message-limit" min="0" placeholder="All">
+            </div>
             <div id="message-log">
                 <!-- Messages will be listed here -->
             </div>
@@ -501,6 +1055,11 @@ const indexHTML = `<!DOCTYPE html>
                     // Activate the clicked tab
                     this.classList.add('active');
                     document.getElementById(this.dataset.tab + '-tab').classList.add('active');
+
+                    // The target may have changed since, e.g. once discovery resolves
+                    if (this.dataset.tab === 'configuration') {
+                        updateConfigTab();
+                    }
                 });
             });
 
@@ -522,8 +1081,13 @@ const indexHTML = `<!DOCTYPE html>
             // Function to calculate time elapsed
             function timeAgo(dateString) {
                 const date = new Date(dateString);
-                const seconds = Math.floor((new Date() - date) / 1000);
-                
+                return secondsAgo((new Date() - date) / 1000);
+            }
+
+            // Function to format a number of seconds elapsed
+            function secondsAgo(seconds) {
+                seconds = Math.max(0, Math.floor(seconds));
+
                 let interval = seconds / 31536000;
                 if (interval > 1) return Math.floor(interval) + " years ago";
                 
@@ -553,9 +1117,10 @@ const indexHTML = `<!DOCTYPE html>
                 }
             }
 
-            async function fetchMessages() {
+            async function fetchMessages(params) {
                 try {
-                    const response = await fetch('/api/messages');
+                    const query = new URLSearchParams(params || {}).toString();
+                    const response = await fetch('/api/messages' + (query ? '?' + query : ''));
                     return await response.json();
                 } catch (error) {
                     console.error('Error fetching messages:', error);
@@ -563,6 +1128,30 @@ const indexHTML = `<!DOCTYPE html>
                 }
             }
 
+            // Disconnecting clients needs --web-token, asked once per browser tab
+            async function closeConnection(addr) {
+                const token = sessionStorage.getItem('npWebToken') || prompt('Web token (--web-token) to disconnect clients:');
+                if (!token) return;
+                try {
+                    const response = await fetch('/api/connections/' + encodeURIComponent(addr) + '/close', {
+                        method: 'POST',
+                        headers: { 'Authorization': 'Bearer ' + token }
+                    });
+                    if (response.status === 401) {
+                        sessionStorage.removeItem('npWebToken');
+                        alert('Wrong web token');
+                    } else {
+                        sessionStorage.setItem('npWebToken', token);
+                        if (!response.ok) {
+                            console.error('Error closing connection:', await response.text());
+                        }
+                    }
+                } catch (error) {
+                    console.error('Error closing connection:', error);
+                }
+                updateDashboard();
+            }
+
             async function fetchConfig() {
                 try {
                     const response = await fetch('/api/config');
@@ -573,6 +1162,24 @@ const indexHTML = `<!DOCTYPE html>
                 }
             }
 
+            async function fetchRateHistory() {
+                try {
+                    const response = await fetch('/api/stats/history');
+                    return await response.json();
+                } catch (error) {
+                    console.error('Error fetching rate history:', error);
+                    return [];
+                }
+            }
+
+            // Draw the rates of the last minute, scaled to the highest one
+            function drawSparkline(id, rates) {
+                const max = Math.max(1, ...rates);
+                const step = rates.length > 1 ? 100 / (rates.length - 1) : 0;
+                const points = rates.map((rate, i) => (i * step).toFixed(1) + ',' + (30 - rate / max * 28).toFixed(1));
+                document.getElementById(id).setAttribute('points', points.join(' '));
+            }
+
             // Function to update the dashboard
             async function updateDashboard() {
                 const stats = await fetchStats();
@@ -580,6 +1187,10 @@ const indexHTML = `<!DOCTYPE html>
 
                 document.getElementById('bytes-sent').textContent = formatBytes(stats.bytesSent);
                 document.getElementById('bytes-received').textContent = formatBytes(stats.bytesReceived);
+
+                const history = await fetchRateHistory();
+                drawSparkline('sent-sparkline', history.map(sample => sample.sent));
+                drawSparkline('received-sparkline', history.map(sample => sample.received));
                 
                 const activeConnections = stats.connections.filter(c => c.isActive).length;
                 document.getElementById('active-connections').textContent = activeConnections;
@@ -593,20 +1204,25 @@ const indexHTML = `<!DOCTYPE html>
                     const row = document.createElement('tr');
                     // JavaScript string template - We use normal strings with concatenation here to avoid issues with the Go compiler
                     row.innerHTML = '<td><span class="status-indicator ' + (conn.isActive ? 'status-active' : 'status-inactive') + '"></span> ' + (conn.isActive ? 'Active' : 'Inactive') + '</td>' +
-                        '<td>' + conn.remoteAddr + '</td>' +
+                        '<td>' + conn.label + (conn.label !== conn.remoteAddr ? ' (' + conn.remoteAddr + ')' : '') + '</td>' +
                         '<td>' + formatDate(conn.connectedAt) + '</td>' +
-                        '<td>' + formatDate(conn.lastActive) + ' (' + timeAgo(conn.lastActive) + ')</td>' +
+                        '<td>' + secondsAgo(conn.ageSeconds).replace(' ago', '') + '</td>' +
+                        '<td>' + formatDate(conn.lastActive) + ' (' + secondsAgo(conn.idleSeconds) + ')</td>' +
                         '<td>' + formatBytes(conn.bytesIn) + '</td>' +
-                        '<td>' + formatBytes(conn.bytesOut) + '</td>';
+                        '<td>' + formatBytes(conn.bytesOut) + '</td>' +
+                        '<td>' + (conn.isActive && canDisconnect ? '<button class="close-button">Disconnect</button>' : '') + '</td>';
+                    const closeButton = row.querySelector('.close-button');
+                    if (closeButton) {
+                        closeButton.addEventListener('click', () => closeConnection(conn.remoteAddr));
+                    }
                     connectionsBody.appendChild(row);
                 });
 
                 // Update the activity feed
-                const messages = await fetchMessages();
+                const recentMessages = await fetchMessages({ limit: 5 });
                 const activityFeed = document.getElementById('activity-feed');
                 activityFeed.innerHTML = '';
                 
-                const recentMessages = messages.slice(0, 5);
                 recentMessages.forEach(msg => {
                     const div = document.createElement('div');
                     div.className = 'message-item ' + (msg.direction === 'out' ? 'outgoing' : '');
@@ -614,34 +1230,62 @@ const indexHTML = `<!DOCTYPE html>
                     div.innerHTML = '<div class="message-content">' + msg.content + '</div>' +
                         '<div class="message-meta">' +
                             '<span>' + (msg.direction === 'out' ? 'Sent to' : 'Received from') + ' ' + (msg.direction === 'out' ? msg.to : msg.from) + '</span>' +
-                            '<span>' + formatBytes(msg.size) + ' | ' + timeAgo(msg.timestamp) + '</span>' +
+                            '<span>' + formatBytes(msg.size) + (msg.compressed ? ' compressed' : '') + ' | ' + timeAgo(msg.timestamp) + '</span>' +
                         '</div>';
                     activityFeed.appendChild(div);
                 });
             }
 
+            // Messages shown in the messages tab, newest first, and the
+            // filters they were fetched with
+            let shownMessages = [];
+            let shownFilters = null;
+
             // Function to update the messages tab
             async function updateMessagesTab() {
-                const messages = await fetchMessages();
+                const params = {};
+                const direction = document.getElementById('message-direction').value;
+                const search = document.getElementById('message-search').value;
+                const limit = document.getElementById('message-limit').value;
+                if (direction) params.direction = direction;
+                if (search) params.q = search;
+                if (limit) params.limit = limit;
+
+                // While the filters stay the same, only fetch the messages
+                // newer than those already shown
+                const filters = JSON.stringify(params);
+                if (filters === shownFilters && shownMessages.length > 0) {
+                    params.after = shownMessages[0].seq;
+                } else {
+                    shownMessages = [];
+                }
+
+                const messages = await fetchMessages(params);
+                shownFilters = filters;
+                shownMessages = messages.concat(shownMessages).slice(0, limit ? Number(limit) : 100);
                 const messageLog = document.getElementById('message-log');
                 messageLog.innerHTML = '';
                 
-                messages.forEach(msg => {
+                shownMessages.forEach(msg => {
                     const div = document.createElement('div');
                     div.className = 'message-item ' + (msg.direction === 'out' ? 'outgoing' : '');
                     // JavaScript string template - We use normal strings here
                     div.innerHTML = '<div class="message-content">' + msg.content + '</div>' +
                         '<div class="message-meta">' +
                             '<span>' + (msg.direction === 'out' ? 'Sent to' : 'Received from') + ' ' + (msg.direction === 'out' ? msg.to : msg.from) + '</span>' +
-                            '<span>' + formatBytes(msg.size) + ' | ' + formatDate(msg.timestamp) + '</span>' +
+                            '<span>' + formatBytes(msg.size) + (msg.compressed ? ' compressed' : '') + ' | ' + formatDate(msg.timestamp) + '</span>' +
                         '</div>';
                     messageLog.appendChild(div);
                 });
             }
 
+            // Whether the connections table offers Disconnect, from /api/config
+            let canDisconnect = false;
+
             // Function to update the configuration tab
             async function updateConfigTab() {
                 const config = await fetchConfig();
+                canDisconnect = config.canDisconnect === true;
                 
                 document.getElementById('config-mode').textContent = config.mode;
                 document.getElementById('config-port').textContent = config.port;
@@ -658,11 +1302,12 @@ const indexHTML = `<!DOCTYPE html>
                 modeBadge.style.fontWeight = 'bold';
             }
 
-            // Function to update all data
+            // Function to update all data. The configuration comes first, since
+            // it decides whether the dashboard shows Disconnect buttons.
             async function updateAllData() {
+                await updateConfigTab();
                 await updateDashboard();
                 await updateMessagesTab();
-                await updateConfigTab();
             }
 
             // Refresh configuration
@@ -679,6 +1324,9 @@ const indexHTML = `<!DOCTYPE html>
             }
             
             document.getElementById('auto-refresh').addEventListener('change', setupAutoRefresh);
+            document.getElementById('message-direction').addEventListener('change', updateMessagesTab);
+            document.getElementById('message-search').addEventListener('input', updateMessagesTab);
+            document.getElementById('message-limit').addEventListener('change', updateMessagesTab);
             document.getElementById('refresh-button').addEventListener('click', updateAllData);
             
             // Load initial data